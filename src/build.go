@@ -83,6 +83,14 @@ func init() {
 					"Useful for linking with C code. ",
 				Aliases: []string{"T"},
 			},
+			&cli.StringFlag{
+				Name:  "allocator",
+				Usage: "The function that allocates memory for new objects. Defaults to malloc. ",
+			},
+			&cli.StringFlag{
+				Name:  "deallocator",
+				Usage: "The function that frees deleted objects. Defaults to free. ",
+			},
 		},
 		Action: build,
 	},
@@ -141,6 +149,14 @@ func init() {
 						"Useful for linking with C code. ",
 					Aliases: []string{"T"},
 				},
+				&cli.StringFlag{
+					Name:  "allocator",
+					Usage: "The function that allocates memory for new objects. Defaults to malloc. ",
+				},
+				&cli.StringFlag{
+					Name:  "deallocator",
+					Usage: "The function that frees deleted objects. Defaults to free. ",
+				},
 			},
 			Action: run,
 		},
@@ -154,6 +170,8 @@ var tmpDir string
 var debug bool
 var header bool
 var pcache cache.PackageCache
+var allocator string
+var deallocator string
 var compiledCache map[string]bool
 
 func build(c *cli.Context) error {
@@ -199,6 +217,15 @@ func build(c *cli.Context) error {
 	header = c.Bool("header")
 	debug = c.Bool("debug")
 
+	allocator = c.String("allocator")
+	if allocator == "" {
+		allocator = conf.Compiler.Allocator
+	}
+	deallocator = c.String("deallocator")
+	if deallocator == "" {
+		deallocator = conf.Compiler.Deallocator
+	}
+
 	llFiles, imports, err := processIncludes(append([]string{f}, c.StringSlice("include")...))
 	if err != nil {
 		return err
@@ -360,6 +387,12 @@ func parseAndCompile(path string, wg *sync.WaitGroup, errs chan<- error, files *
 
 	comp := compiler.NewCompiler()
 	comp.PackageCache = pcache
+	if allocator != "" {
+		comp.Allocator = allocator
+	}
+	if deallocator != "" {
+		comp.Deallocator = deallocator
+	}
 	wDir, err := filepath.Abs(filepath.Dir(path))
 	if err != nil {
 		return "", err
@@ -0,0 +1,192 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/enum"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+	"github.com/vyPal/CaffeineC/lib/parser"
+)
+
+// A lambda compiles to a function that takes a pointer to its environment
+// before its own parameters. The environment is a heap allocated struct
+// holding the locals the lambda uses: a copy of their value, or a pointer to
+// their storage when they are captured by reference. A closure value is a fat
+// pointer {function, environment}, so every closure with the same signature
+// has the same type no matter what it captured.
+
+// closure is a registered closure type and the signature it is called with.
+type closure struct {
+	typ *types.StructType
+	sig *types.FuncType
+}
+
+// closureType returns the type of closures called with the signature `sig`.
+// Closure types are distinct *types.StructType instances, so they can be told
+// apart from the unnamed structs returned by functions with multiple return values.
+func (comp *Compiler) closureType(sig *types.FuncType) *types.StructType {
+	for _, c := range comp.closureTypes {
+		if c.sig.Equal(sig) {
+			return c.typ
+		}
+	}
+	impl := types.NewFunc(sig.RetType, append([]types.Type{types.I8Ptr}, sig.Params...)...)
+	impl.Variadic = sig.Variadic
+	typ := types.NewStruct(types.NewPointer(impl), types.I8Ptr)
+	comp.closureTypes = append(comp.closureTypes, closure{typ: typ, sig: sig})
+	return typ
+}
+
+// closureSignature returns the signature closures of type `t` are called with.
+func (comp *Compiler) closureSignature(t types.Type) (*types.FuncType, bool) {
+	for _, c := range comp.closureTypes {
+		if c.typ == t {
+			return c.sig, true
+		}
+	}
+	return nil, false
+}
+
+// isClosure reports whether `t` is a closure type.
+func (comp *Compiler) isClosure(t types.Type) bool {
+	_, ok := comp.closureSignature(t)
+	return ok
+}
+
+// closureScope captures the locals of the enclosing function as a lambda's body looks them up.
+type closureScope struct {
+	outer   *Context
+	root    *Context
+	envType *types.StructType
+	env     value.Value
+	last    ir.Instruction
+	values  []value.Value
+}
+
+// lookup captures the variable `name` of the enclosing function by copy.
+func (s *closureScope) lookup(name string) *Variable {
+	outer := s.outer.lookupVariable(name)
+	if outer == nil {
+		return nil
+	}
+	if _, ok := outer.Value.(*ir.Global); ok {
+		return outer
+	}
+	v, _ := s.capture(outer, false, lexer.Position{})
+	return v
+}
+
+// capture adds `outer` to the environment and binds it in the lambda's body.
+func (s *closureScope) capture(outer *Variable, byRef bool, pos lexer.Position) (*Variable, error) {
+	var val value.Value
+	if byRef {
+		addr, err := s.outer.addressOf(outer, pos)
+		if err != nil {
+			return nil, err
+		}
+		val = addr
+	} else {
+		val = s.outer.variableValue(outer)
+	}
+	index := len(s.envType.Fields)
+	s.envType.Fields = append(s.envType.Fields, val.Type())
+	s.values = append(s.values, val)
+
+	// Bind the variable at the start of the lambda, so every path can use it
+	field := ir.NewGetElementPtr(s.envType, s.env, constant.NewInt(types.I32, 0), constant.NewInt(types.I32, int64(index)))
+	insts := []ir.Instruction{field}
+	v := &Variable{Name: outer.Name, Type: val.Type(), Value: field, Constant: outer.Constant}
+	if byRef {
+		// The field holds the address of the variable, which is used as its storage
+		ptrType := val.Type().(*types.PointerType)
+		addr := ir.NewLoad(ptrType, field)
+		storage := ir.NewGetElementPtr(ptrType.ElemType, addr, constant.NewInt(types.I32, 0))
+		insts = append(insts, addr, storage)
+		v = &Variable{Name: outer.Name, Type: ptrType.ElemType, Value: storage}
+	}
+
+	entry := s.root.Block.Parent.Blocks[0]
+	for i, inst := range entry.Insts {
+		if inst == s.last {
+			rest := append(insts, entry.Insts[i+1:]...)
+			entry.Insts = append(entry.Insts[:i+1], rest...)
+			break
+		}
+	}
+	s.last = insts[len(insts)-1]
+
+	s.root.vars[outer.Name] = v
+	return v, nil
+}
+
+func (ctx *Context) compileLambda(l *parser.Lambda) (value.Value, error) {
+	var retType types.Type = types.Void
+	if l.ReturnType != nil {
+		retType = ctx.CFTypeToLLType(l.ReturnType)
+	}
+	params := []*ir.Param{ir.NewParam(".env", types.I8Ptr)}
+	var paramTypes []types.Type
+	for _, arg := range l.Parameters {
+		param := ir.NewParam(arg.Name, ctx.CFTypeToLLType(arg.Type))
+		params = append(params, param)
+		paramTypes = append(paramTypes, param.Type())
+	}
+	typ := ctx.closureType(types.NewFunc(retType, paramTypes...))
+
+	name := fmt.Sprintf("%s.lambda.%d", ctx.Block.Parent.Name(), ctx.Compiler.lambdas)
+	ctx.Compiler.lambdas++
+	fn := ctx.Module.NewFunc(name, retType, params...)
+	fn.Linkage = enum.LinkageInternal
+
+	lctx := NewContext(fn.NewBlock(""), ctx.Compiler)
+	lctx.className = ctx.className
+	envType := types.NewStruct()
+	env := lctx.NewBitCast(params[0], types.NewPointer(envType))
+	lctx.closure = &closureScope{outer: ctx, root: lctx, envType: envType, env: env, last: env}
+
+	for _, c := range l.Captures {
+		outer := ctx.lookupVariable(c.Name)
+		if outer == nil {
+			return nil, posError(c.Pos, "Variable %s not found", c.Name)
+		}
+		if _, ok := lctx.vars[c.Name]; ok {
+			return nil, posError(c.Pos, "Variable %s is captured twice", c.Name)
+		}
+		if _, err := lctx.closure.capture(outer, c.ByRef, c.Pos); err != nil {
+			return nil, err
+		}
+	}
+	lctx.spillArrayParams(fn)
+
+	if err := lctx.compileBody(l.Body); err != nil {
+		return nil, err
+	}
+	if lctx.Term == nil {
+		if retType.Equal(types.Void) {
+			lctx.NewRet(nil)
+		} else if !isReachable(lctx.Block) {
+			lctx.NewUnreachable()
+		} else {
+			return nil, posError(l.Pos, "Lambda does not return a value")
+		}
+	}
+
+	// Fill in the environment with the captured values
+	var envPtr value.Value = constant.NewNull(types.I8Ptr)
+	if len(envType.Fields) > 0 {
+		mem := ctx.allocate(envType, false)
+		for i, val := range lctx.closure.values {
+			field := ctx.NewGetElementPtr(envType, mem, constant.NewInt(types.I32, 0), constant.NewInt(types.I32, int64(i)))
+			ctx.NewStore(val, field)
+		}
+		envPtr = ctx.NewBitCast(mem, types.I8Ptr)
+	}
+
+	var result value.Value = ctx.NewInsertValue(constant.NewUndef(typ), fn, 0)
+	result = ctx.NewInsertValue(result, envPtr, 1)
+	return result, nil
+}
@@ -0,0 +1,41 @@
+package compiler
+
+import "testing"
+
+func TestClosures(t *testing.T) {
+	expectOutput(t, `
+func makeAdder(n: i64): closure(i64): i64 {
+	return func (x: i64): i64 { return x + n; };
+}
+func each(k: i64, f: closure(i64)) {
+	for (var i = 0; i < k; i = i + 1) { f(i); }
+}
+func main(): i32 {
+	var add5 = makeAdder(5);
+	var sum = 0;
+	each(4, func [&sum] (i: i64) { sum = sum + i; });
+	var c = 1;
+	var byCopy = func (): i64 { return c; };
+	c = 100;
+	printf("%ld sum=%ld copy=%ld\n", add5(10), sum, byCopy());
+	return 0;
+}
+`, "15 sum=6 copy=1\n")
+	expectError(t, `
+func main(): i32 {
+	var f = func [&nope] () {};
+	return 0;
+}
+`, "Variable nope not found")
+}
+
+func TestClosuresConcurrently(t *testing.T) {
+	// Each compiler has its own closure types, so compilers can run at the same time
+	expectIRConcurrently(t, `
+func apply(f: closure(i64): i64, v: i64): i64 { return f(v); }
+func main(): i32 {
+	var k = 2;
+	return (apply(func (x: i64): i64 { return x * k; }, 3)): i32;
+}
+`, "define i64 @apply")
+}
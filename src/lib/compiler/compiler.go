@@ -21,18 +21,44 @@ type Context struct {
 	vars          map[string]*Variable
 	structNames   map[*types.StructType]string
 	fc            *FlowControl
+	cleanup       *Cleanup
+	closure       *closureScope
+	className     string
 	RequestedType types.Type
 }
 
 type Variable struct {
-	Name  string
-	Type  types.Type
-	Value value.Value
+	Name     string
+	Type     types.Type
+	Value    value.Value
+	Constant bool
 }
 
 type FlowControl struct {
-	Leave    *ir.Block
-	Continue *ir.Block
+	Leave           *ir.Block
+	Continue        *ir.Block
+	LeaveCleanup    *Cleanup
+	ContinueCleanup *Cleanup
+	Label           string
+	outer           *FlowControl
+}
+
+// lookupLoop finds the innermost enclosing loop with the given label, or the
+// innermost enclosing loop whatever its label if `label` is empty.
+func (fc *FlowControl) lookupLoop(label string) *FlowControl {
+	for ; fc != nil; fc = fc.outer {
+		if (label == "" || fc.Label == label) && fc.Continue != nil {
+			return fc
+		}
+	}
+	return nil
+}
+
+// Cleanup is code that has to run whenever control leaves a scope early,
+// for example popping an exception handler or running a finally block.
+type Cleanup struct {
+	parent *Cleanup
+	Emit   func(ctx *Context) error
 }
 
 func NewContext(b *ir.Block, comp *Compiler) *Context {
@@ -49,10 +75,37 @@ func NewContext(b *ir.Block, comp *Compiler) *Context {
 func (c *Context) NewContext(b *ir.Block) *Context {
 	ctx := NewContext(b, c.Compiler)
 	ctx.parent = c
+	*ctx.fc = *c.fc
+	ctx.cleanup = c.cleanup
+	ctx.className = c.className
 	return ctx
 }
 
+// runCleanups emits the pending cleanups of every scope between the current
+// one and `until`, innermost first.
+func (c *Context) runCleanups(until *Cleanup) error {
+	for cl := c.cleanup; cl != nil && cl != until; cl = cl.parent {
+		if c.Term != nil {
+			return nil
+		}
+		cctx := c.NewContext(c.Block)
+		cctx.cleanup = cl.parent
+		if err := cl.Emit(cctx); err != nil {
+			return err
+		}
+		c.Block = cctx.Block
+	}
+	return nil
+}
+
 func (c Context) lookupVariable(name string) *Variable {
+	if v, ok := c.vars[name]; ok {
+		return v
+	}
+	if c.parent != nil && c.Block != nil && c.parent.Block != nil && c.parent.Block.Parent == c.Block.Parent {
+		// Parameters are looked up in the function's outermost scope, which may have spilled them
+		return c.parent.lookupVariable(name)
+	}
 	if c.Block != nil && c.Block.Parent != nil {
 		for _, param := range c.Block.Parent.Params {
 			if param.Name() == name {
@@ -64,11 +117,18 @@ func (c Context) lookupVariable(name string) *Variable {
 			}
 		}
 	}
-	if v, ok := c.vars[name]; ok {
-		return v
-	} else if c.parent != nil {
+	if c.closure != nil {
+		// Locals of the enclosing function are captured by the lambda
+		if v := c.closure.lookup(name); v != nil {
+			return v
+		}
+	}
+	if c.parent != nil {
 		v := c.parent.lookupVariable(name)
 		return v
+	} else if v, ok := c.Compiler.globals[name]; ok {
+		// File-scope variables are visible from every function
+		return v
 	} else {
 		cli.Exit(color.RedString("Error: Unable to find a variable named: %s", name), 1)
 	}
@@ -103,11 +163,47 @@ type Compiler struct {
 	Module          *ir.Module
 	SymbolTable     map[string]value.Value
 	StructFields    map[string][]*parser.FieldDefinition
+	PrivateMethods  map[string]bool
+	StaticMethods   map[string]bool
+	StaticFields    map[string]*parser.FieldDefinition
+	staticGlobals   map[string]*Variable
+	declaredClasses map[string]bool
+	exportedClasses map[*parser.ClassDefinition]bool
+	globals         map[string]*Variable
+	exportedGlobals map[*parser.VariableDefinition]bool
+	// localInstances holds the slots of variables pointing to stack memory,
+	// until they are assigned again
+	localInstances  map[value.Value]bool
+	init            *Context
 	Context         *Context
 	AST             *parser.Program
 	workingDir      string
 	RequiredImports []string
 	PackageCache    cache.PackageCache
+	exceptions      *exceptionRuntime
+	lambdas         int
+	closureTypes    []closure
+	// Generic classes and functions, and their instances
+	genericClasses   map[string]*parser.ClassDefinition
+	genericFuncs     map[string]*parser.FunctionDefinition
+	typeArgs         map[string]types.Type
+	instances        map[string]*instance
+	pendingInstances []*instance
+	// Interfaces, and the interfaces each class implements
+	interfaces map[string]*iface
+	implements map[string][]string
+	// The class each class extends, and the virtual methods of each class
+	parents  map[string]string
+	virtuals map[string][]string
+	// Enums and unions, and the enum each enum type belongs to
+	enums     map[string]*enumDef
+	enumTypes map[*types.IntType]*enumDef
+	unions    map[string]*unionDef
+	// The unsigned integer types, by size
+	unsignedTypes map[uint64]*types.IntType
+	// The functions `new` and `delete` use to manage heap memory
+	Allocator   string
+	Deallocator string
 }
 
 func NewCompiler() *Compiler {
@@ -115,6 +211,28 @@ func NewCompiler() *Compiler {
 		Module:          ir.NewModule(),
 		SymbolTable:     make(map[string]value.Value),
 		StructFields:    make(map[string][]*parser.FieldDefinition),
+		PrivateMethods:  make(map[string]bool),
+		StaticMethods:   make(map[string]bool),
+		StaticFields:    make(map[string]*parser.FieldDefinition),
+		staticGlobals:   make(map[string]*Variable),
+		declaredClasses: make(map[string]bool),
+		exportedClasses: make(map[*parser.ClassDefinition]bool),
+		Allocator:       "malloc",
+		Deallocator:     "free",
+		globals:         make(map[string]*Variable),
+		exportedGlobals: make(map[*parser.VariableDefinition]bool),
+		localInstances:  make(map[value.Value]bool),
+		genericClasses:  make(map[string]*parser.ClassDefinition),
+		genericFuncs:    make(map[string]*parser.FunctionDefinition),
+		instances:       make(map[string]*instance),
+		interfaces:      make(map[string]*iface),
+		implements:      make(map[string][]string),
+		parents:         make(map[string]string),
+		virtuals:        make(map[string][]string),
+		enums:           make(map[string]*enumDef),
+		enumTypes:       make(map[*types.IntType]*enumDef),
+		unions:          make(map[string]*unionDef),
+		unsignedTypes:   make(map[uint64]*types.IntType),
 		RequiredImports: make([]string, 0),
 	}
 }
@@ -132,12 +250,17 @@ func (c *Compiler) Init(program *parser.Program, workingDir string) {
 }
 
 func (c *Compiler) Compile() (err error) {
+	c.Context.declareStatements(c.AST.Statements)
 	for _, s := range c.AST.Statements {
 		err := c.Context.compileStatement(s)
 		if err != nil {
 			return err
 		}
 	}
+	if err := c.compileInstances(); err != nil {
+		return err
+	}
+	c.finishModuleInit()
 	return nil
 }
 
@@ -196,7 +319,22 @@ func (c *Compiler) ImportAll(path string, ctx *Context) error {
 		return cli.Exit(color.RedString("Unable to import directory"), 1)
 	}
 	ast := parser.ParseFile(path)
+	// The interface, enum and union types come first, so classes and functions can refer to them
+	var unions []*unionDef
+	for _, s := range ast.Statements {
+		if s.Export != nil && s.Export.InterfaceDefinition != nil {
+			ctx.declareInterface(s.Export.InterfaceDefinition, s.Export.InterfaceDefinition.Name)
+		} else if s.Export != nil && s.Export.EnumDefinition != nil {
+			ctx.declareEnum(s.Export.EnumDefinition, s.Export.EnumDefinition.Name)
+		} else if s.Export != nil && s.Export.UnionDefinition != nil {
+			unions = append(unions, ctx.declareUnion(s.Export.UnionDefinition, s.Export.UnionDefinition.Name))
+		}
+	}
 	for _, s := range ast.Statements {
+		if s.Export != nil && c.registerGeneric(s.Export, "") {
+			// Generics are instantiated in the importing module
+			continue
+		}
 		if s.Export != nil {
 			if s.Export.FunctionDefinition != nil {
 				var params []*ir.Param
@@ -214,26 +352,27 @@ func (c *Compiler) ImportAll(path string, ctx *Context) error {
 				cStruct.SetName(s.Export.ClassDefinition.Name)
 				ctx.Module.NewTypeDef(s.Export.ClassDefinition.Name, cStruct)
 				ctx.structNames[cStruct] = s.Export.ClassDefinition.Name
+				c.implements[s.Export.ClassDefinition.Name] = s.Export.ClassDefinition.Implements
+				ctx.inheritMembers(s.Export.ClassDefinition, s.Export.ClassDefinition.Name, cStruct)
 				for _, st := range s.Export.ClassDefinition.Body {
-					if st.FieldDefinition != nil {
+					if st.FieldDefinition != nil && st.FieldDefinition.Static {
+						if !st.FieldDefinition.Private {
+							ctx.declareStaticField(s.Export.ClassDefinition.Name, s.Export.ClassDefinition.Name, st.FieldDefinition)
+						}
+					} else if st.FieldDefinition != nil {
 						cStruct.Fields = append(cStruct.Fields, ctx.CFTypeToLLType(st.FieldDefinition.Type))
 						ctx.Compiler.StructFields[s.Export.ClassDefinition.Name] = append(ctx.Compiler.StructFields[s.Export.ClassDefinition.Name], st.FieldDefinition)
-					} else if st.FunctionDefinition != nil {
+					} else if st.FunctionDefinition != nil && !st.FunctionDefinition.Private {
 						f := st.FunctionDefinition
 						var params []*ir.Param
-						params = append(params, ir.NewParam("this", types.NewPointer(cStruct)))
+						if !f.Static {
+							params = append(params, ir.NewParam("this", types.NewPointer(cStruct)))
+						}
 						for _, arg := range f.Parameters {
 							params = append(params, ir.NewParam(arg.Name, ctx.CFTypeToLLType(arg.Type)))
 						}
 
-						ms := "." + f.Name.Name
-						if f.Name.Op {
-							ms = ".op." + strings.Trim(f.Name.Name, "\"")
-						} else if f.Name.Get {
-							ms = ".get." + strings.Trim(f.Name.Name, "\"")
-						} else if f.Name.Set {
-							ms = ".set." + strings.Trim(f.Name.Name, "\"")
-						}
+						ms := ctx.methodSuffix(f)
 
 						fn := ctx.Module.NewFunc(s.Export.ClassDefinition.Name+ms, ctx.CFMultiTypeToLLType(f.ReturnType), params...)
 						if st.FunctionDefinition.Variadic != "" {
@@ -241,8 +380,17 @@ func (c *Compiler) ImportAll(path string, ctx *Context) error {
 						}
 
 						ctx.SymbolTable[s.Export.ClassDefinition.Name+ms] = fn
+						if f.Static {
+							ctx.Compiler.StaticMethods[s.Export.ClassDefinition.Name+ms] = true
+						}
 					}
 				}
+			} else if s.Export.InterfaceDefinition != nil {
+				ctx.declareInterfaceMethods(s.Export.InterfaceDefinition, s.Export.InterfaceDefinition.Name)
+			} else if s.Export.VariableDefinition != nil {
+				for _, b := range variableBindings(s.Export.VariableDefinition) {
+					ctx.declareExternalGlobal(b, b.Name, s.Export.VariableDefinition.Constant == "const")
+				}
 			} else if s.Export.External != nil {
 				var params []*ir.Param
 				for _, p := range s.Export.External.Parameters {
@@ -256,6 +404,10 @@ func (c *Compiler) ImportAll(path string, ctx *Context) error {
 			}
 		}
 	}
+	// Unions are laid out once the classes they may hold are declared
+	for _, u := range unions {
+		ctx.layoutUnion(u)
+	}
 	return nil
 }
 
@@ -280,8 +432,37 @@ func (c *Compiler) ImportAs(path string, symbols map[string]string, ctx *Context
 		return cli.Exit(color.RedString("Unable to import directory"), 1)
 	}
 	ast := parser.ParseFile(path)
+	// The interface, enum and union types come first, so classes and functions can refer to them
+	var unions []*unionDef
+	for _, s := range ast.Statements {
+		if s.Export != nil && s.Export.InterfaceDefinition != nil {
+			if newname, ok := symbols[s.Export.InterfaceDefinition.Name]; ok {
+				if newname == "" {
+					newname = s.Export.InterfaceDefinition.Name
+				}
+				ctx.declareInterface(s.Export.InterfaceDefinition, newname)
+			}
+		} else if s.Export != nil && s.Export.EnumDefinition != nil {
+			if newname, ok := symbols[s.Export.EnumDefinition.Name]; ok {
+				if newname == "" {
+					newname = s.Export.EnumDefinition.Name
+				}
+				ctx.declareEnum(s.Export.EnumDefinition, newname)
+			}
+		} else if s.Export != nil && s.Export.UnionDefinition != nil {
+			if newname, ok := symbols[s.Export.UnionDefinition.Name]; ok {
+				if newname == "" {
+					newname = s.Export.UnionDefinition.Name
+				}
+				unions = append(unions, ctx.declareUnion(s.Export.UnionDefinition, newname))
+			}
+		}
+	}
 	for _, s := range ast.Statements {
 		if s.Export != nil {
+			if newname, ok := symbols[genericName(s.Export)]; ok && c.registerGeneric(s.Export, newname) {
+				continue
+			}
 			if s.Export.FunctionDefinition != nil {
 				if newname, ok := symbols[s.Export.FunctionDefinition.Name.Name]; ok {
 					var params []*ir.Param
@@ -299,36 +480,59 @@ func (c *Compiler) ImportAs(path string, symbols map[string]string, ctx *Context
 					if newname == "" {
 						newname = s.Export.ClassDefinition.Name
 					}
+					// Named first, so its methods can take and return instances of it
 					cStruct := types.NewStruct()
+					ctx.structNames[cStruct] = newname
+					ctx.Module.NewTypeDef(newname, cStruct)
+					ctx.inheritMembers(s.Export.ClassDefinition, newname, cStruct)
 					for _, st := range s.Export.ClassDefinition.Body {
-						if st.FieldDefinition != nil {
+						if st.FieldDefinition != nil && st.FieldDefinition.Static {
+							if !st.FieldDefinition.Private {
+								ctx.declareStaticField(s.Export.ClassDefinition.Name, newname, st.FieldDefinition)
+							}
+						} else if st.FieldDefinition != nil {
 							cStruct.Fields = append(cStruct.Fields, ctx.CFTypeToLLType(st.FieldDefinition.Type))
-						} else if st.FunctionDefinition != nil {
+						} else if st.FunctionDefinition != nil && !st.FunctionDefinition.Private {
 							var params []*ir.Param
+							if !st.FunctionDefinition.Static {
+								params = append(params, ir.NewParam("this", types.NewPointer(cStruct)))
+							}
 							for _, p := range st.FunctionDefinition.Parameters {
 								params = append(params, ir.NewParam(p.Name, ctx.CFTypeToLLType(p.Type)))
 							}
 							f := st.FunctionDefinition
 
-							ms := "." + f.Name.Name
-							if f.Name.Op {
-								ms = ".op." + strings.Trim(f.Name.Name, "\"")
-							} else if f.Name.Get {
-								ms = ".get." + strings.Trim(f.Name.Name, "\"")
-							} else if f.Name.Set {
-								ms = ".set." + strings.Trim(f.Name.Name, "\"")
-							}
+							ms := ctx.methodSuffix(f)
 
 							fn := ctx.Module.NewFunc(s.Export.ClassDefinition.Name+ms, ctx.CFMultiTypeToLLType(f.ReturnType), params...)
 							if st.FunctionDefinition.Variadic != "" {
 								fn.Sig.Variadic = true
 							}
 
-							ctx.SymbolTable[s.Export.ClassDefinition.Name+ms] = fn
+							// The method keeps its symbol, but is found under the new name of the class
+							ctx.SymbolTable[newname+ms] = fn
+							if f.Static {
+								ctx.Compiler.StaticMethods[newname+ms] = true
+							}
 						}
 					}
-					ctx.structNames[cStruct] = newname
-					ctx.Module.NewTypeDef(newname, cStruct)
+					c.implements[newname] = s.Export.ClassDefinition.Implements
+				}
+			} else if s.Export.InterfaceDefinition != nil {
+				if newname, ok := symbols[s.Export.InterfaceDefinition.Name]; ok {
+					if newname == "" {
+						newname = s.Export.InterfaceDefinition.Name
+					}
+					ctx.declareInterfaceMethods(s.Export.InterfaceDefinition, newname)
+				}
+			} else if s.Export.VariableDefinition != nil {
+				for _, b := range variableBindings(s.Export.VariableDefinition) {
+					if newname, ok := symbols[b.Name]; ok {
+						if newname == "" {
+							newname = b.Name
+						}
+						ctx.declareExternalGlobal(b, newname, s.Export.VariableDefinition.Constant == "const")
+					}
 				}
 			} else if s.Export.External != nil {
 				var params []*ir.Param
@@ -342,5 +546,9 @@ func (c *Compiler) ImportAs(path string, symbols map[string]string, ctx *Context
 			}
 		}
 	}
+	// Unions are laid out once the classes they may hold are declared
+	for _, u := range unions {
+		ctx.layoutUnion(u)
+	}
 	return nil
 }
@@ -0,0 +1,167 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/vyPal/CaffeineC/lib/parser"
+)
+
+// The tests compile small programs and check the IR, the diagnostics or, when
+// lli is installed, what the programs print.
+
+func init() {
+	color.NoColor = true
+}
+
+// prelude starts every test program.
+const prelude = "package main;\nextern func printf(fmt: *i8, ...): i32;\n"
+
+// parseMu serializes parsing, as the parser caches files in a global map.
+var parseMu sync.Mutex
+
+// compileFiles compiles the module made of `files`, starting from main.cffc,
+// and returns its IR. Panics of the compiler are returned as errors.
+func compileFiles(t *testing.T, files map[string]string) (string, error) {
+	t.Helper()
+	comp, err := compileModule(t, files)
+	if err != nil {
+		return "", err
+	}
+	return comp.Module.String(), nil
+}
+
+// compileModule compiles the module made of `files` and returns its compiler.
+func compileModule(t *testing.T, files map[string]string) (comp *Compiler, err error) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	program := func() *parser.Program {
+		parseMu.Lock()
+		defer parseMu.Unlock()
+		return parser.ParseFile(filepath.Join(dir, "main.cffc"))
+	}()
+	comp = NewCompiler()
+	comp.Init(program, dir)
+	if err := comp.FindImports(); err != nil {
+		return nil, err
+	}
+	if err := comp.Compile(); err != nil {
+		return nil, err
+	}
+	return comp, nil
+}
+
+// compileSource compiles the program `src`, which is preceded by the prelude.
+func compileSource(t *testing.T, src string) (string, error) {
+	t.Helper()
+	return compileFiles(t, map[string]string{"main.cffc": prelude + src})
+}
+
+// expectIR compiles `src` and checks its IR contains every one of `fragments`.
+func expectIR(t *testing.T, src string, fragments ...string) string {
+	t.Helper()
+	module, err := compileSource(t, src)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, f := range fragments {
+		if !strings.Contains(module, f) {
+			t.Errorf("IR doesn't contain %q:\n%s", f, module)
+		}
+	}
+	return module
+}
+
+// expectIRConcurrently compiles `src` with several compilers at the same time
+// and checks each IR contains every one of `fragments`.
+func expectIRConcurrently(t *testing.T, src string, fragments ...string) {
+	t.Helper()
+	var wg sync.WaitGroup
+	modules := make([]string, 4)
+	errs := make([]error, len(modules))
+	for i := range modules {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			modules[i], errs[i] = compileSource(t, src)
+		}(i)
+	}
+	wg.Wait()
+	for i, module := range modules {
+		if errs[i] != nil {
+			t.Fatalf("unexpected error: %v", errs[i])
+		}
+		for _, f := range fragments {
+			if !strings.Contains(module, f) {
+				t.Errorf("IR doesn't contain %q:\n%s", f, module)
+			}
+		}
+	}
+}
+
+// expectError compiles `src` and checks it fails with an error containing `want`.
+func expectError(t *testing.T, src string, want string) {
+	t.Helper()
+	_, err := compileSource(t, src)
+	if err == nil {
+		t.Fatalf("expected an error containing %q, got none", want)
+	}
+	if !strings.Contains(err.Error(), want) {
+		t.Fatalf("expected an error containing %q, got %q", want, err.Error())
+	}
+}
+
+// expectOutput compiles `src`, runs it with lli and checks what it prints.
+func expectOutput(t *testing.T, src string, want string) {
+	t.Helper()
+	module := expectIR(t, src)
+	lli, err := exec.LookPath("lli")
+	if err != nil {
+		t.Skip("lli is not installed")
+	}
+	cmd := exec.Command(lli, "-")
+	cmd.Stdin = strings.NewReader(module)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("running the program failed: %v\n%s\n%s", err, stderr.String(), module)
+	}
+	if string(out) != want {
+		t.Fatalf("expected the program to print %q, got %q", want, string(out))
+	}
+}
+
+// expectWarning compiles `src` and checks a warning containing `want` is printed.
+// An empty `want` checks there is no warning.
+func expectWarning(t *testing.T, src string, want string) {
+	t.Helper()
+	var buf bytes.Buffer
+	warningOutput = &buf
+	defer func() { warningOutput = os.Stderr }()
+	expectIR(t, src)
+	if want == "" && buf.Len() > 0 {
+		t.Fatalf("expected no warning, got %q", buf.String())
+	}
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("expected a warning containing %q, got %q", want, buf.String())
+	}
+}
@@ -0,0 +1,155 @@
+package compiler
+
+import (
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+	"github.com/vyPal/CaffeineC/lib/parser"
+)
+
+// An enum like `enum Color: u8 { Red, Green = 5, Blue }` is an integer type
+// whose values have names, accessed as `Color.Red`. Its type is a distinct
+// *types.IntType instance of the underlying size, so enum values can be told
+// apart from other integers the way unsigned ones are. A variant without a
+// value follows the previous one, starting at 0. Enums default to i32, like in C.
+
+// enumDef is a declared enum and the values of its variants.
+type enumDef struct {
+	name     string
+	typ      *types.IntType
+	unsigned bool
+	variants []string
+	values   []int64
+}
+
+// enumOf returns the enum `t` is the type of.
+func (c *Compiler) enumOf(t types.Type) (*enumDef, bool) {
+	intType, ok := t.(*types.IntType)
+	if !ok {
+		return nil, false
+	}
+	def, ok := c.enumTypes[intType]
+	return def, ok
+}
+
+// declareEnum registers the enum `e` under `name`.
+func (ctx *Context) declareEnum(e *parser.EnumDefinition, name string) *enumDef {
+	if def, ok := ctx.Compiler.enums[name]; ok {
+		return def
+	}
+
+	underlying := types.I32
+	if e.Type != nil {
+		if intType, ok := ctx.CFTypeToLLType(e.Type).(*types.IntType); ok {
+			underlying = intType
+		}
+	}
+	def := &enumDef{name: name, typ: types.NewInt(underlying.BitSize), unsigned: ctx.isUnsigned(underlying)}
+	next := int64(0)
+	for _, v := range e.Variants {
+		if v.Value != nil {
+			next = *v.Value
+		}
+		def.variants = append(def.variants, v.Name)
+		def.values = append(def.values, next)
+		next++
+	}
+
+	ctx.Compiler.enumTypes[def.typ] = def
+	ctx.Compiler.enums[name] = def
+	return def
+}
+
+// compileEnumDefinition checks the enum `e`, which was declared with the rest of the module.
+func (ctx *Context) compileEnumDefinition(e *parser.EnumDefinition) error {
+	def := ctx.declareEnum(e, e.Name)
+	if e.Type != nil {
+		if t := ctx.CFTypeToLLType(e.Type); !isInteger(t) {
+			return posError(e.Type.Pos, "The type of enum %s must be an integer type, not %s", e.Name, ctx.TypeToString(t))
+		}
+	}
+	if len(e.Variants) == 0 {
+		return posError(e.Pos, "Enum %s has no variants", e.Name)
+	}
+
+	seen := map[string]bool{}
+	for i, v := range e.Variants {
+		if seen[v.Name] {
+			return posError(v.Pos, "Variant %s of enum %s is declared twice", v.Name, e.Name)
+		}
+		seen[v.Name] = true
+		if !fitsInt(def.values[i], def.typ.BitSize, def.unsigned) {
+			return posError(v.Pos, "The value %d of %s.%s doesn't fit in %s", def.values[i], e.Name, v.Name, ctx.TypeToString(ctx.enumUnderlying(def)))
+		}
+	}
+	return nil
+}
+
+// isInteger reports whether `t` is an integer type.
+func isInteger(t types.Type) bool {
+	_, ok := t.(*types.IntType)
+	return ok
+}
+
+// enumUnderlying returns the integer type the enum `def` is stored as.
+func (ctx *Context) enumUnderlying(def *enumDef) types.Type {
+	if def.unsigned {
+		return ctx.unsignedInt(def.typ.BitSize)
+	}
+	return types.NewInt(def.typ.BitSize)
+}
+
+// fitsInt reports whether `v` can be stored in an integer of `bits` bits.
+func fitsInt(v int64, bits uint64, unsigned bool) bool {
+	if bits >= 64 {
+		return !unsigned || v >= 0
+	}
+	if unsigned {
+		return v >= 0 && v < int64(1)<<bits
+	}
+	limit := int64(1) << (bits - 1)
+	return v >= -limit && v < limit
+}
+
+// lookupEnumVariant returns the value of `enumName.variant`. It reports false
+// if there is no enum named `enumName`.
+func (ctx *Context) lookupEnumVariant(enumName string, variant string, pos lexer.Position) (value.Value, bool, error) {
+	def, ok := ctx.Compiler.enums[enumName]
+	if !ok {
+		return nil, false, nil
+	}
+	for i, v := range def.variants {
+		if v == variant {
+			return constant.NewInt(def.typ, def.values[i]), true, nil
+		}
+	}
+	return nil, false, posError(pos, "Enum %s has no variant %s", enumName, variant)
+}
+
+// warnMissingVariants warns about the variants of an enum that a switch without a default doesn't handle.
+func (ctx *Context) warnMissingVariants(s *parser.Switch, condType types.Type, values [][]value.Value) {
+	def, ok := ctx.enumOf(condType)
+	if !ok || s.Default != nil {
+		return
+	}
+	handled := map[int64]bool{}
+	for _, vals := range values {
+		for _, val := range vals {
+			if c, ok := val.(*constant.Int); ok {
+				handled[c.X.Int64()] = true
+			}
+		}
+	}
+	var missing []string
+	for i, variant := range def.variants {
+		if !handled[def.values[i]] {
+			missing = append(missing, variant)
+		}
+	}
+	if len(missing) > 0 {
+		posWarning(s.Pos, "switch over enum %s doesn't handle %s", def.name, strings.Join(missing, ", "))
+	}
+}
@@ -0,0 +1,53 @@
+package compiler
+
+import "testing"
+
+func TestEnums(t *testing.T) {
+	expectOutput(t, `
+enum Dir { N, E = 10, S, W }
+enum Color: u8 { Red, Green = 5, Blue }
+func main(): i32 {
+	var c: Color = Color.Blue;
+	var d = Dir.S;
+	printf("%d %d\n", c, d);
+	switch (d) {
+	case Dir.N:
+		printf("n\n");
+	case Dir.S:
+		printf("s\n");
+	default:
+		printf("other\n");
+	}
+	printf("%ld\n", (d): i64);
+	return 0;
+}
+`, "6 11\ns\n11\n")
+	expectWarning(t, `
+enum Color { Red, Green, Blue }
+func f(c: Color) {
+	switch (c) {
+	case Color.Red:
+		printf("red\n");
+	case Color.Blue:
+		printf("blue\n");
+	}
+}
+func main(): i32 { return 0; }
+`, "switch over enum Color doesn't handle Green")
+	expectError(t, `
+enum E { A, A }
+func main(): i32 { return 0; }
+`, "Variant A of enum E is declared twice")
+}
+
+func TestEnumsConcurrently(t *testing.T) {
+	// Each compiler has its own enum types, so compilers can run at the same time
+	expectIRConcurrently(t, `
+enum Size: u16 { Small = 1, Large = 40000 }
+func main(): i32 {
+	var s = Size.Large;
+	if (s > Size.Small) { return 1; }
+	return 0;
+}
+`, "icmp ugt i16")
+}
@@ -0,0 +1,213 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/enum"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+)
+
+// Exceptions are implemented with setjmp/longjmp. Every active try block
+// pushes a handler frame onto a linked list, throw stores the thrown value
+// and jumps to the innermost frame. The runtime is emitted into every module
+// that uses it with linkonce_odr linkage, so the copies get merged by the linker.
+
+// handlerFrame is the layout of a handler frame: the previous frame followed
+// by a buffer big enough for the jmp_buf of every supported platform.
+var handlerFrame = types.NewStruct(types.I8Ptr, types.NewArray(64, types.I64))
+
+type exceptionRuntime struct {
+	top    *ir.Global
+	value  *ir.Global
+	site   *ir.Global
+	setjmp value.Value
+	throw  *ir.Func
+}
+
+// declareFunc returns the function called `name`, declaring it if the module doesn't have it yet.
+func (c *Compiler) declareFunc(name string, retType types.Type, params ...*ir.Param) *ir.Func {
+	for _, f := range c.Module.Funcs {
+		if f.Name() == name {
+			return f
+		}
+	}
+	return c.Module.NewFunc(name, retType, params...)
+}
+
+// runtimeFunc returns the function `name` used by the generated code as a
+// function taking `params` and returning `retType`. The program may declare it
+// itself with other types, for example `extern func free(p: *i64)`, so it's
+// cast if needed.
+func (c *Compiler) runtimeFunc(name string, retType types.Type, params ...*ir.Param) value.Value {
+	fn := c.declareFunc(name, retType, params...)
+	var paramTypes []types.Type
+	for _, p := range params {
+		paramTypes = append(paramTypes, p.Type())
+	}
+	sig := types.NewFunc(retType, paramTypes...)
+	if fn.Sig.Equal(sig) {
+		return fn
+	}
+	return constant.NewBitCast(fn, types.NewPointer(sig))
+}
+
+func (c *Compiler) exceptionRuntime() *exceptionRuntime {
+	if c.exceptions != nil {
+		return c.exceptions
+	}
+
+	rt := &exceptionRuntime{}
+	rt.top = c.Module.NewGlobalDef("__cffc_exc_top", constant.NewNull(types.I8Ptr))
+	rt.top.Linkage = enum.LinkageLinkOnceODR
+	rt.value = c.Module.NewGlobalDef("__cffc_exc_value", constant.NewInt(types.I64, 0))
+	rt.value.Linkage = enum.LinkageLinkOnceODR
+	rt.site = c.Module.NewGlobalDef("__cffc_exc_site", constant.NewNull(types.I8Ptr))
+	rt.site.Linkage = enum.LinkageLinkOnceODR
+
+	setjmp := c.declareFunc("setjmp", types.I32, ir.NewParam("env", types.I8Ptr))
+	setjmp.FuncAttrs = append(setjmp.FuncAttrs, enum.FuncAttrReturnsTwice)
+	rt.setjmp = c.runtimeFunc("setjmp", types.I32, ir.NewParam("env", types.I8Ptr))
+	longjmp := c.runtimeFunc("longjmp", types.Void, ir.NewParam("env", types.I8Ptr), ir.NewParam("val", types.I32))
+	strlen := c.runtimeFunc("strlen", types.I64, ir.NewParam("s", types.I8Ptr))
+	write := c.runtimeFunc("write", types.I64, ir.NewParam("fd", types.I32), ir.NewParam("buf", types.I8Ptr), ir.NewParam("n", types.I64))
+	fflush := c.runtimeFunc("fflush", types.I32, ir.NewParam("stream", types.I8Ptr))
+	abort := c.runtimeFunc("abort", types.Void)
+
+	// __cffc_throw(value, site) jumps to the innermost handler, or aborts
+	// with the throw site if there is none
+	val := ir.NewParam("value", types.I64)
+	site := ir.NewParam("site", types.I8Ptr)
+	rt.throw = c.Module.NewFunc("__cffc_throw", types.Void, val, site)
+	rt.throw.Linkage = enum.LinkageLinkOnceODR
+	rt.throw.FuncAttrs = append(rt.throw.FuncAttrs, enum.FuncAttrNoReturn)
+
+	entry := rt.throw.NewBlock("")
+	unwind := rt.throw.NewBlock("")
+	uncaught := rt.throw.NewBlock("")
+
+	entry.NewStore(val, rt.value)
+	entry.NewStore(site, rt.site)
+	top := entry.NewLoad(types.I8Ptr, rt.top)
+	entry.NewCondBr(entry.NewICmp(enum.IPredEQ, top, constant.NewNull(types.I8Ptr)), uncaught, unwind)
+
+	frame := unwind.NewBitCast(top, types.NewPointer(handlerFrame))
+	prev := unwind.NewLoad(types.I8Ptr, unwind.NewGetElementPtr(handlerFrame, frame, constant.NewInt(types.I32, 0), constant.NewInt(types.I32, 0)))
+	unwind.NewStore(prev, rt.top)
+	buf := unwind.NewGetElementPtr(handlerFrame, frame, constant.NewInt(types.I32, 0), constant.NewInt(types.I32, 1))
+	unwind.NewCall(longjmp, unwind.NewBitCast(buf, types.I8Ptr), constant.NewInt(types.I32, 1))
+	unwind.NewUnreachable()
+
+	uncaught.NewCall(fflush, constant.NewNull(types.I8Ptr))
+	uncaught.NewCall(write, constant.NewInt(types.I32, 2), site, uncaught.NewCall(strlen, site))
+	uncaught.NewCall(abort)
+	uncaught.NewUnreachable()
+
+	c.exceptions = rt
+	return rt
+}
+
+// pushHandler installs a new handler frame. Control continues in `body`
+// normally, and in `caught` after an exception was thrown while the frame
+// was active. The frame is already unlinked when `caught` is entered.
+func (ctx *Context) pushHandler() (frame value.Value, body *ir.Block, caught *ir.Block) {
+	rt := ctx.Compiler.exceptionRuntime()
+
+	// The frame lives in the entry block so try blocks in loops don't grow the stack
+	entry := ctx.Block.Parent.Blocks[0]
+	alloca := ir.NewAlloca(handlerFrame)
+	alloca.Align = 16
+	entry.Insts = append([]ir.Instruction{alloca}, entry.Insts...)
+
+	prev := ctx.NewLoad(types.I8Ptr, rt.top)
+	ctx.NewStore(prev, ctx.NewGetElementPtr(handlerFrame, alloca, constant.NewInt(types.I32, 0), constant.NewInt(types.I32, 0)))
+	ctx.NewStore(ctx.NewBitCast(alloca, types.I8Ptr), rt.top)
+
+	buf := ctx.NewGetElementPtr(handlerFrame, alloca, constant.NewInt(types.I32, 0), constant.NewInt(types.I32, 1))
+	call := ctx.NewCall(rt.setjmp, ctx.NewBitCast(buf, types.I8Ptr))
+	call.FuncAttrs = append(call.FuncAttrs, enum.FuncAttrReturnsTwice)
+
+	body = ctx.Block.Parent.NewBlock("")
+	caught = ctx.Block.Parent.NewBlock("")
+	ctx.NewCondBr(ctx.NewICmp(enum.IPredEQ, call, constant.NewInt(types.I32, 0)), body, caught)
+
+	return alloca, body, caught
+}
+
+// popHandler unlinks a frame installed by pushHandler.
+func (ctx *Context) popHandler(frame value.Value) {
+	prev := ctx.NewLoad(types.I8Ptr, ctx.NewGetElementPtr(handlerFrame, frame, constant.NewInt(types.I32, 0), constant.NewInt(types.I32, 0)))
+	ctx.NewStore(prev, ctx.Compiler.exceptionRuntime().top)
+}
+
+// rethrow throws the exception that is currently being handled again.
+func (ctx *Context) rethrow() {
+	rt := ctx.Compiler.exceptionRuntime()
+	ctx.NewCall(rt.throw, ctx.NewLoad(types.I64, rt.value), ctx.NewLoad(types.I8Ptr, rt.site))
+	ctx.NewUnreachable()
+}
+
+// toExceptionPayload converts a thrown value to the i64 that is stored in the runtime.
+func (ctx *Context) toExceptionPayload(val value.Value, pos lexer.Position) (value.Value, error) {
+	switch t := val.Type().(type) {
+	case *types.IntType:
+		if t.BitSize < 64 {
+			return ctx.NewZExt(val, types.I64), nil
+		} else if t.BitSize > 64 {
+			return ctx.NewTrunc(val, types.I64), nil
+		}
+		return val, nil
+	case *types.FloatType:
+		switch t.Kind {
+		case types.FloatKindHalf, types.FloatKindFloat:
+			val = ctx.NewFPExt(val, types.Double)
+		case types.FloatKindDouble:
+		default:
+			val = ctx.NewFPTrunc(val, types.Double)
+		}
+		return ctx.NewBitCast(val, types.I64), nil
+	case *types.PointerType:
+		return ctx.NewPtrToInt(val, types.I64), nil
+	default:
+		return nil, posError(pos, "Cannot throw a value of type %s", val.Type())
+	}
+}
+
+// fromExceptionPayload converts the stored i64 back to the type of a catch variable.
+func (ctx *Context) fromExceptionPayload(val value.Value, typ types.Type, pos lexer.Position) (value.Value, error) {
+	switch t := typ.(type) {
+	case *types.IntType:
+		if t.BitSize < 64 {
+			return ctx.NewTrunc(val, t), nil
+		} else if t.BitSize > 64 {
+			return ctx.NewZExt(val, t), nil
+		}
+		return val, nil
+	case *types.FloatType:
+		val = ctx.NewBitCast(val, types.Double)
+		switch t.Kind {
+		case types.FloatKindHalf, types.FloatKindFloat:
+			val = ctx.NewFPTrunc(val, t)
+		case types.FloatKindDouble:
+		default:
+			val = ctx.NewFPExt(val, t)
+		}
+		return val, nil
+	case *types.PointerType:
+		return ctx.NewIntToPtr(val, t), nil
+	default:
+		return nil, posError(pos, "Cannot catch a value of type %s", typ)
+	}
+}
+
+// throwSite returns the message printed when an exception thrown at `pos` is not caught.
+func (ctx *Context) throwSite(pos lexer.Position) value.Value {
+	msg := fmt.Sprintf("Uncaught exception thrown at %s:%d:%d\n", pos.Filename, pos.Line, pos.Column)
+	site := ctx.Module.NewGlobalDef("", constant.NewCharArrayFromString(msg+"\000"))
+	site.Immutable = true
+	site.Linkage = enum.LinkagePrivate
+	return ctx.NewBitCast(site, types.I8Ptr)
+}
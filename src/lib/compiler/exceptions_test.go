@@ -0,0 +1,89 @@
+package compiler
+
+import "testing"
+
+func TestExceptions(t *testing.T) {
+	expectOutput(t, `
+func thrower(x: i64): i64 {
+	if (x > 2) {
+		throw x;
+	}
+	return x;
+}
+func withret(): i64 {
+	try {
+		return 5;
+	} finally {
+		printf("finally on return\n");
+	}
+	return 0;
+}
+func main(): i32 {
+	try {
+		thrower(1);
+		thrower(7);
+		printf("not reached\n");
+	} catch e: i64 {
+		printf("caught %ld\n", e);
+	} finally {
+		printf("finally\n");
+	}
+	printf("withret=%ld\n", withret());
+	try {
+		try {
+			throw 42;
+		} finally {
+			printf("inner finally\n");
+		}
+	} catch e: i64 {
+		printf("outer caught %ld\n", e);
+	}
+	return 0;
+}
+`, "caught 7\nfinally\nfinally on return\nwithret=5\ninner finally\nouter caught 42\n")
+	expectError(t, `
+func main(): i32 {
+	try {
+		printf("x\n");
+	}
+	return 0;
+}
+`, "Try statement must have a catch or finally block")
+}
+
+func TestExternalRedeclaration(t *testing.T) {
+	expectOutput(t, `
+extern func printf(fmt: *i8, ...): i32;
+extern func setjmp(env: *i64): i64;
+func main(): i32 {
+	try {
+		throw 1;
+	} catch e: i64 {
+		printf("caught %ld\n", e);
+	}
+	return 0;
+}
+`, "caught 1\n")
+	expectError(t, `
+extern func printf(fmt: *i8): i32;
+func main(): i32 { return 0; }
+`, "Function printf is already declared as func(*i8, ...): i32")
+	expectError(t, `
+extern func puts(s: *i8): i32;
+extern func puts(s: *i64): i32;
+func main(): i32 { return 0; }
+`, "Function puts is already declared as func(*i8): i32")
+	expectError(t, `
+func twice(x: i64): i64 { return x * 2; }
+extern func twice(x: i32): i32;
+func main(): i32 { return 0; }
+`, "Function twice is already declared as func(i64): i64")
+	expectOutput(t, `
+func twice(x: i64): i64 { return x * 2; }
+extern func twice(x: i64): i64;
+func main(): i32 {
+	printf("%ld\n", twice(2));
+	return 0;
+}
+`, "4\n")
+}
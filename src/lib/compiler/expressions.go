@@ -1,10 +1,10 @@
 package compiler
 
 import (
-	"fmt"
 	"strconv"
 	"strings"
 
+	"github.com/alecthomas/participle/v2/lexer"
 	"github.com/fatih/color"
 	"github.com/llir/llvm/ir"
 	"github.com/llir/llvm/ir/constant"
@@ -22,25 +22,38 @@ func (ctx *Context) compileExpression(e *parser.Expression) (value.Value, error)
 	}
 
 	if e.True != nil && e.False != nil {
-		if cond.Type() != types.I1 {
+		if !cond.Type().Equal(types.I1) {
 			return nil, posError(e.Condition.Pos, "condition in ternary expression must be a boolean")
 		}
 
+		// Only the chosen branch is evaluated
+		trueB := ctx.Block.Parent.NewBlock("")
+		falseB := ctx.Block.Parent.NewBlock("")
+		endB := ctx.Block.Parent.NewBlock("")
+		ctx.NewCondBr(cond, trueB, falseB)
+
+		ctx.Block = trueB
 		trueVal, err := ctx.compileExpression(e.True)
 		if err != nil {
 			return nil, err
 		}
+		trueEnd := ctx.Block
 
+		ctx.Block = falseB
 		falseVal, err := ctx.compileExpression(e.False)
 		if err != nil {
 			return nil, err
 		}
+		falseEnd := ctx.Block
 
-		if trueVal.Type() != falseVal.Type() {
+		if !trueVal.Type().Equal(falseVal.Type()) {
 			return nil, posError(e.Pos, "true and false expressions in ternary expression must be the same type")
 		}
 
-		return ctx.NewSelect(cond, trueVal, falseVal), nil
+		trueEnd.NewBr(endB)
+		falseEnd.NewBr(endB)
+		ctx.Block = endB
+		return ctx.NewPhi(ir.NewIncoming(trueVal, trueEnd), ir.NewIncoming(falseVal, falseEnd)), nil
 	}
 
 	return cond, nil
@@ -52,25 +65,30 @@ func (ctx *Context) compileLogicalAnd(l *parser.LogicalAnd) (value.Value, error)
 		return nil, err
 	}
 
-	if len(l.Right) != 0 && left.Type() != types.I1 {
+	if len(l.Right) != 0 && !left.Type().Equal(types.I1) {
 		return nil, posError(l.Left.Pos, "logical and operator requires boolean operands")
 	}
 
 	for _, right := range l.Right {
-		rightVal, err := ctx.compileLogicalAnd(right)
-		if err != nil {
-			return nil, err
-		}
+		// The right operand is only evaluated if the left one is true
+		left, err = ctx.shortCircuit(left, false, func() (value.Value, error) {
+			rightVal, err := ctx.compileBitwiseOr(right)
+			if err != nil {
+				return nil, err
+			}
 
-		if ptrType, ok := rightVal.Type().(*types.PointerType); ok && ptrType.ElemType == left.Type() {
-			rightVal = ctx.NewLoad(ptrType.ElemType, rightVal)
-		}
+			if ptrType, ok := rightVal.Type().(*types.PointerType); ok && ptrType.ElemType == left.Type() {
+				rightVal = ctx.NewLoad(ptrType.ElemType, rightVal)
+			}
 
-		if rightVal.Type() != types.I1 {
-			return nil, posError(right.Pos, "logical and operator requires boolean operands")
+			if !rightVal.Type().Equal(types.I1) {
+				return nil, posError(right.Pos, "logical and operator requires boolean operands")
+			}
+			return rightVal, nil
+		})
+		if err != nil {
+			return nil, err
 		}
-
-		left = ctx.NewAnd(left, rightVal)
 	}
 
 	return left, nil
@@ -82,28 +100,57 @@ func (ctx *Context) compileLogicalOr(l *parser.LogicalOr) (value.Value, error) {
 		return nil, err
 	}
 
-	if len(l.Right) != 0 && left.Type() != types.I1 {
+	if len(l.Right) != 0 && !left.Type().Equal(types.I1) {
 		return nil, posError(l.Left.Pos, "logical or operator requires boolean operands")
 	}
 
 	for _, right := range l.Right {
-		rightVal, err := ctx.compileLogicalOr(right)
+		// The right operand is only evaluated if the left one is false
+		left, err = ctx.shortCircuit(left, true, func() (value.Value, error) {
+			rightVal, err := ctx.compileLogicalAnd(right)
+			if err != nil {
+				return nil, err
+			}
+
+			if ptrType, ok := rightVal.Type().(*types.PointerType); ok && ptrType.ElemType == left.Type() {
+				rightVal = ctx.NewLoad(ptrType.ElemType, rightVal)
+			}
+
+			if !rightVal.Type().Equal(types.I1) {
+				return nil, posError(right.Pos, "logical or operator requires boolean operands")
+			}
+			return rightVal, nil
+		})
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		if ptrType, ok := rightVal.Type().(*types.PointerType); ok && ptrType.ElemType == left.Type() {
-			rightVal = ctx.NewLoad(ptrType.ElemType, rightVal)
-		}
+	return left, nil
+}
 
-		if rightVal.Type() != types.I1 {
-			return nil, posError(right.Pos, "logical or operator requires boolean operands")
-		}
+// shortCircuit compiles the right operand of a logical operator in its own block, which
+// is skipped when `left` equals `result`, the value that decides the whole operation.
+func (ctx *Context) shortCircuit(left value.Value, result bool, compileRight func() (value.Value, error)) (value.Value, error) {
+	leftEnd := ctx.Block
+	rightB := ctx.Block.Parent.NewBlock("")
+	endB := ctx.Block.Parent.NewBlock("")
+	if result {
+		ctx.NewCondBr(left, endB, rightB)
+	} else {
+		ctx.NewCondBr(left, rightB, endB)
+	}
 
-		left = ctx.NewOr(left, rightVal)
+	ctx.Block = rightB
+	rightVal, err := compileRight()
+	if err != nil {
+		return nil, err
 	}
+	rightEnd := ctx.Block
+	ctx.NewBr(endB)
 
-	return left, nil
+	ctx.Block = endB
+	return ctx.NewPhi(ir.NewIncoming(constant.NewBool(result), leftEnd), ir.NewIncoming(rightVal, rightEnd)), nil
 }
 
 func (ctx *Context) compileBitwiseAnd(b *parser.BitwiseAnd) (value.Value, error) {
@@ -112,12 +159,8 @@ func (ctx *Context) compileBitwiseAnd(b *parser.BitwiseAnd) (value.Value, error)
 		return nil, err
 	}
 
-	if _, ok := left.Type().(*types.IntType); len(b.Right) != 0 && !ok {
-		return nil, posError(b.Left.Pos, "bitwise and operator requires integer operands")
-	}
-
-	for _, right := range b.Right {
-		rightVal, err := ctx.compileBitwiseAnd(right)
+	for i, right := range b.Right {
+		rightVal, err := ctx.compileEquality(right)
 		if err != nil {
 			return nil, err
 		}
@@ -126,12 +169,29 @@ func (ctx *Context) compileBitwiseAnd(b *parser.BitwiseAnd) (value.Value, error)
 			rightVal = ctx.NewLoad(ptrType.ElemType, rightVal)
 		}
 
+		result, overloaded, err := ctx.compileOperatorOverload(left, b.Op[i], right.Pos, rightVal)
+		if err != nil {
+			return nil, err
+		} else if overloaded {
+			left = result
+			continue
+		}
+
+		if _, ok := left.Type().(*types.IntType); !ok {
+			return nil, posError(b.Left.Pos, "bitwise and operator requires integer operands")
+		}
+
 		if _, ok := rightVal.Type().(*types.IntType); !ok {
 			return nil, posError(right.Pos, "bitwise and operator requires integer operands")
 		}
 
-		if left.Type() != rightVal.Type() {
-			return nil, posError(right.Pos, "operands must be the same type (%s != %s)", left.Type(), rightVal.Type())
+		left, rightVal, err = ctx.promoteOperands(left, rightVal, right.Pos)
+		if err != nil {
+			return nil, err
+		}
+
+		if !left.Type().Equal(rightVal.Type()) {
+			return nil, posError(right.Pos, "operands must be the same type (%s != %s)", ctx.TypeToString(left.Type()), ctx.TypeToString(rightVal.Type()))
 		}
 
 		left = ctx.NewAnd(left, rightVal)
@@ -146,12 +206,8 @@ func (ctx *Context) compileBitwiseXor(b *parser.BitwiseXor) (value.Value, error)
 		return nil, err
 	}
 
-	if _, ok := left.Type().(*types.IntType); len(b.Right) != 0 && !ok {
-		return nil, posError(b.Left.Pos, "bitwise xor operator requires integer operands")
-	}
-
-	for _, right := range b.Right {
-		rightVal, err := ctx.compileBitwiseXor(right)
+	for i, right := range b.Right {
+		rightVal, err := ctx.compileBitwiseAnd(right)
 		if err != nil {
 			return nil, err
 		}
@@ -160,12 +216,29 @@ func (ctx *Context) compileBitwiseXor(b *parser.BitwiseXor) (value.Value, error)
 			rightVal = ctx.NewLoad(ptrType.ElemType, rightVal)
 		}
 
+		result, overloaded, err := ctx.compileOperatorOverload(left, b.Op[i], right.Pos, rightVal)
+		if err != nil {
+			return nil, err
+		} else if overloaded {
+			left = result
+			continue
+		}
+
+		if _, ok := left.Type().(*types.IntType); !ok {
+			return nil, posError(b.Left.Pos, "bitwise xor operator requires integer operands")
+		}
+
 		if _, ok := rightVal.Type().(*types.IntType); !ok {
 			return nil, posError(right.Pos, "bitwise xor operator requires integer operands")
 		}
 
-		if left.Type() != rightVal.Type() {
-			return nil, posError(right.Pos, "operands must be the same type (%s != %s)", left.Type(), rightVal.Type())
+		left, rightVal, err = ctx.promoteOperands(left, rightVal, right.Pos)
+		if err != nil {
+			return nil, err
+		}
+
+		if !left.Type().Equal(rightVal.Type()) {
+			return nil, posError(right.Pos, "operands must be the same type (%s != %s)", ctx.TypeToString(left.Type()), ctx.TypeToString(rightVal.Type()))
 		}
 
 		left = ctx.NewXor(left, rightVal)
@@ -180,12 +253,8 @@ func (ctx *Context) compileBitwiseOr(b *parser.BitwiseOr) (value.Value, error) {
 		return nil, err
 	}
 
-	if _, ok := left.Type().(*types.IntType); len(b.Right) != 0 && !ok {
-		return nil, posError(b.Left.Pos, "bitwise or operator requires integer operands")
-	}
-
-	for _, right := range b.Right {
-		rightVal, err := ctx.compileBitwiseOr(right)
+	for i, right := range b.Right {
+		rightVal, err := ctx.compileBitwiseXor(right)
 		if err != nil {
 			return nil, err
 		}
@@ -194,12 +263,29 @@ func (ctx *Context) compileBitwiseOr(b *parser.BitwiseOr) (value.Value, error) {
 			rightVal = ctx.NewLoad(ptrType.ElemType, rightVal)
 		}
 
+		result, overloaded, err := ctx.compileOperatorOverload(left, b.Op[i], right.Pos, rightVal)
+		if err != nil {
+			return nil, err
+		} else if overloaded {
+			left = result
+			continue
+		}
+
+		if _, ok := left.Type().(*types.IntType); !ok {
+			return nil, posError(b.Left.Pos, "bitwise or operator requires integer operands")
+		}
+
 		if _, ok := rightVal.Type().(*types.IntType); !ok {
 			return nil, posError(right.Pos, "bitwise or operator requires integer operands")
 		}
 
-		if left.Type() != rightVal.Type() {
-			return nil, posError(right.Pos, "operands must be the same type (%s != %s)", left.Type(), rightVal.Type())
+		left, rightVal, err = ctx.promoteOperands(left, rightVal, right.Pos)
+		if err != nil {
+			return nil, err
+		}
+
+		if !left.Type().Equal(rightVal.Type()) {
+			return nil, posError(right.Pos, "operands must be the same type (%s != %s)", ctx.TypeToString(left.Type()), ctx.TypeToString(rightVal.Type()))
 		}
 
 		left = ctx.NewOr(left, rightVal)
@@ -209,13 +295,21 @@ func (ctx *Context) compileBitwiseOr(b *parser.BitwiseOr) (value.Value, error) {
 }
 
 func (ctx *Context) compileEquality(e *parser.Equality) (value.Value, error) {
+	// The result is a boolean, the operands are typed after the left one
+	if len(e.Right) != 0 {
+		requested := ctx.RequestedType
+		defer func() { ctx.RequestedType = requested }()
+		ctx.RequestedType = nil
+	}
+
 	left, err := ctx.compileRelational(e.Left)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, right := range e.Right {
-		rightVal, err := ctx.compileEquality(right)
+	for i, right := range e.Right {
+		ctx.RequestedType = left.Type()
+		rightVal, err := ctx.compileRelational(right)
 		if err != nil {
 			return nil, err
 		}
@@ -224,11 +318,28 @@ func (ctx *Context) compileEquality(e *parser.Equality) (value.Value, error) {
 			rightVal = ctx.NewLoad(ptrType.ElemType, rightVal)
 		}
 
-		if left.Type() != rightVal.Type() {
-			return nil, posError(e.Left.Pos, "operands must be the same type")
+		var withNull bool
+		left, rightVal, withNull = nullOperands(left, rightVal)
+		if !withNull {
+			result, overloaded, err := ctx.compileOperatorOverload(left, e.Op[i], right.Pos, rightVal)
+			if err != nil {
+				return nil, err
+			} else if overloaded {
+				left = result
+				continue
+			}
+		}
+
+		left, rightVal, err = ctx.promoteOperands(left, rightVal, right.Pos)
+		if err != nil {
+			return nil, err
 		}
 
-		switch right.Op {
+		if !left.Type().Equal(rightVal.Type()) {
+			return nil, posError(right.Pos, "operands must be the same type (%s != %s)", ctx.TypeToString(left.Type()), ctx.TypeToString(rightVal.Type()))
+		}
+
+		switch e.Op[i] {
 		case "==":
 			if types.IsFloat(left.Type()) {
 				left = ctx.NewFCmp(enum.FPredOEQ, left, rightVal)
@@ -242,7 +353,7 @@ func (ctx *Context) compileEquality(e *parser.Equality) (value.Value, error) {
 				left = ctx.NewICmp(enum.IPredNE, left, rightVal)
 			}
 		default:
-			return nil, posError(right.Pos, "unknown equality operator: %s", right.Op)
+			return nil, posError(right.Pos, "unknown equality operator: %s", e.Op[i])
 		}
 	}
 
@@ -250,18 +361,21 @@ func (ctx *Context) compileEquality(e *parser.Equality) (value.Value, error) {
 }
 
 func (ctx *Context) compileRelational(r *parser.Relational) (value.Value, error) {
+	// The result is a boolean, the operands are typed after the left one
+	if len(r.Right) != 0 {
+		requested := ctx.RequestedType
+		defer func() { ctx.RequestedType = requested }()
+		ctx.RequestedType = nil
+	}
+
 	left, err := ctx.compileShift(r.Left)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(r.Right) != 0 && !isNumeric(left.Type()) {
-		return nil, posError(r.Left.Pos, "relational operator requires numeric operands")
-	}
-
-	lrop := r.Op
-	for _, right := range r.Right {
-		rightVal, err := ctx.compileRelational(right)
+	for i, right := range r.Right {
+		ctx.RequestedType = left.Type()
+		rightVal, err := ctx.compileShift(right)
 		if err != nil {
 			return nil, err
 		}
@@ -270,43 +384,80 @@ func (ctx *Context) compileRelational(r *parser.Relational) (value.Value, error)
 			rightVal = ctx.NewLoad(ptrType.ElemType, rightVal)
 		}
 
+		var withNull bool
+		left, rightVal, withNull = nullOperands(left, rightVal)
+		if !withNull {
+			result, overloaded, err := ctx.compileOperatorOverload(left, r.Op[i], right.Pos, rightVal)
+			if err != nil {
+				return nil, err
+			} else if overloaded {
+				left = result
+				continue
+			}
+		}
+
+		if _, ok := left.Type().(*types.PointerType); ok {
+			// Pointers are ordered by address
+			if !left.Type().Equal(rightVal.Type()) {
+				return nil, posError(right.Pos, "Cannot compare %s and %s", ctx.TypeToString(left.Type()), ctx.TypeToString(rightVal.Type()))
+			}
+			left = ctx.NewICmp(pointerPredicate(r.Op[i]), left, rightVal)
+			continue
+		}
+
+		if !isNumeric(left.Type()) {
+			return nil, posError(r.Left.Pos, "relational operator requires numeric operands")
+		}
+
 		if !isNumeric(rightVal.Type()) {
 			return nil, posError(right.Pos, "relational operator requires numeric operands")
 		}
 
+		left, rightVal, err = ctx.promoteOperands(left, rightVal, right.Pos)
+		if err != nil {
+			return nil, err
+		}
+
 		if !left.Type().Equal(rightVal.Type()) {
-			return nil, posError(right.Pos, "operands must be the same type (%s != %s)", left.Type(), rightVal.Type())
+			return nil, posError(right.Pos, "operands must be the same type (%s != %s)", ctx.TypeToString(left.Type()), ctx.TypeToString(rightVal.Type()))
 		}
 
-		switch lrop {
+		switch r.Op[i] {
 		case "<=":
 			if types.IsFloat(left.Type()) {
 				left = ctx.NewFCmp(enum.FPredOLE, left, rightVal)
+			} else if ctx.isUnsigned(left.Type()) {
+				left = ctx.NewICmp(enum.IPredULE, left, rightVal)
 			} else {
 				left = ctx.NewICmp(enum.IPredSLE, left, rightVal)
 			}
 		case ">=":
 			if types.IsFloat(left.Type()) {
 				left = ctx.NewFCmp(enum.FPredOGE, left, rightVal)
+			} else if ctx.isUnsigned(left.Type()) {
+				left = ctx.NewICmp(enum.IPredUGE, left, rightVal)
 			} else {
 				left = ctx.NewICmp(enum.IPredSGE, left, rightVal)
 			}
 		case "<":
 			if types.IsFloat(left.Type()) {
 				left = ctx.NewFCmp(enum.FPredOLT, left, rightVal)
+			} else if ctx.isUnsigned(left.Type()) {
+				left = ctx.NewICmp(enum.IPredULT, left, rightVal)
 			} else {
 				left = ctx.NewICmp(enum.IPredSLT, left, rightVal)
 			}
 		case ">":
 			if types.IsFloat(left.Type()) {
 				left = ctx.NewFCmp(enum.FPredOGT, left, rightVal)
+			} else if ctx.isUnsigned(left.Type()) {
+				left = ctx.NewICmp(enum.IPredUGT, left, rightVal)
 			} else {
 				left = ctx.NewICmp(enum.IPredSGT, left, rightVal)
 			}
 		default:
-			return nil, posError(right.Pos, "unknown relational operator: %s", lrop)
+			return nil, posError(right.Pos, "unknown relational operator: %s", r.Op[i])
 		}
-		lrop = right.Op
 	}
 
 	return left, nil
@@ -318,12 +469,8 @@ func (ctx *Context) compileShift(s *parser.Shift) (value.Value, error) {
 		return nil, err
 	}
 
-	if _, ok := left.Type().(*types.IntType); len(s.Right) != 0 && !ok {
-		return nil, posError(s.Left.Pos, "shift operator requires integer operands")
-	}
-
-	for _, right := range s.Right {
-		rightVal, err := ctx.compileShift(right)
+	for i, right := range s.Right {
+		rightVal, err := ctx.compileAdditive(right)
 		if err != nil {
 			return nil, err
 		}
@@ -332,21 +479,39 @@ func (ctx *Context) compileShift(s *parser.Shift) (value.Value, error) {
 			rightVal = ctx.NewLoad(ptrType.ElemType, rightVal)
 		}
 
+		result, overloaded, err := ctx.compileOperatorOverload(left, s.Op[i], right.Pos, rightVal)
+		if err != nil {
+			return nil, err
+		} else if overloaded {
+			left = result
+			continue
+		}
+
+		if _, ok := left.Type().(*types.IntType); !ok {
+			return nil, posError(s.Left.Pos, "shift operator requires integer operands")
+		}
+
 		if _, ok := rightVal.Type().(*types.IntType); !ok {
 			return nil, posError(right.Pos, "shift operator requires integer operands")
 		}
 
-		if left.Type() != rightVal.Type() {
-			return nil, posError(right.Pos, "operands must be the same type (%s != %s)", left.Type(), rightVal.Type())
-		}
+		// The shift amount takes the type of the shifted value
+		rightVal = ctx.resizeInt(rightVal, left.Type().(*types.IntType))
 
-		switch right.Op {
+		switch s.Op[i] {
 		case "<<":
 			left = ctx.NewShl(left, rightVal)
-		case ">>", ">>>":
+		case ">>":
+			// Signed values keep their sign
+			if ctx.isUnsigned(left.Type()) {
+				left = ctx.NewLShr(left, rightVal)
+			} else {
+				left = ctx.NewAShr(left, rightVal)
+			}
+		case ">>>":
 			left = ctx.NewLShr(left, rightVal)
 		default:
-			return nil, posError(right.Pos, "unknown shift operator: %s", right.Op)
+			return nil, posError(right.Pos, "unknown shift operator: %s", s.Op[i])
 		}
 	}
 
@@ -359,12 +524,14 @@ func (ctx *Context) compileAdditive(a *parser.Additive) (value.Value, error) {
 		return nil, err
 	}
 
-	if len(a.Right) != 0 && !isNumeric(left.Type()) {
-		return nil, posError(a.Left.Pos, "additive operator requires numeric operands")
-	}
-
-	for _, right := range a.Right {
-		rightVal, err := ctx.compileAdditive(right)
+	for i, right := range a.Right {
+		requested := ctx.RequestedType
+		if _, ok := left.Type().(*types.PointerType); ok {
+			// The offset from a pointer is an integer
+			ctx.RequestedType = nil
+		}
+		rightVal, err := ctx.compileMultiplicative(right)
+		ctx.RequestedType = requested
 		if err != nil {
 			return nil, err
 		}
@@ -373,30 +540,39 @@ func (ctx *Context) compileAdditive(a *parser.Additive) (value.Value, error) {
 			rightVal = ctx.NewLoad(ptrType.ElemType, rightVal)
 		}
 
+		result, overloaded, err := ctx.compileOperatorOverload(left, a.Op[i], right.Pos, rightVal)
+		if err != nil {
+			return nil, err
+		} else if overloaded {
+			left = result
+			continue
+		}
+
+		if result, ok, err := ctx.compilePointerArithmetic(left, rightVal, a.Op[i], right.Pos); err != nil {
+			return nil, err
+		} else if ok {
+			left = result
+			continue
+		}
+
+		if !isNumeric(left.Type()) {
+			return nil, posError(a.Left.Pos, "additive operator requires numeric operands")
+		}
+
 		if !isNumeric(rightVal.Type()) {
 			return nil, posError(right.Pos, "additive operator requires numeric operands")
 		}
 
-		if left.Type() != rightVal.Type() {
-			return nil, posError(right.Pos, "operands must be the same type (%s != %s)", left.Type(), rightVal.Type())
+		left, rightVal, err = ctx.promoteOperands(left, rightVal, right.Pos)
+		if err != nil {
+			return nil, err
 		}
 
-		switch leftType := left.(type) {
-		case *ir.InstLoad, *ir.InstCall, *ir.InstAlloca:
-			if ptrType, ok := leftType.Type().(*types.PointerType); ok {
-				if structType, ok := ptrType.ElemType.(*types.StructType); ok {
-					// Check if the class has a method with the name "classname.op.operator"
-					methodName := fmt.Sprintf("%s.op.%s", structType.Name(), a.Op)
-					if method, ok := ctx.lookupFunction(methodName); ok {
-						// Call the method and use its result as the result
-						left = ctx.NewCall(method, left, rightVal)
-						continue
-					}
-				}
-			}
+		if !left.Type().Equal(rightVal.Type()) {
+			return nil, posError(right.Pos, "operands must be the same type (%s != %s)", ctx.TypeToString(left.Type()), ctx.TypeToString(rightVal.Type()))
 		}
 
-		switch a.Op {
+		switch a.Op[i] {
 		case "+":
 			if types.IsFloat(left.Type()) {
 				left = ctx.NewFAdd(left, rightVal)
@@ -410,7 +586,7 @@ func (ctx *Context) compileAdditive(a *parser.Additive) (value.Value, error) {
 				left = ctx.NewSub(left, rightVal)
 			}
 		default:
-			return nil, posError(right.Pos, "unknown additive operator: %s", a.Op)
+			return nil, posError(right.Pos, "unknown additive operator: %s", a.Op[i])
 		}
 	}
 
@@ -423,12 +599,8 @@ func (ctx *Context) compileMultiplicative(m *parser.Multiplicative) (value.Value
 		return nil, err
 	}
 
-	if len(m.Right) != 0 && !isNumeric(left.Type()) {
-		return nil, posError(m.Left.Pos, "multiplicative operator requires numeric operands")
-	}
-
-	for _, right := range m.Right {
-		rightVal, err := ctx.compileMultiplicative(right)
+	for i, right := range m.Right {
+		rightVal, err := ctx.compileLogicalNot(right)
 		if err != nil {
 			return nil, err
 		}
@@ -437,30 +609,32 @@ func (ctx *Context) compileMultiplicative(m *parser.Multiplicative) (value.Value
 			rightVal = ctx.NewLoad(ptrType.ElemType, rightVal)
 		}
 
+		result, overloaded, err := ctx.compileOperatorOverload(left, m.Op[i], right.Pos, rightVal)
+		if err != nil {
+			return nil, err
+		} else if overloaded {
+			left = result
+			continue
+		}
+
+		if !isNumeric(left.Type()) {
+			return nil, posError(m.Left.Pos, "multiplicative operator requires numeric operands")
+		}
+
 		if !isNumeric(rightVal.Type()) {
 			return nil, posError(right.Pos, "multiplicative operator requires numeric operands")
 		}
 
-		if left.Type() != rightVal.Type() {
-			return nil, posError(right.Pos, "operands must be the same type (%s != %s)", left.Type(), rightVal.Type())
+		left, rightVal, err = ctx.promoteOperands(left, rightVal, right.Pos)
+		if err != nil {
+			return nil, err
 		}
 
-		switch leftType := left.(type) {
-		case *ir.InstLoad, *ir.InstCall, *ir.InstAlloca:
-			if ptrType, ok := leftType.Type().(*types.PointerType); ok {
-				if structType, ok := ptrType.ElemType.(*types.StructType); ok {
-					// Check if the class has a method with the name "classname.op.operator"
-					methodName := fmt.Sprintf("%s.op.%s", structType.Name(), right.Op)
-					if method, ok := ctx.lookupFunction(methodName); ok {
-						// Call the method and use its result as the result
-						left = ctx.NewCall(method, left, rightVal)
-						continue
-					}
-				}
-			}
+		if !left.Type().Equal(rightVal.Type()) {
+			return nil, posError(right.Pos, "operands must be the same type (%s != %s)", ctx.TypeToString(left.Type()), ctx.TypeToString(rightVal.Type()))
 		}
 
-		switch right.Op {
+		switch m.Op[i] {
 		case "*":
 			if types.IsFloat(left.Type()) {
 				left = ctx.NewFMul(left, rightVal)
@@ -470,17 +644,21 @@ func (ctx *Context) compileMultiplicative(m *parser.Multiplicative) (value.Value
 		case "/":
 			if types.IsFloat(left.Type()) {
 				left = ctx.NewFDiv(left, rightVal)
+			} else if ctx.isUnsigned(left.Type()) {
+				left = ctx.NewUDiv(left, rightVal)
 			} else {
 				left = ctx.NewSDiv(left, rightVal)
 			}
 		case "%":
 			if types.IsFloat(left.Type()) {
 				left = ctx.NewFRem(left, rightVal)
+			} else if ctx.isUnsigned(left.Type()) {
+				left = ctx.NewURem(left, rightVal)
 			} else {
 				left = ctx.NewSRem(left, rightVal)
 			}
 		default:
-			return nil, posError(right.Pos, "unknown multiplicative operator: %s", right.Op)
+			return nil, posError(right.Pos, "unknown multiplicative operator: %s", m.Op[i])
 		}
 	}
 
@@ -494,7 +672,14 @@ func (ctx *Context) compileLogicalNot(l *parser.LogicalNot) (value.Value, error)
 	}
 
 	if l.Op != "" {
-		if right.Type() != types.I1 {
+		result, overloaded, err := ctx.compileOperatorOverload(right, l.Op, l.Pos)
+		if err != nil {
+			return nil, err
+		} else if overloaded {
+			return result, nil
+		}
+
+		if !right.Type().Equal(types.I1) {
 			return nil, posError(l.Right.Pos, "logical not operator requires a boolean operand")
 		}
 		right = ctx.NewXor(right, constant.NewInt(types.I1, 1))
@@ -504,12 +689,19 @@ func (ctx *Context) compileLogicalNot(l *parser.LogicalNot) (value.Value, error)
 }
 
 func (ctx *Context) compileBitwiseNot(b *parser.BitwiseNot) (value.Value, error) {
-	right, err := ctx.compilePrefixAdditive(b.Right)
+	right, err := ctx.compileNegation(b.Right)
 	if err != nil {
 		return nil, err
 	}
 
 	if b.Op != "" {
+		result, overloaded, err := ctx.compileOperatorOverload(right, b.Op, b.Pos)
+		if err != nil {
+			return nil, err
+		} else if overloaded {
+			return result, nil
+		}
+
 		intType, ok := right.Type().(*types.IntType)
 		if !ok {
 			return nil, posError(b.Right.Pos, "bitwise not operator requires an integer operand")
@@ -522,6 +714,33 @@ func (ctx *Context) compileBitwiseNot(b *parser.BitwiseNot) (value.Value, error)
 	return right, nil
 }
 
+func (ctx *Context) compileNegation(n *parser.Negation) (value.Value, error) {
+	right, err := ctx.compilePrefixAdditive(n.Right)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.Op != "" {
+		result, overloaded, err := ctx.compileOperatorOverload(right, n.Op, n.Pos)
+		if err != nil {
+			return nil, err
+		} else if overloaded {
+			return result, nil
+		}
+
+		switch t := right.Type().(type) {
+		case *types.IntType:
+			right = ctx.NewSub(constant.NewInt(t, 0), right)
+		case *types.FloatType:
+			right = ctx.NewFNeg(right)
+		default:
+			return nil, posError(n.Right.Pos, "negation operator requires a numeric operand")
+		}
+	}
+
+	return right, nil
+}
+
 func (ctx *Context) compilePrefixAdditive(p *parser.PrefixAdditive) (value.Value, error) {
 	right, err := ctx.compilePostfixAdditive(p.Right)
 	if err != nil {
@@ -536,10 +755,15 @@ func (ctx *Context) compilePrefixAdditive(p *parser.PrefixAdditive) (value.Value
 				return ctx.NewFSub(right, constant.NewFloat(types.Float, 1)), nil
 			}
 		} else {
+			intType, ok := right.Type().(*types.IntType)
+			if !ok {
+				return nil, posError(p.Right.Pos, "%s operator requires a numeric operand", p.Op)
+			}
+			one := constant.NewInt(intType, 1)
 			if p.Op == "++" {
-				return ctx.NewAdd(right, constant.NewInt(types.I8, 1)), nil
+				return ctx.NewAdd(right, one), nil
 			} else {
-				return ctx.NewSub(right, constant.NewInt(types.I8, 1)), nil
+				return ctx.NewSub(right, one), nil
 			}
 		}
 	}
@@ -562,10 +786,15 @@ func (ctx *Context) compilePostfixAdditive(p *parser.PostfixAdditive) (value.Val
 				left = ctx.NewFSub(left, constant.NewFloat(types.Float, 1))
 			}
 		} else {
+			intType, ok := left.Type().(*types.IntType)
+			if !ok {
+				return nil, posError(p.Left.Pos, "%s operator requires a numeric operand", p.Op)
+			}
+			one := constant.NewInt(intType, 1)
 			if p.Op == "++" {
-				left = ctx.NewAdd(left, constant.NewInt(types.I8, 1))
+				left = ctx.NewAdd(left, one)
 			} else {
-				left = ctx.NewSub(left, constant.NewInt(types.I8, 1))
+				left = ctx.NewSub(left, one)
 			}
 		}
 		if _, ok := original.Type().(*types.PointerType); ok {
@@ -585,19 +814,23 @@ func (ctx *Context) compileFactor(f *parser.Factor) (value.Value, error) {
 		if err != nil {
 			return nil, err
 		}
+		if f.Identifier.Ref != "" {
+			// The address itself is the value
+			return val, nil
+		}
 		if v, ok := val.(*ir.InstAlloca); ok {
 			elemType := v.Type().(*types.PointerType).ElemType
-			if _, isStruct := elemType.(*types.StructType); isStruct {
-				return val, nil
-			}
-			if _, isPointer := elemType.(*types.PointerType); isPointer {
+			if _, isStruct := elemType.(*types.StructType); isStruct && !ctx.isClosure(elemType) && !ctx.isInterface(elemType) && !ctx.isUnion(elemType) {
 				return val, nil
 			}
 			return ctx.NewLoad(elemType, val), nil
-		} else if v, ok := val.(*ir.InstPhi); ok {
-			return ctx.NewLoad(v.Type().(*types.PointerType).ElemType, val), nil
 		} else if v, ok := val.(*ir.InstGetElementPtr); ok {
 			return ctx.NewLoad(v.Type().(*types.PointerType).ElemType, val), nil
+		} else if v, ok := val.(*ir.Global); ok {
+			if _, isStruct := v.ContentType.(*types.StructType); isStruct && !ctx.isClosure(v.ContentType) && !ctx.isInterface(v.ContentType) && !ctx.isUnion(v.ContentType) {
+				return val, nil
+			}
+			return ctx.NewLoad(v.ContentType, val), nil
 		}
 		return val, nil
 	} else if f.BitCast != nil {
@@ -608,12 +841,23 @@ func (ctx *Context) compileFactor(f *parser.Factor) (value.Value, error) {
 		return ctx.compileFunctionCall(f.FunctionCall)
 	} else if f.ClassInitializer != nil {
 		return ctx.compileClassInitializer(f.ClassInitializer)
+	} else if f.Lambda != nil {
+		return ctx.compileLambda(f.Lambda)
+	} else if f.Match != nil {
+		return ctx.compileMatch(f.Match)
 	} else {
 		return nil, posError(f.Pos, "Unknown factor type")
 	}
 }
 
 func (ctx *Context) compileBitCast(bc *parser.BitCast) (value.Value, error) {
+	// The cast decides the type of the result, not the context
+	if bc.Type != nil {
+		requested := ctx.RequestedType
+		defer func() { ctx.RequestedType = requested }()
+		ctx.RequestedType = nil
+	}
+
 	val, err := ctx.compileExpression(bc.Expr)
 	if err != nil {
 		return nil, err
@@ -627,37 +871,13 @@ func (ctx *Context) compileBitCast(bc *parser.BitCast) (value.Value, error) {
 
 	// If the value is already of the target type, just return it
 	if val.Type().Equal(targetType) {
-		return val, nil
-	}
-
-	// Predefined bitcasts
-	switch targetType {
-	case types.Double:
-		if val.Type().Equal(types.Float) {
-			val = ctx.NewFPExt(val, types.Double)
-		}
-		if _, ok := val.Type().(*types.IntType); ok {
-			val = ctx.NewSIToFP(val, targetType)
-		}
-	case types.Float:
-		if val.Type().Equal(types.Double) {
-			val = ctx.NewFPTrunc(val, types.Float)
-		}
-		if _, ok := val.Type().(*types.IntType); ok {
-			val = ctx.NewSIToFP(val, targetType)
-		}
-	}
-
-	if valType, ok := val.Type().(*types.IntType); ok {
-		if targetType, ok := targetType.(*types.IntType); ok {
-			if valType.BitSize < targetType.BitSize {
-				// Extend if valType is smaller than targetType
-				val = ctx.NewSExt(val, targetType)
-			} else if valType.BitSize > targetType.BitSize {
-				// Truncate if valType is larger than targetType
-				val = ctx.NewTrunc(val, targetType)
-			}
+		if ctx.isUnsigned(val.Type()) == ctx.isUnsigned(targetType) {
+			return val, nil
+		} else if c := ctx.convertConstant(val, targetType); c != nil {
+			return c, nil
 		}
+		// Only the signedness changes, which a no-op bitcast records in the type
+		return ctx.NewBitCast(val, targetType), nil
 	}
 
 	// If the value is a struct type or a pointer to a struct type, try to find a conversion function
@@ -679,16 +899,79 @@ func (ctx *Context) compileBitCast(bc *parser.BitCast) (value.Value, error) {
 		}
 	}
 
-	// If the value is not a custom type or there is no conversion function, perform a bitcast
-	bitcast := ctx.NewBitCast(val, targetType)
-	if bitcast.Type().Equal(targetType) {
-		return bitcast, nil
+	cast, ok := ctx.castValue(val, targetType)
+	if !ok {
+		return nil, posError(bc.Pos, "Cannot cast %s to %s", ctx.TypeToString(val.Type()), ctx.TypeToString(targetType))
 	}
+	return cast, nil
+}
 
-	return nil, posError(bc.Pos, "Cannot convert %s to %s", val.Type().Name(), ctx.CFTypeToLLType(bc.Type).Name())
+// castValue converts `v` to the type `t` for an explicit cast:
+//
+//	from \ to | integer            | float          | pointer
+//	integer   | trunc, sext, zext  | sitofp, uitofp | inttoptr
+//	float     | fptosi, fptoui     | fpext, fptrunc |
+//	pointer   | ptrtoint           |                | bitcast
+//
+// Casting to i1 compares the value with zero instead of truncating it.
+// It returns false if there is no cast between the two types.
+func (ctx *Context) castValue(v value.Value, t types.Type) (value.Value, bool) {
+	switch from := v.Type().(type) {
+	case *types.IntType:
+		switch to := t.(type) {
+		case *types.IntType:
+			if to.BitSize == 1 && from.BitSize != 1 {
+				return ctx.NewICmp(enum.IPredNE, v, constant.NewInt(from, 0)), true
+			}
+			return ctx.resizeInt(v, to), true
+		case *types.FloatType:
+			if ctx.isUnsigned(from) {
+				return ctx.NewUIToFP(v, to), true
+			}
+			return ctx.NewSIToFP(v, to), true
+		case *types.PointerType:
+			return ctx.NewIntToPtr(v, to), true
+		}
+	case *types.FloatType:
+		switch to := t.(type) {
+		case *types.IntType:
+			if to.BitSize == 1 {
+				return ctx.NewFCmp(enum.FPredUNE, v, constant.NewFloat(from, 0)), true
+			} else if ctx.isUnsigned(to) {
+				return ctx.NewFPToUI(v, to), true
+			}
+			return ctx.NewFPToSI(v, to), true
+		case *types.FloatType:
+			if from.Kind < to.Kind {
+				return ctx.NewFPExt(v, to), true
+			}
+			return ctx.NewFPTrunc(v, to), true
+		}
+	case *types.PointerType:
+		switch to := t.(type) {
+		case *types.IntType:
+			return ctx.NewPtrToInt(v, to), true
+		case *types.PointerType:
+			return ctx.NewBitCast(v, to), true
+		}
+	}
+	return nil, false
 }
 
 func (ctx *Context) compileClassInitializer(ci *parser.ClassInitializer) (value.Value, error) {
+	var inferredArgs []value.Value
+	if _, ok := ctx.Compiler.genericClasses[ci.ClassName]; ok {
+		name, args, err := ctx.instantiateInitializedClass(ci)
+		inferredArgs = args
+		if err != nil {
+			return nil, err
+		}
+		init := *ci
+		init.ClassName = name
+		init.TypeArgs = nil
+		ci = &init
+	}
+
 	// Lookup the class
 	class, exists := ctx.lookupClass(ci.ClassName)
 	if !exists {
@@ -697,10 +980,12 @@ func (ctx *Context) compileClassInitializer(ci *parser.ClassInitializer) (value.
 	class = class.(*types.StructType)
 
 	// Allocate memory for the class
-	classPtr := ctx.NewAlloca(class)
+	classPtr := ctx.allocate(class, ci.Local)
 
-	// Initialize the class
-	constructor, exists := ctx.lookupFunction(class.Name() + ".constructor")
+	ctx.initInstances(classPtr, class)
+
+	// Initialize the class, the constructor may be inherited
+	constructor, exists := ctx.lookupClassMethod(class.Name(), "constructor")
 	if exists {
 		if len(ci.Args.Arguments) != len(constructor.Sig.Params)-1 {
 			return nil, posError(ci.Pos, "Invalid number of arguments for class constructor")
@@ -708,16 +993,31 @@ func (ctx *Context) compileClassInitializer(ci *parser.ClassInitializer) (value.
 		// Compile the arguments
 		compiledArgs := make([]value.Value, len(ci.Args.Arguments))
 		for i, arg := range ci.Args.Arguments {
-			ctx.RequestedType = constructor.Sig.Params[i+1]
+			paramType := constructor.Sig.Params[i+1]
+			if inferredArgs != nil {
+				// Already compiled to infer the type arguments of a generic class
+				converted, ok := ctx.convertValue(inferredArgs[i], paramType)
+				if !ok {
+					return nil, posError(arg.Pos, "Cannot pass a value of type %s as argument %d of type %s", ctx.TypeToString(inferredArgs[i].Type()), i+1, ctx.TypeToString(paramType))
+				}
+				compiledArgs[i] = converted
+				continue
+			}
+			ctx.RequestedType = paramType
 			expr, err := ctx.compileExpression(arg)
+			ctx.RequestedType = nil
 			if err != nil {
 				return nil, err
 			}
+			if expr, err = ctx.convertArgument(expr, paramType, i, arg.Pos); err != nil {
+				return nil, err
+			}
 			compiledArgs[i] = expr
 		}
 
 		// Call the constructor
-		ctx.NewCall(constructor, append([]value.Value{classPtr}, compiledArgs...)...)
+		_, this := ctx.methodCallee(classPtr, class.Name(), "constructor", constructor, true)
+		ctx.NewCall(constructor, append([]value.Value{this}, compiledArgs...)...)
 	}
 
 	// Return the class pointer
@@ -727,6 +1027,13 @@ func (ctx *Context) compileClassInitializer(ci *parser.ClassInitializer) (value.
 func (ctx *Context) compileFunctionCall(fc *parser.FunctionCall) (value.Value, error) {
 	// Lookup the function
 	fc.FunctionName = strings.Trim(fc.FunctionName, "\"")
+	if v := ctx.lookupVariable(fc.FunctionName); v != nil && ctx.isCallable(v.Type) {
+		// Call through a variable or parameter holding a function or closure
+		return ctx.compileIndirectCall(ctx.variableValue(v), fc.FunctionName, &fc.Args, fc.Pos)
+	}
+	if def, ok := ctx.Compiler.genericFuncs[fc.FunctionName]; ok {
+		return ctx.compileGenericCall(def, fc)
+	}
 	function, exists := ctx.lookupFunction(fc.FunctionName)
 	if !exists {
 		return nil, posError(fc.Pos, "Function %s not found", fc.FunctionName)
@@ -743,6 +1050,11 @@ func (ctx *Context) compileFunctionCall(fc *parser.FunctionCall) (value.Value, e
 			return nil, err
 		}
 		ctx.RequestedType = nil
+		if i < len(function.Sig.Params) {
+			if expr, err = ctx.convertArgument(expr, function.Sig.Params[i], i, arg.Pos); err != nil {
+				return nil, err
+			}
+		}
 		compiledArgs[i] = expr
 	}
 
@@ -754,8 +1066,13 @@ func (ctx *Context) compileValue(v *parser.Value) (value.Value, error) {
 	if v.Float != nil {
 		if ctx.RequestedType != nil {
 			if ptrType, ok := ctx.RequestedType.(*types.PointerType); ok {
-				local := ctx.NewAlloca(ptrType.ElemType.(*types.FloatType))
-				ctx.NewStore(constant.NewFloat(ptrType.ElemType.(*types.FloatType), *v.Float), local)
+				floatType, ok := ptrType.ElemType.(*types.FloatType)
+				if !ok {
+					// Not a pointer to a float, e.g. an operand of an overloaded operator
+					return constant.NewFloat(types.Double, *v.Float), nil
+				}
+				local := ctx.NewAlloca(floatType)
+				ctx.NewStore(constant.NewFloat(floatType, *v.Float), local)
 				return local, nil
 			} else if ctx.RequestedType == types.Float {
 				return constant.NewFloat(types.Float, *v.Float), nil
@@ -765,16 +1082,14 @@ func (ctx *Context) compileValue(v *parser.Value) (value.Value, error) {
 				return constant.NewFloat(types.Half, *v.Float), nil
 			} else if ctx.RequestedType == types.FP128 {
 				return constant.NewFloat(types.FP128, *v.Float), nil
-			} else if ctx.RequestedType == types.I32 {
-				return constant.NewInt(types.I32, int64(*v.Float)), nil
-			} else if ctx.RequestedType == types.I64 {
-				return constant.NewInt(types.I64, int64(*v.Float)), nil
-			} else if ctx.RequestedType == types.I1 {
+			} else if ctx.RequestedType.Equal(types.I1) {
 				if *v.Float == 0 {
 					return constant.NewInt(types.I1, 0), nil
 				} else {
 					return constant.NewInt(types.I1, 1), nil
 				}
+			} else if intType, ok := ctx.RequestedType.(*types.IntType); ok {
+				return constant.NewInt(intType, int64(*v.Float)), nil
 			} else {
 				return nil, posError(v.Pos, "Cannot convert float to %s", ctx.RequestedType.Name())
 			}
@@ -783,8 +1098,13 @@ func (ctx *Context) compileValue(v *parser.Value) (value.Value, error) {
 	} else if v.Int != nil {
 		if ctx.RequestedType != nil {
 			if ptrType, ok := ctx.RequestedType.(*types.PointerType); ok {
-				local := ctx.NewAlloca(ptrType.ElemType.(*types.IntType))
-				ctx.NewStore(constant.NewInt(ptrType.ElemType.(*types.IntType), *v.Int), local)
+				intType, ok := ptrType.ElemType.(*types.IntType)
+				if !ok {
+					// Not a pointer to an integer, e.g. an operand of an overloaded operator
+					return constant.NewInt(types.I64, *v.Int), nil
+				}
+				local := ctx.NewAlloca(intType)
+				ctx.NewStore(constant.NewInt(intType, *v.Int), local)
 				return local, nil
 			} else if intType, ok := ctx.RequestedType.(*types.IntType); ok {
 				return constant.NewInt(intType, *v.Int), nil
@@ -821,22 +1141,139 @@ func (ctx *Context) compileValue(v *parser.Value) (value.Value, error) {
 		strGlobal := ctx.Module.NewGlobalDef("", constant.NewCharArrayFromString(str+"\000"))
 		strGlobal.Immutable = true
 		strGlobal.Linkage = enum.LinkagePrivate
-		return strGlobal, nil
+		// Strings are pointers to their first character
+		zero := constant.NewInt(types.I64, 0)
+		return constant.NewGetElementPtr(strGlobal.ContentType, strGlobal, zero, zero), nil
 	} else if v.Null {
+		if ptrType, ok := ctx.RequestedType.(*types.PointerType); ok {
+			return constant.NewNull(ptrType), nil
+		}
 		return constant.NewNull(types.I8Ptr), nil
+	} else if v.Array != nil {
+		return ctx.compileArrayLiteral(v)
 	} else {
 		return nil, posError(v.Pos, "Unknown value type")
 	}
 }
 
+func (ctx *Context) compileArrayLiteral(v *parser.Value) (value.Value, error) {
+	requested := ctx.RequestedType
+	defer func() { ctx.RequestedType = requested }()
+
+	// The element type comes from the requested type, or from the first element
+	var elemType types.Type
+	if arrType, ok := requested.(*types.ArrayType); ok {
+		if arrType.Len != uint64(len(v.Array)) {
+			return nil, posError(v.Pos, "Array literal has %d elements, expected %d", len(v.Array), arrType.Len)
+		}
+		elemType = arrType.ElemType
+	} else if len(v.Array) == 0 {
+		return nil, posError(v.Pos, "Cannot infer the element type of an empty array literal")
+	}
+
+	elems := make([]value.Value, len(v.Array))
+	allConst := true
+	for i, expr := range v.Array {
+		ctx.RequestedType = elemType
+		val, err := ctx.compileExpression(expr)
+		if err != nil {
+			return nil, err
+		}
+
+		if elemType == nil {
+			elemType = val.Type()
+		}
+
+		if ptrType, ok := val.Type().(*types.PointerType); ok && ptrType.ElemType.Equal(elemType) {
+			val = ctx.NewLoad(ptrType.ElemType, val)
+		} else if _, ok := elemType.(*types.PointerType); ok && !val.Type().Equal(elemType) {
+			if _, isPointer := val.Type().(*types.PointerType); isPointer {
+				if c, isConst := val.(constant.Constant); isConst {
+					val = constant.NewBitCast(c, elemType)
+				} else {
+					val = ctx.NewBitCast(val, elemType)
+				}
+			}
+		}
+
+		if !val.Type().Equal(elemType) {
+			return nil, posError(expr.Pos, "Array element must be of type %s, got %s", elemType, val.Type())
+		}
+
+		if _, ok := val.(constant.Constant); !ok {
+			allConst = false
+		}
+		elems[i] = val
+	}
+
+	arrType := types.NewArray(uint64(len(elems)), elemType)
+	if allConst {
+		consts := make([]constant.Constant, len(elems))
+		for i, elem := range elems {
+			consts[i] = elem.(constant.Constant)
+		}
+		return constant.NewArray(arrType, consts...), nil
+	}
+
+	// Build the array one element at a time if some of them are only known at runtime
+	var arr value.Value = constant.NewZeroInitializer(arrType)
+	for i, elem := range elems {
+		arr = ctx.NewInsertValue(arr, elem, uint64(i))
+	}
+	return arr, nil
+}
+
 func (ctx *Context) compileIdentifier(i *parser.Identifier, returnTopLevelStruct bool) (value.Value, types.Type, error) {
 	val := ctx.lookupVariable(i.Name)
+	if val == nil && i.Sub != nil {
+		// Static fields are accessed through the class name
+		static, err := ctx.lookupStaticField(i.Name, i.Sub.Name, i.Sub.Pos)
+		if err != nil {
+			return nil, nil, err
+		}
+		if static != nil {
+			val = static
+			i = &parser.Identifier{Pos: i.Pos, Ref: i.Ref, Deref: i.Deref, Name: static.Name, GEP: i.Sub.GEP, Sub: i.Sub.Sub}
+		}
+	}
+	if val == nil && i.Sub != nil && i.Sub.Sub == nil && i.GEP == nil && i.Sub.GEP == nil {
+		// Enum variants are accessed through the enum name
+		variant, ok, err := ctx.lookupEnumVariant(i.Name, i.Sub.Name, i.Sub.Pos)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			return variant, variant.Type(), nil
+		}
+		// And so are the variants of unions without fields
+		if def, ok := ctx.Compiler.unions[i.Name]; ok {
+			variant, err := ctx.compileUnionVariant(def, i.Sub.Name, &parser.ArgumentList{}, i.Sub.Pos)
+			if err != nil {
+				return nil, nil, err
+			}
+			return variant, variant.Type(), nil
+		}
+	}
+	if val == nil && i.Sub == nil && i.GEP == nil && i.Deref == "" {
+		// A function's name is its address
+		if fn, ok := ctx.lookupFunction(i.Name); ok {
+			return fn, fn.Type(), nil
+		}
+	}
 	if val == nil {
 		return nil, nil, posError(i.Pos, "Variable %s not found", i.Name)
 	}
 
 	if i.Sub == nil {
 		if i.GEP != nil {
+			if _, obj, ok := ctx.indexableClass(val.Value, "[]"); ok {
+				elem, err := ctx.compileIndexOperator(obj, i.GEP, i.GEP.Pos)
+				if err != nil {
+					return nil, nil, err
+				}
+				return elem, elem.Type(), nil
+			}
+
 			ctx.RequestedType = types.I32
 			gepExpr, err := ctx.compileExpression(i.GEP)
 			if err != nil {
@@ -844,103 +1281,86 @@ func (ctx *Context) compileIdentifier(i *parser.Identifier, returnTopLevelStruct
 			}
 			ctx.RequestedType = nil
 
-			var elementType types.Type
 			switch t := val.Type.(type) {
 			case *types.PointerType:
-				elementType = t.ElemType
+				ptr := val.Value
+				// Pointer variables live in a stack slot
+				if ptrType, ok := ptr.Type().(*types.PointerType); ok && ptrType.ElemType.Equal(t) {
+					ptr = ctx.NewLoad(t, ptr)
+				}
+				return ctx.NewGetElementPtr(t.ElemType, ptr, gepExpr), t.ElemType, nil
 			case *types.ArrayType:
-				elementType = t.ElemType
+				ptr := val.Value
+				if ptrType, ok := ptr.Type().(*types.PointerType); !ok || !ptrType.ElemType.Equal(t) {
+					// The array is a value, spill it so it can be indexed
+					alloc := ctx.NewAlloca(t)
+					ctx.NewStore(ptr, alloc)
+					ptr = alloc
+				}
+				return ctx.NewGetElementPtr(t, ptr, constant.NewInt(types.I32, 0), gepExpr), t.ElemType, nil
 			default:
 				return nil, nil, posError(i.GEP.Pos, "unsupported type for GetElementPtr: %s", t)
 			}
-
-			v := ctx.NewGetElementPtr(elementType, val.Value, gepExpr)
-			return v, elementType, nil
 		}
-		// Handle referencing
-		for j := 0; j < len(i.Ref); j++ {
-			// Create a pointer to the variable
-			ptrType := types.NewPointer(val.Value.Type())
-			ptr := ctx.NewAlloca(ptrType)
-			ctx.NewStore(val.Value, ptr)
-			val.Value = ptr
-			val.Type = ptrType
+		if i.Ref != "" {
+			// Take the address of the variable's storage
+			addr, err := ctx.addressOf(val, i.Pos)
+			if err != nil {
+				return nil, nil, err
+			}
+			return addr, addr.Type(), nil
 		}
 
-		// Handle dereferencing
-		for j := 0; j < len(i.Deref); j++ {
+		if i.Deref != "" {
 			// Load the value the pointer points to
-			val.Value = ctx.NewLoad(val.Value.Type().(*types.PointerType).ElemType, val.Value)
-			val.Type = val.Value.Type()
+			ptr, err := ctx.dereference(ctx.variableValue(val), len(i.Deref), i.Pos)
+			if err != nil {
+				return nil, nil, err
+			}
+			return ptr, ptr.Type(), nil
 		}
 		return val.Value, val.Value.Type(), nil
 	}
 
-	originalVal := val
-
-	// Iterate over the subs
-	currentVal := val
-	currentSub := i.Sub
-	for currentSub != nil {
-		fieldType, fieldPtr, isMethod, err := ctx.compileSubIdentifier(currentVal, currentSub)
-		if err != nil {
-			return nil, nil, err
-		}
-		if isMethod {
-			if returnTopLevelStruct {
-				return currentVal.Value, currentVal.Type, nil
-			} else {
-				return nil, nil, posError(i.Pos, "Cannot call method %s on %s", currentSub.Name, currentVal.Type.Name())
-			}
+	// Work on a copy so the variable itself isn't modified
+	obj := &Variable{Name: val.Name, Type: val.Type, Value: val.Value}
+	_, fieldPtr, isMethod, err := ctx.compileSubIdentifier(obj, i.Sub)
+	if err != nil {
+		return nil, nil, err
+	}
+	if isMethod && !returnTopLevelStruct {
+		last := i.Sub
+		for last.Sub != nil {
+			last = last.Sub
 		}
+		return nil, nil, posError(last.Pos, "Cannot call method %s on %s", last.Name, fieldPtr.Type())
+	}
 
-		// Update currentSub to its subfield
-		nextSub := currentSub.Sub
-
-		if nextSub == nil && !returnTopLevelStruct {
-			// If this is the last sub and we're not returning the top-level struct,
-			// return the field pointer
-			// Handle referencing
-			for j := 0; j < len(i.Ref); j++ {
-				// Create a pointer to the variable
-				ptrType := types.NewPointer(fieldPtr.Type())
-				ptr := ctx.NewAlloca(ptrType)
-				ctx.NewStore(fieldPtr, ptr)
-				fieldPtr = ptr
-			}
-
-			// Handle dereferencing
-			for j := 0; j < len(i.Deref); j++ {
-				// Load the value the pointer points to
-				fieldPtr = ctx.NewLoad(fieldPtr.Type().(*types.PointerType).ElemType, fieldPtr)
+	if returnTopLevelStruct {
+		// Return the struct the last field points to
+		if ptrType, ok := fieldPtr.Type().(*types.PointerType); ok && isStorage(fieldPtr) {
+			if _, ok := ptrType.ElemType.(*types.PointerType); ok {
+				fieldPtr = ctx.NewLoad(ptrType.ElemType, fieldPtr)
 			}
-			return fieldPtr, fieldPtr.Type(), nil
 		}
-
-		// Otherwise, load the field and continue
-		currentVal.Value = ctx.NewLoad(fieldType, fieldPtr)
-		currentSub = nextSub
+		return fieldPtr, fieldPtr.Type(), nil
 	}
 
-	// Handle referencing
-	for j := 0; j < len(i.Ref); j++ {
-		// Create a pointer to the variable
-		ptrType := types.NewPointer(originalVal.Value.Type())
-		ptr := ctx.NewAlloca(ptrType)
-		ctx.NewStore(originalVal.Value, ptr)
-		originalVal.Value = ptr
-		originalVal.Type = ptrType
+	if i.Deref != "" {
+		// Load the field, then the value it points to
+		if isStorage(fieldPtr) {
+			fieldPtr = ctx.NewLoad(fieldPtr.Type().(*types.PointerType).ElemType, fieldPtr)
+		}
+		ptr, err := ctx.dereference(fieldPtr, len(i.Deref), i.Pos)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ptr, ptr.Type(), nil
 	}
-
-	// Handle dereferencing
-	for j := 0; j < len(i.Deref); j++ {
-		// Load the value the pointer points to
-		originalVal.Value = ctx.NewLoad(originalVal.Value.Type().(*types.PointerType).ElemType, originalVal.Value)
-		originalVal.Type = originalVal.Value.Type()
+	if i.Ref != "" && !isStorage(fieldPtr) {
+		return nil, nil, posError(i.Pos, "Cannot take the address of a property")
 	}
-
-	// If we're here, we're returning the top-level struct
-	return originalVal.Value, originalVal.Type, nil
+	return fieldPtr, fieldPtr.Type(), nil
 }
 
 func (ctx *Context) compileSubIdentifier(f *Variable, sub *parser.Identifier) (FieldType types.Type, Pointer value.Value, IsMethod bool, err error) {
@@ -950,6 +1370,15 @@ func (ctx *Context) compileSubIdentifier(f *Variable, sub *parser.Identifier) (F
 			return f.Type, f.Value, true, nil
 		}
 
+		if _, ok := f.Value.Type().(*types.PointerType); !ok {
+			return nil, nil, false, posError(sub.Pos, "Cannot access field %s of non-class value", sub.Name)
+		}
+
+		// Pointer variables live in a stack slot
+		if ptrType, ok := f.Value.Type().(*types.PointerType).ElemType.(*types.PointerType); ok {
+			f = &Variable{Name: f.Name, Type: ptrType, Value: ctx.NewLoad(ptrType, f.Value)}
+		}
+
 		var field *parser.FieldDefinition
 		var nfield int
 		elemtypename := f.Value.Type().(*types.PointerType).ElemType.Name()
@@ -964,10 +1393,22 @@ func (ctx *Context) compileSubIdentifier(f *Variable, sub *parser.Identifier) (F
 			}
 		}
 		if field == nil {
-			return nil, nil, false, posError(sub.Pos, "Field %s not found in struct %s", sub.Name, elemtypename)
+			return ctx.compilePropertyGet(f, elemtypename, sub)
+		}
+		if err := ctx.checkAccess(ctx.fieldOwner(elemtypename, field), field.Name, field.Private, f.Name == "this", sub.Pos); err != nil {
+			return nil, nil, false, err
 		}
 
-		fieldPtr := ctx.NewGetElementPtr(ctx.CFTypeToLLType(field.Type), f.Value, constant.NewInt(types.I32, int64(nfield)))
+		structType := f.Value.Type().(*types.PointerType).ElemType
+		fieldType := ctx.fieldType(elemtypename, field)
+		fieldPtr := ctx.NewGetElementPtr(structType, f.Value, constant.NewInt(types.I32, 0), constant.NewInt(types.I32, int64(nfield)))
+		if className, ok := classOf(fieldType); ok && sub.GEP != nil && ctx.hasOperator(className, "[]") {
+			elem, err := ctx.compileIndexOperator(ctx.NewLoad(fieldType, fieldPtr), sub.GEP, sub.GEP.Pos)
+			if err != nil {
+				return nil, nil, false, err
+			}
+			return ctx.compileSubIdentifier(&Variable{Value: elem, Type: elem.Type()}, sub.Sub)
+		}
 		if sub.GEP != nil {
 			ctx.RequestedType = types.I32
 			gepExpr, err := ctx.compileExpression(sub.GEP)
@@ -976,19 +1417,87 @@ func (ctx *Context) compileSubIdentifier(f *Variable, sub *parser.Identifier) (F
 			}
 			ctx.RequestedType = nil
 
-			// Load the array pointer
-			arrayPtr := ctx.NewLoad(fieldPtr.Type().(*types.PointerType).ElemType, fieldPtr)
-
-			// Get the pointer to the specific element
-			elemPtr := ctx.NewGetElementPtr(arrayPtr.Type().(*types.PointerType).ElemType, arrayPtr, gepExpr)
-
-			return elemPtr.Type().(*types.PointerType).ElemType.(*types.PointerType).ElemType, elemPtr, false, nil
+			var elemPtr value.Value
+			switch t := fieldType.(type) {
+			case *types.ArrayType:
+				// Index into the array stored inline in the struct
+				elemPtr = ctx.NewGetElementPtr(t, fieldPtr, constant.NewInt(types.I32, 0), gepExpr)
+			case *types.PointerType:
+				// Load the array pointer and get the pointer to the specific element
+				arrayPtr := ctx.NewLoad(t, fieldPtr)
+				elemPtr = ctx.NewGetElementPtr(t.ElemType, arrayPtr, gepExpr)
+			default:
+				return nil, nil, false, posError(sub.GEP.Pos, "Field %s of type %s cannot be indexed", sub.Name, fieldType)
+			}
+			return ctx.compileSubIdentifier(&Variable{Value: elemPtr, Type: elemPtr.Type()}, sub.Sub)
 		}
 		return ctx.compileSubIdentifier(&Variable{Value: fieldPtr, Type: fieldPtr.Type()}, sub.Sub)
 	}
 	return f.Type, f.Value, false, nil
 }
 
+// compilePropertyGet reads a property of the object `f` by calling its getter.
+func (ctx *Context) compilePropertyGet(f *Variable, className string, sub *parser.Identifier) (types.Type, value.Value, bool, error) {
+	getter, _, isProperty := ctx.lookupProperty(className, sub.Name)
+	if !isProperty {
+		return nil, nil, false, posError(sub.Pos, "Field %s not found in struct %s", sub.Name, className)
+	}
+	if getter == nil {
+		return nil, nil, false, posError(sub.Pos, "Property %s of class %s is write-only", sub.Name, className)
+	}
+	if err := ctx.checkAccess(className, sub.Name, ctx.PrivateMethods[getter.Name()], f.Name == "this", sub.Pos); err != nil {
+		return nil, nil, false, err
+	}
+
+	var result value.Value = ctx.NewCall(getter, f.Value)
+	if sub.GEP != nil {
+		ptrType, ok := result.Type().(*types.PointerType)
+		if !ok {
+			return nil, nil, false, posError(sub.GEP.Pos, "Property %s of type %s cannot be indexed", sub.Name, result.Type())
+		}
+		ctx.RequestedType = types.I32
+		gepExpr, err := ctx.compileExpression(sub.GEP)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		ctx.RequestedType = nil
+		result = ctx.NewGetElementPtr(ptrType.ElemType, result, gepExpr)
+	}
+	return ctx.compileSubIdentifier(&Variable{Value: result, Type: result.Type()}, sub.Sub)
+}
+
+// lookupField finds the definition of the field `name` of the class `className`.
+func (ctx *Context) lookupField(className string, name string) *parser.FieldDefinition {
+	for _, field := range ctx.Compiler.StructFields[className] {
+		if field.Name == name {
+			return field
+		}
+	}
+	return nil
+}
+
+// fieldType returns the type of the field `field` of the class `className`.
+func (ctx *Context) fieldType(className string, field *parser.FieldDefinition) types.Type {
+	var typ types.Type
+	ctx.Compiler.withTypeArgs(ctx.Compiler.classTypeArgs(className), func() {
+		typ = ctx.CFTypeToLLType(field.Type)
+	})
+	return typ
+}
+
+// lookupProperty finds the accessors of the property `name` of the class `className`.
+func (ctx *Context) lookupProperty(className string, name string) (getter *ir.Func, setter *ir.Func, ok bool) {
+	getter, hasGetter := ctx.lookupFunction(className + ".get." + name)
+	setter, hasSetter := ctx.lookupFunction(className + ".set." + name)
+	if !hasGetter {
+		getter = nil
+	}
+	if !hasSetter {
+		setter = nil
+	}
+	return getter, setter, hasGetter || hasSetter
+}
+
 func (ctx *Context) compileClassMethod(cm *parser.ClassMethod) (value.Value, error) {
 	var methodName string
 	var currentSub *parser.Identifier
@@ -1009,17 +1518,45 @@ func (ctx *Context) compileClassMethod(cm *parser.ClassMethod) (value.Value, err
 		cm.Identifier.Sub = nil
 	}
 
+	if cm.Identifier.Name == "super" && cm.Identifier.Sub == nil {
+		return ctx.compileSuperCall(methodName, cm.Args, cm.Pos)
+	}
+
+	// Static methods are called on the class itself, and union values are built through the union
+	if cm.Identifier.Sub == nil && ctx.lookupVariable(cm.Identifier.Name) == nil {
+		if def, ok := ctx.Compiler.unions[cm.Identifier.Name]; ok {
+			return ctx.compileUnionVariant(def, methodName, cm.Args, cm.Pos)
+		}
+		if _, isClass := ctx.lookupClass(cm.Identifier.Name); isClass {
+			return ctx.compileStaticMethodCall(cm.Identifier.Name, methodName, cm.Args, cm.Pos)
+		}
+	}
+
 	// Compile the class identifier to get the class instance
+	viaThis := cm.Identifier.Name == "this" && cm.Identifier.Sub == nil
 	classInstance, _, err := ctx.compileIdentifier(cm.Identifier, true)
 	if err != nil {
 		return nil, err
 	}
+	classInstance = ctx.slotValue(classInstance)
+
+	// Methods of interface values are looked up in their vtable
+	if obj, in, ok := ctx.interfaceValue(classInstance); ok {
+		return ctx.compileInterfaceCall(obj, in, methodName, cm.Args, cm.Pos)
+	}
+
+	// Fields holding a function are called like methods
+	if result, ok, err := ctx.compileFieldCall(classInstance, methodName, cm.Args, viaThis, cm.Pos); err != nil || ok {
+		return result, err
+	}
 
 	// Then, compile the method call on the class instance
-	return ctx.compileMethodCall(classInstance, methodName, cm.Args)
+	return ctx.compileMethodCall(classInstance, methodName, cm.Args, viaThis, false, cm.Pos)
 }
 
-func (ctx *Context) compileMethodCall(classInstance value.Value, methodName string, arguments *parser.ArgumentList) (value.Value, error) {
+// compileMethodCall calls the method `methodName` on `classInstance`. Virtual
+// methods are called through the instance's vtable, unless `static` is set.
+func (ctx *Context) compileMethodCall(classInstance value.Value, methodName string, arguments *parser.ArgumentList, viaThis bool, static bool, pos lexer.Position) (value.Value, error) {
 	// Lookup the method on the class
 	pointerType, ok := classInstance.Type().(*types.PointerType)
 	if !ok {
@@ -1029,19 +1566,197 @@ func (ctx *Context) compileMethodCall(classInstance value.Value, methodName stri
 	if !exists {
 		return nil, cli.Exit(color.RedString("Error: Method %s not found on type %s", methodName, pointerType.ElemType.Name()), 1)
 	}
+	fn := method.(*ir.Func)
+	className := pointerType.ElemType.Name()
+	owner := strings.TrimSuffix(fn.Name(), "."+methodName)
+	if err := ctx.checkAccess(owner, methodName, ctx.PrivateMethods[fn.Name()], viaThis, pos); err != nil {
+		return nil, err
+	}
+	if ctx.StaticMethods[fn.Name()] {
+		return nil, posError(pos, "Static method %s must be called on the class %s", methodName, owner)
+	}
 
 	// Prepare the arguments for the method call
-	args := []value.Value{classInstance}
-	for _, arg := range arguments.Arguments {
+	callee, this := ctx.methodCallee(classInstance, className, methodName, fn, static)
+	args := []value.Value{this}
+	params := fn.Sig.Params
+	for i, arg := range arguments.Arguments {
+		if i+1 < len(params) {
+			ctx.RequestedType = params[i+1]
+		}
 		compiledArg, err := ctx.compileExpression(arg)
+		ctx.RequestedType = nil
 		if err != nil {
 			return nil, err
 		}
+		if i+1 < len(params) {
+			if compiledArg, err = ctx.convertArgument(compiledArg, params[i+1], i, arg.Pos); err != nil {
+				return nil, err
+			}
+		}
 		args = append(args, compiledArg)
 	}
 
 	// Call the method
-	return ctx.Block.NewCall(method, args...), nil
+	return ctx.Block.NewCall(callee, args...), nil
+}
+
+func (ctx *Context) compileStaticMethodCall(className string, methodName string, arguments *parser.ArgumentList, pos lexer.Position) (value.Value, error) {
+	method, exists := ctx.lookupFunction(className + "." + methodName)
+	if !exists {
+		return nil, posError(pos, "Method %s not found on class %s", methodName, className)
+	}
+	if !ctx.StaticMethods[className+"."+methodName] {
+		return nil, posError(pos, "Method %s of class %s is not static", methodName, className)
+	}
+	if err := ctx.checkAccess(className, methodName, ctx.PrivateMethods[className+"."+methodName], true, pos); err != nil {
+		return nil, err
+	}
+
+	args := []value.Value{}
+	for i, arg := range arguments.Arguments {
+		if i < len(method.Sig.Params) {
+			ctx.RequestedType = method.Sig.Params[i]
+		}
+		compiledArg, err := ctx.compileExpression(arg)
+		if err != nil {
+			return nil, err
+		}
+		ctx.RequestedType = nil
+		if i < len(method.Sig.Params) {
+			if compiledArg, err = ctx.convertArgument(compiledArg, method.Sig.Params[i], i, arg.Pos); err != nil {
+				return nil, err
+			}
+		}
+		args = append(args, compiledArg)
+	}
+
+	return ctx.NewCall(method, args...), nil
+}
+
+// lookupStaticField finds the global holding the static field `field` of the class `className`.
+func (ctx *Context) lookupStaticField(className string, field string, pos lexer.Position) (*Variable, error) {
+	def, ok := ctx.StaticFields[className+"."+field]
+	if !ok {
+		return nil, nil
+	}
+	if err := ctx.checkAccess(className, field, def.Private, true, pos); err != nil {
+		return nil, err
+	}
+	return ctx.staticGlobals[className+"."+field], nil
+}
+
+// checkAccess makes sure private members are only used through `this` inside the class's own methods.
+func (ctx *Context) checkAccess(className string, member string, private bool, viaThis bool, pos lexer.Position) error {
+	if !private || (viaThis && ctx.className == className) {
+		return nil
+	}
+	return posError(pos, "%s is a private member of class %s", member, className)
+}
+
+// compileOperatorOverload calls the method overloading `op` when `left` is a class instance.
+// If the operator isn't overloaded, overloaded is false and the operator should be compiled normally.
+func (ctx *Context) compileOperatorOverload(left value.Value, op string, pos lexer.Position, operands ...value.Value) (result value.Value, overloaded bool, err error) {
+	className, ok := classOf(left.Type())
+	if !ok {
+		return nil, false, nil
+	}
+
+	method, args, ok := ctx.lookupOperator(className, op, operands)
+	if !ok {
+		if op == "==" || op == "!=" {
+			// Instances are compared by address unless the class says otherwise
+			return nil, false, nil
+		}
+		if len(operands) == 0 {
+			return nil, false, posError(pos, "Class %s does not overload the unary operator %s", className, op)
+		}
+		var operandTypes []string
+		for _, operand := range operands {
+			operandTypes = append(operandTypes, operand.Type().String())
+		}
+		return nil, false, posError(pos, "Class %s does not overload the operator %s for operands of type %s", className, op, strings.Join(operandTypes, ", "))
+	}
+	if err := ctx.checkAccess(className, "op "+op, ctx.PrivateMethods[method.Name()], true, pos); err != nil {
+		return nil, false, err
+	}
+
+	return ctx.NewCall(method, append([]value.Value{left}, args...)...), true, nil
+}
+
+// indexableClass returns the class instance stored in `v` if its class overloads
+// the index operator `op`.
+func (ctx *Context) indexableClass(v value.Value, op string) (string, value.Value, bool) {
+	// Pointer variables live in a stack slot
+	if ptrType, ok := v.Type().(*types.PointerType); ok && isStorage(v) {
+		if elemType, ok := ptrType.ElemType.(*types.PointerType); ok {
+			if className, ok := classOf(elemType); ok && ctx.hasOperator(className, op) {
+				return className, ctx.NewLoad(elemType, v), true
+			}
+			return "", nil, false
+		}
+	}
+	if className, ok := classOf(v.Type()); ok && ctx.hasOperator(className, op) {
+		return className, v, true
+	}
+	return "", nil, false
+}
+
+// compileIndexOperator indexes the class instance `obj` through its `[]` operator.
+func (ctx *Context) compileIndexOperator(obj value.Value, index *parser.Expression, pos lexer.Position) (value.Value, error) {
+	idx, err := ctx.compileExpression(index)
+	if err != nil {
+		return nil, err
+	}
+	result, _, err := ctx.compileOperatorOverload(obj, "[]", pos, idx)
+	return result, err
+}
+
+// hasOperator reports whether the class `className` overloads the operator `op`.
+func (ctx *Context) hasOperator(className string, op string) bool {
+	prefix := operatorPrefix(className, op)
+	for _, f := range ctx.Module.Funcs {
+		if f.Name() == prefix || strings.HasPrefix(f.Name(), prefix+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupOperator finds the overload of the operator `op` of the class `className` that
+// accepts `operands`. Constant operands are converted to the parameter types if no
+// overload matches them exactly, so literals work with any overload.
+func (ctx *Context) lookupOperator(className string, op string, operands []value.Value) (*ir.Func, []value.Value, bool) {
+	prefix := operatorPrefix(className, op)
+	name := prefix
+	for _, operand := range operands {
+		name += "." + ctx.mangleType(operand.Type())
+	}
+	if method, ok := ctx.lookupFunction(name); ok {
+		return method, operands, true
+	}
+
+	for _, f := range ctx.Module.Funcs {
+		if f.Name() != prefix && !strings.HasPrefix(f.Name(), prefix+".") {
+			continue
+		}
+		if len(f.Sig.Params) != len(operands)+1 {
+			continue
+		}
+		converted := make([]value.Value, len(operands))
+		for i, operand := range operands {
+			converted[i] = ctx.convertConstant(operand, f.Sig.Params[i+1])
+			if converted[i] == nil {
+				converted = nil
+				break
+			}
+		}
+		if converted != nil {
+			return f, converted, true
+		}
+	}
+
+	return nil, nil, false
 }
 
 func (ctx *Context) lookupMethod(parentType types.Type, methodName string) (value.Value, bool) {
@@ -1061,8 +1776,7 @@ func (ctx *Context) lookupMethod(parentType types.Type, methodName string) (valu
 		return nil, false
 	}
 
-	// Check if methodName is a method of the struct
-	methodKey := fmt.Sprintf("%s.%s", structName, methodName)
-	method, exists := ctx.SymbolTable[methodKey]
+	// Check if methodName is a method of the struct or one of its ancestors
+	method, exists := ctx.lookupClassMethod(structName, methodName)
 	return method, exists
 }
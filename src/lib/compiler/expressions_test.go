@@ -0,0 +1,439 @@
+package compiler
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStringLiterals(t *testing.T) {
+	expectIR(t, `
+func main(): i32 {
+	printf("hi\n");
+	return 0;
+}
+`, "call i32 (i8*, ...) @printf(i8* getelementptr ([4 x i8], [4 x i8]* @0, i64 0, i64 0))")
+}
+
+func TestArrays(t *testing.T) {
+	expectOutput(t, `
+class Box {
+	items: [3]i64;
+	func constructor() { this.items = [7, 8, 9]; }
+}
+var g: [3]i64 = [4, 5, 6];
+func sum(a: [3]i64): i64 {
+	a[0] = 100;
+	return a[0] + a[1] + a[2];
+}
+func main(): i32 {
+	var n: i64 = 10;
+	var a: [3]i64 = [1, 2, n];
+	var b: [3]i64 = a;
+	b[0] = 50;
+	printf("%ld %ld %ld\n", a[0], b[0], a[2]);
+	printf("sum=%ld a0=%ld\n", sum(a), a[0]);
+	var bx: *Box = new Box();
+	bx.items[1] = 80;
+	printf("box %ld %ld\n", bx.items[0], bx.items[1]);
+	g[2] = 60;
+	var i: i64 = 2;
+	printf("g %ld %ld dyn %ld\n", g[0], g[2], a[i]);
+	return 0;
+}
+`, "1 50 10\nsum=112 a0=1\nbox 7 80\ng 4 60 dyn 10\n")
+	expectError(t, `
+func main(): i32 {
+	var a: [2]i64 = [1, 2, 3];
+	return 0;
+}
+`, "Array literal has 3 elements, expected 2")
+}
+
+func TestPrivateMembers(t *testing.T) {
+	expectOutput(t, `
+class Counter {
+	private count: i64;
+	func constructor() { this.count = 0; }
+	private func bump() { this.count = this.count + 1; }
+	func inc(): i64 {
+		this.bump();
+		return this.count;
+	}
+}
+func main(): i32 {
+	var c: *Counter = new Counter();
+	c.inc();
+	printf("%ld\n", c.inc());
+	return 0;
+}
+`, "2\n")
+	expectError(t, `
+class C { private x: i64; }
+func main(): i32 {
+	var c: *C = new C();
+	c.x = 1;
+	return 0;
+}
+`, "x is a private member of class C")
+	expectError(t, `
+class C { private func f() {} }
+func main(): i32 {
+	var c: *C = new C();
+	c.f();
+	return 0;
+}
+`, "f is a private member of class C")
+}
+
+func TestStaticMembers(t *testing.T) {
+	expectOutput(t, `
+class Counter {
+	static count: i64;
+	value: i64;
+	func constructor(v: i64) {
+		this.value = v;
+		Counter.count = Counter.count + 1;
+	}
+	static func total(): i64 { return Counter.count; }
+}
+func main(): i32 {
+	var a: *Counter = new Counter(3);
+	var b: *Counter = new Counter(4);
+	printf("count=%ld a=%ld b=%ld\n", Counter.total(), a.value, b.value);
+	return 0;
+}
+`, "count=2 a=3 b=4\n")
+	expectError(t, `
+class C { func f() {} }
+func main(): i32 {
+	C.f();
+	return 0;
+}
+`, "Method f of class C is not static")
+	expectIR(t, `
+class C { static count: i64; }
+export class D { static count: i64; }
+func main(): i32 { return (C.count + D.count): i32; }
+`, "@C.count = internal global i64 zeroinitializer", "@D.count = global i64 zeroinitializer")
+}
+
+func TestProperties(t *testing.T) {
+	expectOutput(t, `
+class Temp {
+	celsius: f64;
+	private hidden: i64;
+	func constructor(c: f64) { this.celsius = c; this.hidden = 7; }
+	func get fahrenheit(): f64 { return this.celsius + 10.0; }
+	func set fahrenheit(f: f64) { this.celsius = f - 10.0; }
+	func get counter(): i64 { return this.hidden; }
+	func set counter(v: i64) { this.hidden = v; }
+}
+func main(): i32 {
+	var t: *Temp = new Temp(100.0);
+	printf("%.1f\n", t.fahrenheit);
+	t.fahrenheit = 32.0;
+	printf("%.1f\n", t.celsius);
+	t.counter += 5;
+	printf("%ld\n", t.counter);
+	return 0;
+}
+`, "110.0\n22.0\n12\n")
+	expectError(t, `
+class T {
+	v: i64;
+	func get ro(): i64 { return this.v; }
+}
+func main(): i32 {
+	var t: *T = new T();
+	t.ro = 1;
+	return 0;
+}
+`, "Property ro of class T is read-only")
+}
+
+func TestOperatorOverloading(t *testing.T) {
+	expectOutput(t, `
+class V {
+	x: i64;
+	func constructor(x: i64) { this.x = x; }
+	func op "+"(o: *V): i64 { return this.x + o.x; }
+	func op "*"(k: i64): i64 { return this.x * k; }
+	func op "*"(o: *V): i64 { return this.x * o.x; }
+	func op "<"(o: *V): i1 { return this.x < o.x; }
+	func op "-"(): i64 { return 0 - this.x; }
+	func op "[]"(i: i64): i64 { return this.x + i; }
+	func op "[]="(i: i64, v: i64) { this.x = v * 100 + i; }
+}
+func main(): i32 {
+	var a: *V = new V(3);
+	var b: *V = new V(4);
+	var c: i64 = a + b;
+	var d: i64 = a * b;
+	var k: i64 = b * 2;
+	var e: i64 = -a;
+	printf("c=%ld d=%ld k=%ld lt=%d neg=%ld idx=%ld\n", c, d, k, a < b, e, a[10]);
+	a[2] = 7;
+	printf("a=%ld\n", a.x);
+	return 0;
+}
+`, "c=7 d=12 k=8 lt=1 neg=-3 idx=13\na=702\n")
+	expectError(t, `
+class V { x: i64; }
+func main(): i32 {
+	var a: *V = new V();
+	var b: i64 = a + a;
+	return 0;
+}
+`, "Class V does not overload the operator +")
+}
+
+func TestImportedMethods(t *testing.T) {
+	lib := `package counter;
+export class C {
+	x: i64;
+	func value(): i64 { return this.x; }
+	static func zero(): i64 { return 0; }
+}
+`
+	for _, imp := range []string{`import "./counter.cffc";`, `from "./counter.cffc" import { C };`} {
+		module, err := compileFiles(t, map[string]string{
+			"counter.cffc": lib,
+			"main.cffc": prelude + imp + `
+func main(): i32 {
+	var c: *C = new C();
+	return (c.value() + C.zero()): i32;
+}
+`,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, f := range []string{"declare i64 @C.value(%C* %this)", "declare i64 @C.zero()", "call i64 @C.value(%C* "} {
+			if !strings.Contains(module, f) {
+				t.Errorf("IR doesn't contain %q:\n%s", f, module)
+			}
+		}
+	}
+}
+
+func TestImportedStaticMembers(t *testing.T) {
+	module, err := compileFiles(t, map[string]string{
+		"counter.cffc": `package counter;
+export class Foo {
+	static count: i64;
+	static func make(): i64 { return Foo.count + 1; }
+}
+`,
+		"main.cffc": prelude + `from "./counter.cffc" import { Foo as Bar };
+func main(): i32 {
+	Bar.count = 2;
+	return (Bar.count + Bar.make()): i32;
+}
+`,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, f := range []string{"@Foo.count = external global i64", "store i64 2, i64* @Foo.count", "call i64 @Foo.make()"} {
+		if !strings.Contains(module, f) {
+			t.Errorf("IR doesn't contain %q:\n%s", f, module)
+		}
+	}
+}
+
+func TestShortCircuit(t *testing.T) {
+	expectOutput(t, `
+class P { x: i64; func constructor(x: i64) { this.x = x; } }
+func t(n: i64): i1 { printf("t%ld ", n); return true; }
+func f(n: i64): i1 { printf("f%ld ", n); return false; }
+func main(): i32 {
+	var p: *P = null;
+	if (p != null && p.x > 0) { printf("bad\n"); } else { printf("null ok\n"); }
+	var r: i1 = f(1) && t(2) || t(3) && f(4) || t(5);
+	printf("=> %d\n", r);
+	var r2: i1 = t(1) or f(2) and t(3);
+	printf("=> %d\n", r2);
+	return 0;
+}
+`, "null ok\nf1 t3 f4 t5 => 1\nt1 => 1\n")
+	expectError(t, `
+func main(): i32 {
+	var x: i64 = 1;
+	if (x && 2.5) {}
+	return 0;
+}
+`, "logical and operator requires boolean operands")
+}
+
+func TestUnsigned(t *testing.T) {
+	expectOutput(t, `
+func main(): i32 {
+	var a: u32 = 4000000000;
+	var b: u32 = 3;
+	var c: i32 = -8;
+	printf("%u %u %u %d\n", a / b, a % b, a >> 1, c >> 1);
+	if (a > b) { printf("gt ok\n"); }
+	var d: u64 = (a): u64;
+	printf("%lu %.1f\n", d, (a): f64);
+	return 0;
+}
+`, "1333333333 1 2000000000 -4\ngt ok\n4000000000 4000000000.0\n")
+	expectError(t, `
+func main(): i32 {
+	var a: u32 = 1;
+	var b: i32 = -1;
+	if (a < b) {}
+	return 0;
+}
+`, "Cannot mix u32 and i32 operands without a cast")
+}
+
+func TestUnsignedConcurrently(t *testing.T) {
+	// Each compiler has its own unsigned types, so compilers can run at the same time
+	const src = `
+func main(): i32 {
+	var a: u32 = 7;
+	var b: u16 = 2;
+	var c: u64 = (a / (b): u32): u64;
+	return (c): i32;
+}
+`
+	expectIRConcurrently(t, src, "udiv i32")
+}
+
+func TestConversions(t *testing.T) {
+	expectOutput(t, `
+func main(): i32 {
+	var x: i16 = 5;
+	var y: i64 = 7;
+	var z: f64 = y + 0.5;
+	var g: f64 = 3.9;
+	printf("%ld %.1f %d %u\n", x + y, z, (g): i32, (g): u8);
+	var p: *i8 = "hi";
+	var pi: i64 = (p): i64;
+	var q: *i8 = (pi): *i8;
+	var h: f16 = (g): f16;
+	printf("%s %.1f\n", q, (h): f64);
+	return 0;
+}
+`, "12 7.5 3 3\nhi 3.9\n")
+	expectError(t, `
+class C { x: i64; }
+func main(): i32 {
+	var c = new C();
+	var f: f64 = (c): f64;
+	return 0;
+}
+`, "Cannot cast *C to f64")
+}
+
+func TestArgumentConversions(t *testing.T) {
+	expectOutput(t, `
+class Box {
+	v: f64;
+	func put(v: f64) { this.v = v; }
+	static func wide(v: i64): i64 { return v; }
+}
+func take(v: f64) { printf("%.1f\n", v); }
+func main(): i32 {
+	var b: *Box = new Box();
+	var x: i32 = 2;
+	take(x);
+	b.put(x);
+	printf("%.1f %ld\n", b.v, Box.wide(x));
+	return 0;
+}
+`, "2.0\n2.0 2\n")
+	expectError(t, `
+class Box { func put(v: f64) {} }
+func main(): i32 {
+	var b = new Box();
+	b.put(b);
+	return 0;
+}
+`, "Cannot pass a value of type *Box as argument 1 of type f64")
+}
+
+func TestOperatorMangling(t *testing.T) {
+	expectIR(t, `
+class V {
+	x: i64;
+	func op "+"(o: *V): *V { return this; }
+	func op "*"(k: u32): i64 { return 1; }
+	func op "*"(k: i32): i64 { return 2; }
+	func op "[]="(i: i64, v: i64) {}
+}
+func main(): i32 {
+	var a = new V();
+	var k: u32 = 3;
+	var b = a + a;
+	return (a * k): i32;
+}
+`, "define %V* @V.op.add.V_ptr(", "@V.op.mul.u32(", "@V.op.mul.i32(", "@V.op.setindex.i64.i64(", "call i64 @V.op.mul.u32(")
+	expectHeader(t, `
+class V {
+	x: i64;
+	func op "+"(o: *V): *V { return this; }
+	func op "[]="(i: i64, v: i64) {}
+	func get double(): i64 { return this.x * 2; }
+}
+func main(): i32 { return 0; }
+`, []string{"V * operator+(V * o);", "long long get_double();"}, []string{"setindex", ".op"})
+}
+
+func TestImportedOperators(t *testing.T) {
+	lib := `package vec;
+export class V {
+	x: i64;
+	func op "+"(o: *V): *V { return this; }
+	func op "*"(k: u32): i64 { return 1; }
+}
+`
+	for _, imp := range []string{`import "./vec.cffc";`, `from "./vec.cffc" import { V };`} {
+		module, err := compileFiles(t, map[string]string{
+			"vec.cffc": lib,
+			"main.cffc": prelude + imp + `
+func main(): i32 {
+	var a = new V();
+	var k: u32 = 3;
+	var b = a + a;
+	return (a * k): i32;
+}
+`,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, f := range []string{"call %V* @V.op.add.V_ptr(", "call i64 @V.op.mul.u32("} {
+			if !strings.Contains(module, f) {
+				t.Errorf("IR doesn't contain %q:\n%s", f, module)
+			}
+		}
+	}
+}
+
+func TestOverloadedComparisonWithNull(t *testing.T) {
+	// Comparing with null checks the address instead of calling the overload
+	src := `
+class V {
+	x: i64;
+	func constructor(x: i64) { this.x = x; }
+	func op "=="(o: *V): i1 { return this.x == o.x; }
+	func op "!="(o: *V): i1 { return this.x != o.x; }
+	func op "<"(o: *V): i1 { return this.x < o.x; }
+}
+func main(): i32 {
+	var p: *V = null;
+	if (p != null && p.x > 0) { printf("bad\n"); } else { printf("null ok\n"); }
+	var q: *V = new V(2);
+	var r: *V = new V(2);
+	printf("%d %d %d %d %d\n", q == r, q != null, null == p, p == null, q < null);
+	return 0;
+}
+`
+	module := expectIR(t, src, "icmp ne %V* %", "icmp eq %V* null, %", "icmp ult %V* %")
+	if strings.Count(module, "call i1 @V.op.") != 1 {
+		t.Errorf("expected only q == r to call an overload:\n%s", module)
+	}
+	expectOutput(t, src, "null ok\n1 1 1 1 0\n")
+}
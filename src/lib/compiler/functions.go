@@ -0,0 +1,131 @@
+package compiler
+
+import (
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+	"github.com/vyPal/CaffeineC/lib/parser"
+)
+
+// A function type like `func(i64, *i8): i32` is a pointer to an LLVM
+// function, so CaffeineC functions can be stored in variables and fields and
+// handed to C as callbacks. Naming a function without calling it gives its address.
+// A closure type like `closure(i64): i64` is the fat pointer described in closures.go.
+
+// funcValueType returns the LLVM type of a function or closure value of type `f`.
+func (ctx *Context) funcValueType(f *parser.FuncType) types.Type {
+	var retType types.Type = types.Void
+	if f.ReturnType != nil {
+		retType = ctx.CFTypeToLLType(f.ReturnType)
+	}
+	params := make([]types.Type, len(f.Parameters))
+	for i, param := range f.Parameters {
+		params[i] = ctx.CFTypeToLLType(param)
+	}
+	sig := types.NewFunc(retType, params...)
+	sig.Variadic = f.Variadic
+	if f.Closure {
+		return ctx.closureType(sig)
+	}
+	return types.NewPointer(sig)
+}
+
+// funcTypeString formats `sig` the way it is written in CaffeineC, starting with `keyword`.
+func (ctx *Context) funcTypeString(keyword string, sig *types.FuncType) string {
+	var params []string
+	for _, param := range sig.Params {
+		params = append(params, ctx.TypeToString(param))
+	}
+	if sig.Variadic {
+		params = append(params, "...")
+	}
+	str := keyword + "(" + strings.Join(params, ", ") + ")"
+	if !sig.RetType.Equal(types.Void) {
+		str += ": " + ctx.TypeToString(sig.RetType)
+	}
+	return str
+}
+
+// isFuncPointer reports whether `t` is a pointer to a function.
+func isFuncPointer(t types.Type) bool {
+	if ptrType, ok := t.(*types.PointerType); ok {
+		_, ok := ptrType.ElemType.(*types.FuncType)
+		return ok
+	}
+	return false
+}
+
+// isCallable reports whether values of type `t` can be called.
+func (c *Compiler) isCallable(t types.Type) bool {
+	_, isClosure := c.closureSignature(t)
+	return isFuncPointer(t) || isClosure
+}
+
+// compileIndirectCall calls the function or closure `callee`.
+func (ctx *Context) compileIndirectCall(callee value.Value, name string, arguments *parser.ArgumentList, pos lexer.Position) (value.Value, error) {
+	calleeType := ctx.TypeToString(callee.Type())
+	var sig *types.FuncType
+	var args []value.Value
+	if closureSig, ok := ctx.closureSignature(callee.Type()); ok {
+		// The function takes the closure's environment before its own arguments
+		sig = closureSig
+		args = append(args, ctx.NewExtractValue(callee, 1))
+		callee = ctx.NewExtractValue(callee, 0)
+	} else {
+		sig = callee.Type().(*types.PointerType).ElemType.(*types.FuncType)
+	}
+	if len(arguments.Arguments) < len(sig.Params) || (!sig.Variadic && len(arguments.Arguments) > len(sig.Params)) {
+		return nil, posError(pos, "%s of type %s takes %d arguments but %d were given", name, calleeType, len(sig.Params), len(arguments.Arguments))
+	}
+
+	for i, arg := range arguments.Arguments {
+		var paramType types.Type
+		if i < len(sig.Params) {
+			paramType = sig.Params[i]
+		}
+		ctx.RequestedType = paramType
+		compiled, err := ctx.compileExpression(arg)
+		ctx.RequestedType = nil
+		if err != nil {
+			return nil, err
+		}
+		if paramType != nil {
+			converted, ok := ctx.convertValue(compiled, paramType)
+			if !ok {
+				return nil, posError(arg.Pos, "Cannot pass a value of type %s as argument %d of type %s", ctx.TypeToString(compiled.Type()), i+1, ctx.TypeToString(paramType))
+			}
+			compiled = converted
+		}
+		args = append(args, compiled)
+	}
+	return ctx.NewCall(callee, args...), nil
+}
+
+// compileFieldCall calls the function stored in the field `name` of `obj`.
+// It reports false if the class has no such field.
+func (ctx *Context) compileFieldCall(obj value.Value, name string, arguments *parser.ArgumentList, viaThis bool, pos lexer.Position) (value.Value, bool, error) {
+	className, ok := classOf(obj.Type())
+	if !ok || ctx.lookupField(className, name) == nil {
+		return nil, false, nil
+	}
+	if _, isMethod := ctx.lookupMethod(obj.Type(), name); isMethod {
+		return nil, false, nil
+	}
+
+	objName := ""
+	if viaThis {
+		objName = "this"
+	}
+	_, fieldPtr, _, err := ctx.compileSubIdentifier(&Variable{Name: objName, Type: obj.Type(), Value: obj}, &parser.Identifier{Pos: pos, Name: name})
+	if err != nil {
+		return nil, false, err
+	}
+	callee := ctx.NewLoad(fieldPtr.Type().(*types.PointerType).ElemType, fieldPtr)
+	if !ctx.isCallable(callee.Type()) {
+		return nil, false, posError(pos, "Field %s of type %s is not a function", name, ctx.TypeToString(callee.Type()))
+	}
+	result, err := ctx.compileIndirectCall(callee, name, arguments, pos)
+	return result, true, err
+}
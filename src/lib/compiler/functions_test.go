@@ -0,0 +1,34 @@
+package compiler
+
+import "testing"
+
+func TestFunctionPointers(t *testing.T) {
+	expectOutput(t, `
+extern func qsort(base: *i64, n: i64, size: i64, cmp: func(*i64, *i64): i32);
+class H { cb: func(i64): i64; }
+func cmp(a: *i64, b: *i64): i32 {
+	if (*a < *b) { return -1; }
+	if (*a > *b) { return 1; }
+	return 0;
+}
+func dbl(x: i64): i64 { return x * 2; }
+func apply(f: func(i64): i64, v: i64): i64 { return f(v); }
+func main(): i32 {
+	var arr: [4]i64 = [3, 1, 4, 2];
+	qsort(&arr[0], 4, 8, cmp);
+	printf("%ld %ld %ld %ld\n", arr[0], arr[1], arr[2], arr[3]);
+	var f: func(i64): i64 = dbl;
+	var h = new H();
+	h.cb = dbl;
+	printf("%ld %ld %ld\n", f(5), apply(dbl, 7), h.cb(11));
+	return 0;
+}
+`, "1 2 3 4\n10 14 22\n")
+	expectError(t, `
+func d(x: i64): i64 { return x; }
+func main(): i32 {
+	var f: func(f64): i64 = d;
+	return 0;
+}
+`, "Cannot initialize f of type func(f64): i64 with a value of type func(i64): i64")
+}
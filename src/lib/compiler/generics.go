@@ -0,0 +1,403 @@
+package compiler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/fatih/color"
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/enum"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+	"github.com/urfave/cli/v2"
+	"github.com/vyPal/CaffeineC/lib/parser"
+)
+
+// Generic classes and functions are monomorphized: every set of type
+// arguments gets its own copy, named after them like `List<i64>` and
+// `max<f64>`. An instance is declared as soon as it is used, and its bodies
+// are compiled once the rest of the module is, with the type parameters bound
+// to the arguments. Instances are internal to the module that uses them.
+
+// instance is a generic class or function instantiated with some type arguments.
+type instance struct {
+	Name     string
+	TypeArgs []types.Type
+	Bindings map[string]types.Type
+	Pos      lexer.Position
+	compile  func(ctx *Context) error
+}
+
+// registerGeneric remembers the generic class or function defined by `s`
+// under `alias`, or under its own name if `alias` is empty. It reports false
+// if `s` isn't generic.
+func (c *Compiler) registerGeneric(s *parser.Statement, alias string) bool {
+	name := genericName(s)
+	if name == "" {
+		return false
+	} else if alias == "" {
+		alias = name
+	}
+	if s.ClassDefinition != nil {
+		c.genericClasses[alias] = s.ClassDefinition
+	} else {
+		c.genericFuncs[alias] = s.FunctionDefinition
+	}
+	return true
+}
+
+// genericName returns the name of the generic class or function defined by `s`,
+// or an empty string if `s` doesn't define one.
+func genericName(s *parser.Statement) string {
+	if s.ClassDefinition != nil && len(s.ClassDefinition.TypeParams) > 0 {
+		return s.ClassDefinition.Name
+	} else if s.FunctionDefinition != nil && len(s.FunctionDefinition.TypeParams) > 0 {
+		return s.FunctionDefinition.Name.Name
+	}
+	return ""
+}
+
+// lookupTypeParam returns the type bound to the type parameter `name` in the instance being compiled.
+func (ctx *Context) lookupTypeParam(name string) (types.Type, bool) {
+	t, ok := ctx.Compiler.typeArgs[name]
+	return t, ok
+}
+
+// instanceName returns the name of the instance of `name` with the type arguments `args`.
+func (ctx *Context) instanceName(name string, args []types.Type) string {
+	names := make([]string, len(args))
+	for i, arg := range args {
+		names[i] = ctx.TypeToString(arg)
+	}
+	return name + "<" + strings.Join(names, ", ") + ">"
+}
+
+// bindTypeParams pairs the type parameters of a generic with its type arguments.
+func bindTypeParams(name string, params []string, args []types.Type, pos lexer.Position) (map[string]types.Type, error) {
+	if len(params) != len(args) {
+		return nil, posError(pos, "%s takes %d type arguments but %d were given", name, len(params), len(args))
+	}
+	bindings := make(map[string]types.Type, len(params))
+	for i, param := range params {
+		bindings[param] = args[i]
+	}
+	return bindings, nil
+}
+
+// instantiateClass returns the type of the generic class `name` instantiated with `args`.
+func (ctx *Context) instantiateClass(name string, args []types.Type, pos lexer.Position) (*types.StructType, error) {
+	def, ok := ctx.Compiler.genericClasses[name]
+	if !ok {
+		return nil, posError(pos, "Class %s is not generic", name)
+	}
+	instName := ctx.instanceName(name, args)
+	if t, ok := ctx.lookupClass(instName); ok {
+		return t.(*types.StructType), nil
+	}
+	bindings, err := bindTypeParams(name, def.TypeParams, args, pos)
+	if err != nil {
+		return nil, err
+	}
+
+	inst := *def
+	inst.Name = instName
+	inst.TypeParams = nil
+
+	root := ctx.Compiler.Context
+	var classType *types.StructType
+	ctx.Compiler.withTypeArgs(bindings, func() {
+		classType = root.declareClass(&inst)
+		root.declareClassMembers(&inst)
+	})
+	ctx.Compiler.queueInstance(&instance{
+		Name:     instName,
+		TypeArgs: args,
+		Bindings: bindings,
+		Pos:      pos,
+		compile: func(ctx *Context) error {
+			_, _, _, err := ctx.compileClassDefinition(&inst)
+			return err
+		},
+	})
+	return classType, nil
+}
+
+// instantiateFunction returns the generic function `def` instantiated with `args`.
+func (ctx *Context) instantiateFunction(def *parser.FunctionDefinition, args []types.Type, pos lexer.Position) (*ir.Func, error) {
+	instName := ctx.instanceName(def.Name.Name, args)
+	if fn, ok := ctx.SymbolTable[instName].(*ir.Func); ok {
+		return fn, nil
+	}
+	bindings, err := bindTypeParams(def.Name.Name, def.TypeParams, args, pos)
+	if err != nil {
+		return nil, err
+	}
+
+	inst := *def
+	inst.Name.Name = instName
+	inst.TypeParams = nil
+
+	var fn *ir.Func
+	ctx.Compiler.withTypeArgs(bindings, func() {
+		fn = ctx.Compiler.Context.declareFunction(&inst)
+	})
+	fn.Linkage = enum.LinkageInternal
+	ctx.Compiler.queueInstance(&instance{
+		Name:     instName,
+		TypeArgs: args,
+		Bindings: bindings,
+		Pos:      pos,
+		compile: func(ctx *Context) error {
+			_, _, _, err := ctx.compileFunctionDefinition(&inst)
+			return err
+		},
+	})
+	return fn, nil
+}
+
+// classTypeArgs returns the type parameters bound in the class `className`,
+// or the ones currently bound if it isn't an instance of a generic class.
+func (c *Compiler) classTypeArgs(className string) map[string]types.Type {
+	if inst, ok := c.instances[className]; ok {
+		return inst.Bindings
+	}
+	return c.typeArgs
+}
+
+// withTypeArgs runs `f` with the type parameters bound to `bindings`.
+func (c *Compiler) withTypeArgs(bindings map[string]types.Type, f func()) {
+	saved := c.typeArgs
+	c.typeArgs = bindings
+	defer func() { c.typeArgs = saved }()
+	f()
+}
+
+func (c *Compiler) queueInstance(inst *instance) {
+	c.instances[inst.Name] = inst
+	c.pendingInstances = append(c.pendingInstances, inst)
+}
+
+// compileInstances compiles the bodies of the instances used by the module,
+// including the ones only used by other instances.
+func (c *Compiler) compileInstances() error {
+	for len(c.pendingInstances) > 0 {
+		inst := c.pendingInstances[0]
+		c.pendingInstances = c.pendingInstances[1:]
+
+		var err error
+		c.withTypeArgs(inst.Bindings, func() {
+			err = inst.compile(c.Context)
+		})
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("%s\n%s", err.Error(), color.RedString("  in %s instantiated at %s:%d:%d", inst.Name, inst.Pos.Filename, inst.Pos.Line, inst.Pos.Column)), 1)
+		}
+
+		// Every module using an instance has its own copy
+		for _, fn := range c.Module.Funcs {
+			if fn.Name() == inst.Name || strings.HasPrefix(fn.Name(), inst.Name+".") {
+				fn.Linkage = enum.LinkageInternal
+			}
+		}
+	}
+	return nil
+}
+
+// inferTypeArgs infers the type arguments of a generic from the values passed
+// for its parameters. Constants only decide a type parameter that no other
+// value does, so `max(x, 1)` takes the type of `x`.
+func (ctx *Context) inferTypeArgs(name string, typeParams []string, params []*parser.ArgumentDefinition, args []value.Value, pos lexer.Position) ([]types.Type, error) {
+	if len(args) != len(params) {
+		return nil, posError(pos, "%s takes %d arguments but %d were given", name, len(params), len(args))
+	}
+	bindings := map[string]types.Type{}
+	for _, constants := range []bool{false, true} {
+		for i, param := range params {
+			if _, isConstant := args[i].(constant.Constant); isConstant != constants {
+				continue
+			}
+			if !ctx.unifyType(param.Type, args[i].Type(), typeParams, bindings) && !constants {
+				return nil, posError(pos, "Argument %d of %s has type %s, which doesn't match %s", i+1, name, ctx.TypeToString(args[i].Type()), typeString(param.Type))
+			}
+		}
+	}
+
+	inferred := make([]types.Type, len(typeParams))
+	for i, param := range typeParams {
+		t, ok := bindings[param]
+		if !ok {
+			return nil, posError(pos, "Cannot infer the type parameter %s of %s", param, name)
+		}
+		inferred[i] = t
+	}
+	return inferred, nil
+}
+
+// unifyType binds the type parameters in `t` so that it matches `actual`.
+// It reports false if they don't match.
+func (ctx *Context) unifyType(t *parser.Type, actual types.Type, typeParams []string, bindings map[string]types.Type) bool {
+	if t.Array != nil {
+		arrType, ok := actual.(*types.ArrayType)
+		if !ok {
+			return false
+		}
+		actual = arrType.ElemType
+	}
+	for i := 0; i < strings.Count(t.Ptr, "*"); i++ {
+		ptrType, ok := actual.(*types.PointerType)
+		if !ok {
+			return false
+		}
+		actual = ptrType.ElemType
+	}
+
+	if t.Inner != nil {
+		return ctx.unifyType(t.Inner, actual, typeParams, bindings)
+	}
+	for _, param := range typeParams {
+		if t.Name != param || t.Func != nil || len(t.TypeArgs) > 0 {
+			continue
+		}
+		if bound, ok := bindings[param]; ok {
+			return bound.Equal(actual) && ctx.isUnsigned(bound) == ctx.isUnsigned(actual)
+		}
+		bindings[param] = actual
+		return true
+	}
+	if len(t.TypeArgs) > 0 {
+		// The arguments of a generic class are those of the instance `actual` is
+		structType, ok := actual.(*types.StructType)
+		if !ok {
+			return false
+		}
+		inst, ok := ctx.Compiler.instances[structType.Name()]
+		if !ok || !strings.HasPrefix(inst.Name, t.Name+"<") || len(inst.TypeArgs) != len(t.TypeArgs) {
+			return false
+		}
+		for i, arg := range t.TypeArgs {
+			if !ctx.unifyType(arg, inst.TypeArgs[i], typeParams, bindings) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// typeString formats a type as it was written in the source.
+func typeString(t *parser.Type) string {
+	str := ""
+	if t.Array != nil {
+		str += "[]"
+	}
+	str += t.Ptr
+	if t.Inner != nil {
+		return str + typeString(t.Inner)
+	} else if t.Func != nil {
+		return str + "func(...)"
+	}
+	str += t.Name
+	if len(t.TypeArgs) > 0 {
+		args := make([]string, len(t.TypeArgs))
+		for i, arg := range t.TypeArgs {
+			args[i] = typeString(arg)
+		}
+		str += "<" + strings.Join(args, ", ") + ">"
+	}
+	return str
+}
+
+// compileGenericCall calls the generic function `def`, instantiated with the
+// type arguments given in the call or inferred from its arguments.
+func (ctx *Context) compileGenericCall(def *parser.FunctionDefinition, fc *parser.FunctionCall) (value.Value, error) {
+	args := make([]value.Value, len(fc.Args.Arguments))
+	var typeArgs []types.Type
+	if len(fc.TypeArgs) > 0 {
+		for _, t := range fc.TypeArgs {
+			typeArgs = append(typeArgs, ctx.CFTypeToLLType(t))
+		}
+	} else {
+		for i, arg := range fc.Args.Arguments {
+			val, err := ctx.compileExpression(arg)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = val
+		}
+		inferred, err := ctx.inferTypeArgs(def.Name.Name, def.TypeParams, def.Parameters, args, fc.Pos)
+		if err != nil {
+			return nil, err
+		}
+		typeArgs = inferred
+	}
+
+	fn, err := ctx.instantiateFunction(def, typeArgs, fc.Pos)
+	if err != nil {
+		return nil, err
+	}
+	if len(fc.Args.Arguments) != len(fn.Params) {
+		return nil, posError(fc.Pos, "%s takes %d arguments but %d were given", fn.Name(), len(fn.Params), len(fc.Args.Arguments))
+	}
+	for i, arg := range fc.Args.Arguments {
+		paramType := fn.Params[i].Type()
+		if args[i] == nil {
+			ctx.RequestedType = paramType
+			val, err := ctx.compileExpression(arg)
+			ctx.RequestedType = nil
+			if err != nil {
+				return nil, err
+			}
+			args[i] = val
+		}
+		converted, ok := ctx.convertValue(args[i], paramType)
+		if !ok {
+			return nil, posError(arg.Pos, "Cannot pass a value of type %s as argument %d of type %s", ctx.TypeToString(args[i].Type()), i+1, ctx.TypeToString(paramType))
+		}
+		args[i] = converted
+	}
+	return ctx.NewCall(fn, args...), nil
+}
+
+// instantiateInitializedClass instantiates the generic class created by `ci`
+// and returns the name of the instance. Without type arguments, they are
+// inferred from the arguments of the constructor, which are returned compiled.
+func (ctx *Context) instantiateInitializedClass(ci *parser.ClassInitializer) (string, []value.Value, error) {
+	def := ctx.Compiler.genericClasses[ci.ClassName]
+	var typeArgs []types.Type
+	var args []value.Value
+	if len(ci.TypeArgs) > 0 {
+		for _, t := range ci.TypeArgs {
+			typeArgs = append(typeArgs, ctx.CFTypeToLLType(t))
+		}
+	} else {
+		var constructor *parser.FunctionDefinition
+		for _, s := range def.Body {
+			if s.FunctionDefinition != nil && s.FunctionDefinition.Name.Name == "constructor" {
+				constructor = s.FunctionDefinition
+			}
+		}
+		if constructor == nil {
+			return "", nil, posError(ci.Pos, "Cannot infer the type arguments of %s without a constructor", ci.ClassName)
+		}
+
+		args = make([]value.Value, len(ci.Args.Arguments))
+		for i, arg := range ci.Args.Arguments {
+			val, err := ctx.compileExpression(arg)
+			if err != nil {
+				return "", nil, err
+			}
+			args[i] = val
+		}
+		inferred, err := ctx.inferTypeArgs(ci.ClassName, def.TypeParams, constructor.Parameters, args, ci.Pos)
+		if err != nil {
+			return "", nil, err
+		}
+		typeArgs = inferred
+	}
+
+	classType, err := ctx.instantiateClass(ci.ClassName, typeArgs, ci.Pos)
+	if err != nil {
+		return "", nil, err
+	}
+	return classType.Name(), args, nil
+}
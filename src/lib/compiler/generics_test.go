@@ -0,0 +1,35 @@
+package compiler
+
+import "testing"
+
+func TestGenerics(t *testing.T) {
+	expectOutput(t, `
+extern func malloc(size: i64): *i8;
+class List<T> {
+	items: *T;
+	len: i64;
+	func constructor(cap: i64) { this.items = (malloc(cap * 16)): *T; this.len = 0; }
+	func push(v: T) { var p = this.items + this.len; *p = v; this.len = this.len + 1; }
+	func at(i: i64): T { var p = this.items + i; return *p; }
+}
+class Box<T> { v: T; func constructor(v: T) { this.v = v; } }
+func max<T>(a: T, b: T): T { if (a > b) { return a; } return b; }
+func first<T>(l: *List<T>): T { return l.at(0); }
+func main(): i32 {
+	var l: *List<i64> = new List<i64>(4);
+	l.push(3);
+	l.push(9);
+	var b = new Box(7);
+	printf("%ld %ld %ld box %ld first %ld\n", l.at(1), l.len, max<i64>(3, 8), b.v, first(l));
+	printf("%.1f\n", max(2.5, 1.0));
+	return 0;
+}
+`, "9 2 8 box 7 first 3\n2.5\n")
+	expectError(t, `
+func id<T>(a: T): T { return a; }
+func main(): i32 {
+	var x = id<i64, i64>(1);
+	return 0;
+}
+`, "id takes 1 type arguments but 2 were given")
+}
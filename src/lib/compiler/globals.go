@@ -0,0 +1,189 @@
+package compiler
+
+import (
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/enum"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+	"github.com/vyPal/CaffeineC/lib/parser"
+)
+
+// File-scope variables become LLVM globals. Constant initializers are stored
+// in the global directly, anything else is evaluated by a module init function
+// that runs before main. Only exported globals are visible to other modules.
+
+// declareGlobals declares the globals holding the file-scope variables defined by `v`.
+// Variables without a type are declared once their initializer is compiled.
+func (ctx *Context) declareGlobals(v *parser.VariableDefinition) {
+	for _, b := range variableBindings(v) {
+		if b.Type != nil {
+			ctx.declareGlobal(b.Name, ctx.CFTypeToLLType(b.Type), v)
+		}
+	}
+}
+
+// declareGlobal declares the global `name` of type `typ`, defined by `v`.
+func (ctx *Context) declareGlobal(name string, typ types.Type, v *parser.VariableDefinition) *Variable {
+	if variable, ok := ctx.Compiler.globals[name]; ok {
+		return variable
+	}
+
+	global := ctx.Module.NewGlobalDef(name, constant.NewZeroInitializer(typ))
+	if !ctx.Compiler.exportedGlobals[v] {
+		global.Linkage = enum.LinkageInternal
+	}
+	variable := &Variable{
+		Name:     name,
+		Type:     typ,
+		Value:    global,
+		Constant: v.Constant == "const",
+	}
+	ctx.Compiler.globals[name] = variable
+	return variable
+}
+
+// declareExternalGlobal declares a file-scope variable exported by another module.
+func (ctx *Context) declareExternalGlobal(b *parser.VariableBinding, alias string, isConst bool) {
+	if b.Type == nil {
+		// Rejected when the exporting module is compiled
+		return
+	}
+	typ := ctx.CFTypeToLLType(b.Type)
+	global := ctx.Module.NewGlobal(b.Name, typ)
+	global.Linkage = enum.LinkageExternal
+	ctx.Compiler.globals[alias] = &Variable{
+		Name:     alias,
+		Type:     typ,
+		Value:    global,
+		Constant: isConst,
+	}
+}
+
+func (ctx *Context) compileGlobalDefinition(v *parser.VariableDefinition) (Name string, Type types.Type, Value value.Value, Err error) {
+	if v.Constant == "const" && v.Assignment == nil {
+		return "", nil, nil, posError(v.Pos, "Constant definition must have assignment")
+	}
+	isConst := v.Constant == "const"
+
+	init := ctx.moduleInit()
+	if len(v.Rest) > 0 {
+		bindings := variableBindings(v)
+		if v.Assignment == nil {
+			for _, b := range bindings {
+				if b.Type == nil {
+					return "", nil, nil, posError(b.Pos, "Cannot infer the type of %s without an assignment", b.Name)
+				}
+			}
+			ctx.declareGlobals(v)
+			for _, b := range bindings {
+				variable := ctx.Compiler.globals[b.Name]
+				init.initInstances(variable.Value, variable.Type)
+			}
+			return v.Name, nil, nil, nil
+		}
+
+		vals, err := init.compileUnpacking(v.Assignment, bindings)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		for i, b := range bindings {
+			variable := ctx.declareGlobal(b.Name, vals[i].Type(), v)
+			init.NewStore(vals[i], variable.Value)
+			if isConst {
+				init.markInvariant(variable.Value.(*ir.Global))
+			}
+		}
+		return v.Name, nil, nil, nil
+	}
+
+	var variable *Variable
+	var val value.Value
+	if v.Type == nil {
+		inferred, err := init.compileInferredInitializer(v.Name, v.Pos, v.Assignment)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		val = inferred
+		variable = ctx.declareGlobal(v.Name, val.Type(), v)
+	} else {
+		variable = ctx.declareGlobal(v.Name, ctx.CFTypeToLLType(v.Type), v)
+	}
+
+	global := variable.Value.(*ir.Global)
+	if v.Assignment == nil {
+		init.initInstances(global, variable.Type)
+		return v.Name, global.Type(), global, nil
+	}
+
+	if val == nil {
+		init.RequestedType = variable.Type
+		compiled, err := init.compileExpression(v.Assignment)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		init.RequestedType = nil
+
+		converted, ok := init.convertValue(compiled, variable.Type)
+		if !ok {
+			return "", nil, nil, posError(v.Assignment.Pos, "Cannot initialize %s of type %s with a value of type %s", v.Name, ctx.TypeToString(variable.Type), ctx.TypeToString(compiled.Type()))
+		}
+		val = converted
+	}
+
+	if c, ok := val.(constant.Constant); ok {
+		global.Init = c
+		global.Immutable = variable.Constant
+	} else {
+		init.NewStore(val, global)
+		if variable.Constant {
+			init.markInvariant(global)
+		}
+	}
+
+	return v.Name, global.Type(), global, nil
+}
+
+// markInvariant tells LLVM the constant `global`, which the init function just
+// stored a value computed at runtime in, doesn't change anymore.
+func (ctx *Context) markInvariant(global *ir.Global) {
+	start := ctx.Compiler.declareFunc("llvm.invariant.start.p0i8", types.NewPointer(types.NewStruct()), ir.NewParam("size", types.I64), ir.NewParam("ptr", types.I8Ptr))
+	size, _ := ctx.typeLayout(global.ContentType)
+	ctx.NewCall(start, constant.NewInt(types.I64, int64(size)), ctx.NewBitCast(global, types.I8Ptr))
+}
+
+// moduleInit returns a context in the function that initializes the globals at startup.
+func (ctx *Context) moduleInit() *Context {
+	if ctx.Compiler.init == nil {
+		fn := ctx.Module.NewFunc("__cffc_init", types.Void)
+		fn.Linkage = enum.LinkageInternal
+		ctx.Compiler.init = NewContext(fn.NewBlock(""), ctx.Compiler)
+	}
+	return ctx.Compiler.init
+}
+
+// finishModuleInit registers the init function as a global constructor,
+// or removes it if every global had a constant initializer.
+func (c *Compiler) finishModuleInit() {
+	if c.init == nil {
+		return
+	}
+
+	fn := c.init.Parent
+	if len(fn.Blocks) == 1 && len(fn.Blocks[0].Insts) == 0 {
+		for i, f := range c.Module.Funcs {
+			if f == fn {
+				c.Module.Funcs = append(c.Module.Funcs[:i], c.Module.Funcs[i+1:]...)
+				break
+			}
+		}
+		c.init = nil
+		return
+	}
+	c.init.NewRet(nil)
+
+	ctorType := types.NewStruct(types.I32, fn.Type(), types.I8Ptr)
+	ctor := constant.NewStruct(ctorType, constant.NewInt(types.I32, 65535), fn, constant.NewNull(types.I8Ptr))
+	ctors := c.Module.NewGlobalDef("llvm.global_ctors", constant.NewArray(types.NewArray(1, ctorType), ctor))
+	ctors.Linkage = enum.LinkageAppending
+}
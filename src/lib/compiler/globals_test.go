@@ -0,0 +1,53 @@
+package compiler
+
+import "testing"
+
+func TestGlobals(t *testing.T) {
+	expectOutput(t, `
+var counter: i64 = 1;
+var inferred = 2.5;
+const limit: i64 = 10;
+func bump() { counter = counter + limit; }
+func main(): i32 {
+	bump();
+	printf("%ld %.1f\n", counter, inferred);
+	return 0;
+}
+`, "11 2.5\n")
+	expectError(t, `
+const g: i64 = 1;
+func main(): i32 {
+	g = 2;
+	return 0;
+}
+`, "Cannot assign to constant g")
+	expectError(t, `
+var g;
+func main(): i32 { return 0; }
+`, "Cannot infer the type of g without an assignment")
+}
+
+func TestGlobalLinkage(t *testing.T) {
+	expectIR(t, `
+var hidden: i64 = 1;
+const limit = 2;
+export var shared: i64 = 3;
+func main(): i32 { return (hidden + limit + shared): i32; }
+`, "@hidden = internal global i64 1", "@limit = internal constant i64 2", "@shared = global i64 3")
+}
+
+func TestRuntimeConstant(t *testing.T) {
+	expectIR(t, `
+func f(): i64 { return 4; }
+const g: i64 = f();
+func main(): i32 { return (g): i32; }
+`, "@g = internal global i64 zeroinitializer", "call {}* @llvm.invariant.start.p0i8(i64 8, i8* %2)")
+	expectOutput(t, `
+func f(): i64 { return 4; }
+const g: i64 = f();
+func main(): i32 {
+	printf("%ld\n", g);
+	return 0;
+}
+`, "4\n")
+}
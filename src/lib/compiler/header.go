@@ -2,20 +2,35 @@ package compiler
 
 import (
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/llir/llvm/ir/enum"
 	"github.com/llir/llvm/ir/types"
 )
 
-func convertCffTypeToCType(t types.Type) string {
+// cppOperators are the C++ operators the operators overloaded by classes are
+// declared as, by their name in mangled method names.
+var cppOperators = map[string]string{
+	"add": "+", "sub": "-", "mul": "*", "div": "/", "rem": "%",
+	"and": "&", "or": "|", "xor": "^", "shl": "<<", "shr": ">>",
+	"eq": "==", "ne": "!=", "lt": "<", "le": "<=", "gt": ">", "ge": ">=",
+	"land": "&&", "lor": "||", "not": "!", "compl": "~", "inc": "++", "dec": "--", "index": "[]",
+}
+
+func (comp *Compiler) convertCffTypeToCType(t types.Type) string {
 	switch typ := t.(type) {
 	case *types.IntType:
+		if comp.isUnsigned(typ) {
+			return "unsigned " + comp.convertCffTypeToCType(types.NewInt(typ.BitSize))
+		}
 		if typ.BitSize <= 8 {
 			return "char"
 		} else if typ.BitSize <= 16 {
 			return "short"
 		} else if typ.BitSize <= 32 {
-			return "long"
+			return "int"
 		} else {
 			return "long long"
 		}
@@ -29,7 +44,12 @@ func convertCffTypeToCType(t types.Type) string {
 		}
 	case *types.PointerType:
 		// Call the function recursively with the ElemType and append a star before it
-		return convertCffTypeToCType(typ.ElemType) + " *"
+		return comp.convertCffTypeToCType(typ.ElemType) + " *"
+	case *types.StructType:
+		if typ.Name() != "" {
+			return typ.Name()
+		}
+		return "void"
 	default:
 		return "void"
 	}
@@ -66,11 +86,37 @@ func WriteHeader(f *os.File, comp *Compiler) error {
 		return err
 	}
 
+	// Enums come first, as C enums with their variants prefixed by the enum name
+	var enums []string
+	for name := range comp.enums {
+		enums = append(enums, name)
+	}
+	sort.Strings(enums)
+	for _, name := range enums {
+		def := comp.enums[name]
+		_, err = f.WriteString("typedef enum " + name + "\n{\n")
+		if err != nil {
+			return err
+		}
+
+		for i, variant := range def.variants {
+			_, err = f.WriteString(name + "_" + variant + " = " + strconv.FormatInt(def.values[i], 10) + ",\n")
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = f.WriteString("} " + name + ";\n")
+		if err != nil {
+			return err
+		}
+	}
+
 	for _, fn := range comp.Module.Funcs {
-		if strings.Count(fn.Name(), ".") > 0 {
+		if strings.Count(fn.Name(), ".") > 0 || fn.Linkage == enum.LinkageInternal {
 			continue
 		}
-		_, err = f.WriteString(convertCffTypeToCType(fn.Sig.RetType) + " ")
+		_, err = f.WriteString(comp.convertCffTypeToCType(fn.Sig.RetType) + " ")
 		if err != nil {
 			return err
 		}
@@ -86,7 +132,7 @@ func WriteHeader(f *os.File, comp *Compiler) error {
 		}
 
 		for i, param := range fn.Sig.Params {
-			_, err = f.WriteString(convertCffTypeToCType(param))
+			_, err = f.WriteString(comp.convertCffTypeToCType(param))
 			if err != nil {
 				return err
 			}
@@ -128,31 +174,64 @@ func WriteHeader(f *os.File, comp *Compiler) error {
 	}
 
 	for _, c := range comp.Module.TypeDefs {
-		_, err = f.WriteString("class " + c.Name() + "\n{\nprivate:\n")
+		if _, ok := comp.instances[c.Name()]; ok {
+			// Instances of generic classes are internal to the module
+			continue
+		}
+		if _, ok := comp.interfaces[strings.TrimSuffix(c.Name(), ".vtable")]; ok {
+			// Interfaces only exist in CaffeineC
+			continue
+		}
+		if _, ok := comp.unions[c.Name()]; ok {
+			// And so do unions
+			continue
+		}
+		// Private members are an implementation detail of the class and are left
+		// out, but private fields are replaced by padding so the layout stays the same
+		_, err = f.WriteString("class " + c.Name() + "\n{\n")
 		if err != nil {
 			return err
 		}
 
-		for _, field := range comp.StructFields[c.Name()] {
-			if !field.Private {
-				continue
+		classType, _ := c.(*types.StructType)
+		access := ""
+		for i, field := range comp.StructFields[c.Name()] {
+			fieldAccess := "public:\n"
+			if field.Private {
+				fieldAccess = "private:\n"
+			}
+			if fieldAccess != access {
+				access = fieldAccess
+				_, err = f.WriteString(access)
+				if err != nil {
+					return err
+				}
+			}
+
+			if field.Private {
+				size, align := comp.Context.typeLayout(classType.Fields[i])
+				_, err = f.WriteString("alignas(" + strconv.FormatUint(align, 10) + ") char __private_" + strconv.Itoa(i) + "[" + strconv.FormatUint(size, 10) + "];\n")
+			} else {
+				_, err = f.WriteString(comp.convertCffTypeToCType(comp.Context.CFTypeToLLType(field.Type)) + " " + field.Name + ";\n")
 			}
-			_, err = f.WriteString(convertCffTypeToCType(comp.Context.CFTypeToLLType(field.Type)) + " " + field.Name + ";\n")
 			if err != nil {
 				return err
 			}
 		}
 
-		_, err = f.WriteString("public:\n")
-		if err != nil {
-			return err
+		if access != "public:\n" {
+			_, err = f.WriteString("public:\n")
+			if err != nil {
+				return err
+			}
 		}
 
-		for _, field := range comp.StructFields[c.Name()] {
-			if field.Private {
+		for _, g := range comp.Module.Globals {
+			field, ok := comp.StaticFields[g.Name()]
+			if !ok || field.Private || !strings.HasPrefix(g.Name(), c.Name()+".") {
 				continue
 			}
-			_, err = f.WriteString(convertCffTypeToCType(comp.Context.CFTypeToLLType(field.Type)) + " " + field.Name + ";\n")
+			_, err = f.WriteString("static " + comp.convertCffTypeToCType(g.ContentType) + " " + field.Name + ";\n")
 			if err != nil {
 				return err
 			}
@@ -164,20 +243,41 @@ func WriteHeader(f *os.File, comp *Compiler) error {
 				continue
 			} else {
 				parts = strings.Split(fn.Name(), ".")
-				if parts[0] != c.Name() {
+				if parts[0] != c.Name() || comp.PrivateMethods[fn.Name()] {
 					continue
 				}
 			}
 
 			isConstructor := parts[1] == "constructor"
+			isStatic := comp.StaticMethods[fn.Name()]
+
+			// Operators and property accessors carry more parts in their names
+			method := parts[1]
+			if parts[1] == "op" {
+				symbol, ok := cppOperators[parts[2]]
+				if !ok {
+					// C++ has no such operator
+					continue
+				}
+				method = "operator" + symbol
+			} else if parts[1] == "get" || parts[1] == "set" {
+				method = parts[1] + "_" + parts[2]
+			}
+
+			if isStatic {
+				_, err = f.WriteString("static ")
+				if err != nil {
+					return err
+				}
+			}
 
 			if !isConstructor {
-				_, err = f.WriteString(convertCffTypeToCType(fn.Sig.RetType) + " ")
+				_, err = f.WriteString(comp.convertCffTypeToCType(fn.Sig.RetType) + " ")
 				if err != nil {
 					return err
 				}
 
-				_, err = f.WriteString(parts[1])
+				_, err = f.WriteString(method)
 				if err != nil {
 					return err
 				}
@@ -193,8 +293,14 @@ func WriteHeader(f *os.File, comp *Compiler) error {
 				return err
 			}
 
-			for i, param := range fn.Sig.Params[1:] {
-				_, err = f.WriteString(convertCffTypeToCType(param))
+			// Skip the `this` parameter of instance methods
+			first := 1
+			if isStatic {
+				first = 0
+			}
+
+			for i, param := range fn.Sig.Params[first:] {
+				_, err = f.WriteString(comp.convertCffTypeToCType(param))
 				if err != nil {
 					return err
 				}
@@ -204,12 +310,12 @@ func WriteHeader(f *os.File, comp *Compiler) error {
 					return err
 				}
 
-				_, err = f.WriteString(fn.Params[i+1].Name())
+				_, err = f.WriteString(fn.Params[i+first].Name())
 				if err != nil {
 					return err
 				}
 
-				if i != len(fn.Sig.Params)-2 {
+				if i != len(fn.Sig.Params)-first-1 {
 					_, err = f.WriteString(", ")
 					if err != nil {
 						return err
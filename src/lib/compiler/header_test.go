@@ -0,0 +1,69 @@
+package compiler
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// expectHeader compiles `src` and checks the C++ header written for it
+// contains every one of `fragments`, and none of `missing`.
+func expectHeader(t *testing.T, src string, fragments []string, missing []string) {
+	t.Helper()
+	comp, err := compileModule(t, map[string]string{"main.cffc": prelude + src})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "main.h")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := WriteHeader(f, comp); err != nil {
+		t.Fatal(err)
+	}
+	header, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, frag := range fragments {
+		if !strings.Contains(string(header), frag) {
+			t.Errorf("header doesn't contain %q:\n%s", frag, header)
+		}
+	}
+	for _, m := range missing {
+		if strings.Contains(string(header), m) {
+			t.Errorf("header contains %q:\n%s", m, header)
+		}
+	}
+}
+
+func TestHeaderPrivateFields(t *testing.T) {
+	expectHeader(t, `
+class Counter {
+	flag: i8;
+	private count: i64;
+	total: i64;
+	virtual func inc() { this.count = this.count + 1; }
+}
+func main(): i32 { return 0; }
+`, []string{
+		"class Counter\n{\nprivate:\nalignas(8) char __private_0[8];\npublic:\nchar flag;\nprivate:\nalignas(8) char __private_2[8];\npublic:\nlong long total;\nvoid inc();\n",
+	}, []string{"count", ".vtable"})
+}
+
+func TestHeaderIntegerTypes(t *testing.T) {
+	// long is 64 bits wide on LP64 targets, so 32-bit integers are written as int
+	expectHeader(t, `
+export class Sizes {
+	a: i8;
+	b: i16;
+	c: i32;
+	d: i64;
+}
+export func scale(x: i32): i64 { return (x): i64 * 2; }
+func main(): i32 { return 0; }
+`, []string{"char a;\nshort b;\nint c;\nlong long d;\n", "long long scale(int x);"}, []string{"long c;"})
+}
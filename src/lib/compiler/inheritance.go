@@ -0,0 +1,345 @@
+package compiler
+
+import (
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/enum"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+	"github.com/vyPal/CaffeineC/lib/parser"
+)
+
+// A class extending another starts with the fields of its parent, so a
+// pointer to it can be used wherever a pointer to the parent is expected, and
+// the methods it doesn't define are looked up in its ancestors. The first
+// class of a hierarchy to declare a virtual method gets a hidden field pointing
+// to the vtable of the instance's class, an array holding the implementation
+// of every virtual method. Calls to virtual methods go through it.
+
+// vtableField is the name of the hidden field holding the vtable.
+const vtableField = ".vtable"
+
+// sortByParent orders `classes` so every class comes after the class it extends.
+func sortByParent(classes []*parser.ClassDefinition) []*parser.ClassDefinition {
+	byName := make(map[string]*parser.ClassDefinition, len(classes))
+	for _, c := range classes {
+		byName[c.Name] = c
+	}
+	var sorted []*parser.ClassDefinition
+	visited := map[string]bool{}
+	var visit func(c *parser.ClassDefinition)
+	visit = func(c *parser.ClassDefinition) {
+		if visited[c.Name] {
+			return
+		}
+		visited[c.Name] = true
+		if parent, ok := byName[c.Extends]; ok {
+			visit(parent)
+		}
+		sorted = append(sorted, c)
+	}
+	for _, c := range classes {
+		visit(c)
+	}
+	return sorted
+}
+
+// inheritMembers starts the class `c`, declared as `name`, with the fields of
+// its parent and records its virtual methods. It has to run before the
+// class's own fields are added.
+func (ctx *Context) inheritMembers(c *parser.ClassDefinition, name string, classType *types.StructType) {
+	var slots []string
+	if c.Extends != "" {
+		ctx.Compiler.parents[name] = c.Extends
+		if t, ok := ctx.lookupClass(c.Extends); ok {
+			if parentType, ok := t.(*types.StructType); ok && !ctx.isInterface(parentType) {
+				classType.Fields = append(classType.Fields, parentType.Fields...)
+				ctx.Compiler.StructFields[name] = append(ctx.Compiler.StructFields[name], ctx.Compiler.StructFields[c.Extends]...)
+			}
+		}
+		slots = append(slots, ctx.Compiler.virtuals[c.Extends]...)
+	}
+	inherited := len(slots)
+
+	for _, s := range c.Body {
+		if f := s.FunctionDefinition; f != nil && f.Virtual && !contains(slots, f.Name.Name) {
+			slots = append(slots, f.Name.Name)
+		}
+	}
+	if inherited == 0 && len(slots) > 0 {
+		classType.Fields = append(classType.Fields, types.I8Ptr)
+		ctx.Compiler.StructFields[name] = append(ctx.Compiler.StructFields[name], &parser.FieldDefinition{
+			Pos:     c.Pos,
+			Private: true,
+			Name:    vtableField,
+			Type:    &parser.Type{Pos: c.Pos, Ptr: "*", Name: "i8"},
+		})
+	}
+	ctx.Compiler.virtuals[name] = slots
+}
+
+// contains reports whether `names` contains `name`.
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isSubclass reports whether the class `className` is `ancestor` or inherits from it.
+func (c *Compiler) isSubclass(className string, ancestor string) bool {
+	for depth := 0; className != "" && depth <= len(c.parents); depth++ {
+		if className == ancestor {
+			return true
+		}
+		className = c.parents[className]
+	}
+	return false
+}
+
+// lookupClassMethod finds the method `name` of the class `className`, which
+// may be inherited from one of its ancestors.
+func (ctx *Context) lookupClassMethod(className string, name string) (*ir.Func, bool) {
+	for depth := 0; className != "" && depth <= len(ctx.Compiler.parents); depth++ {
+		if fn, ok := ctx.SymbolTable[className+"."+name].(*ir.Func); ok {
+			return fn, true
+		}
+		className = ctx.Compiler.parents[className]
+	}
+	return nil, false
+}
+
+// fieldOwner returns the class among `className` and its ancestors that defines `field`.
+func (ctx *Context) fieldOwner(className string, field *parser.FieldDefinition) string {
+	for depth := 0; depth < len(ctx.Compiler.parents); depth++ {
+		parent, ok := ctx.Compiler.parents[className]
+		if !ok || !containsField(ctx.Compiler.StructFields[parent], field) {
+			break
+		}
+		className = parent
+	}
+	return className
+}
+
+// containsField reports whether `fields` contains `field`.
+func containsField(fields []*parser.FieldDefinition, field *parser.FieldDefinition) bool {
+	for _, f := range fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// checkInheritance makes sure the class `c` extends a class and overrides its virtual methods properly.
+func (ctx *Context) checkInheritance(c *parser.ClassDefinition) error {
+	if c.Extends == "" {
+		for _, s := range c.Body {
+			if f := s.FunctionDefinition; f != nil && f.Override {
+				return posError(f.Pos, "Method %s of class %s overrides nothing, the class doesn't extend another", f.Name.Name, c.Name)
+			}
+		}
+		return nil
+	}
+	if t, ok := ctx.lookupClass(c.Extends); !ok || ctx.isInterface(t) {
+		return posError(c.Pos, "Class %s extends unknown class %s", c.Name, c.Extends)
+	}
+	if ctx.Compiler.isSubclass(c.Extends, c.Name) {
+		return posError(c.Pos, "Class %s cannot extend itself", c.Name)
+	}
+
+	parentSlots := ctx.Compiler.virtuals[c.Extends]
+	for _, s := range c.Body {
+		f := s.FunctionDefinition
+		if f == nil {
+			continue
+		}
+		name := f.Name.Name
+		if f.Static && (f.Virtual || f.Override) {
+			return posError(f.Pos, "Static method %s of class %s cannot be virtual", name, c.Name)
+		}
+		if f.Virtual && contains(parentSlots, name) {
+			return posError(f.Pos, "Method %s of class %s must be marked override, %s already declares it virtual", name, c.Name, c.Extends)
+		}
+		if !f.Override {
+			if contains(parentSlots, name) {
+				return posError(f.Pos, "Method %s of class %s overrides a virtual method of %s without being marked override", name, c.Name, c.Extends)
+			}
+			continue
+		}
+		if !contains(parentSlots, name) {
+			return posError(f.Pos, "Method %s of class %s is marked override, but %s has no virtual method %s", name, c.Name, c.Extends, name)
+		}
+
+		overridden, _ := ctx.lookupClassMethod(c.Extends, name)
+		fn, _ := ctx.lookupClassMethod(c.Name, name)
+		sig := types.NewFunc(fn.Sig.RetType, fn.Sig.Params[1:]...)
+		parentSig := types.NewFunc(overridden.Sig.RetType, overridden.Sig.Params[1:]...)
+		if !sig.Equal(parentSig) {
+			return posError(f.Pos, "Method %s of class %s has type %s, but the method it overrides has type %s", name, c.Name, ctx.funcTypeString("func", sig), ctx.funcTypeString("func", parentSig))
+		}
+	}
+	return nil
+}
+
+// classVtable returns the vtable of the class `className`. It is defined by
+// the module defining the class and declared by the ones importing it.
+func (ctx *Context) classVtable(className string) *ir.Global {
+	name := className + ".vtable"
+	for _, g := range ctx.Module.Globals {
+		if g.Name() == name {
+			return g
+		}
+	}
+
+	slots := ctx.Compiler.virtuals[className]
+	arrType := types.NewArray(uint64(len(slots)), types.I8Ptr)
+	if !ctx.Compiler.declaredClasses[className] {
+		vtable := ctx.Module.NewGlobal(name, arrType)
+		vtable.Linkage = enum.LinkageExternal
+		vtable.Immutable = true
+		return vtable
+	}
+
+	methods := make([]constant.Constant, len(slots))
+	for i, slot := range slots {
+		fn, _ := ctx.lookupClassMethod(className, slot)
+		methods[i] = constant.NewBitCast(fn, types.I8Ptr)
+	}
+	vtable := ctx.Module.NewGlobalDef(name, constant.NewArray(arrType, methods...))
+	vtable.Immutable = true
+	if _, ok := ctx.Compiler.instances[className]; ok {
+		vtable.Linkage = enum.LinkageInternal
+	}
+	return vtable
+}
+
+// initVtable points the hidden vtable field of the new instance `obj` of the class `className` to its vtable.
+func (ctx *Context) initVtable(obj value.Value, className string) {
+	if len(ctx.Compiler.virtuals[className]) == 0 {
+		return
+	}
+	field := ctx.vtableSlot(obj, className)
+	ctx.NewStore(ctx.NewBitCast(ctx.classVtable(className), types.I8Ptr), field)
+}
+
+// needsVtable reports whether a value of type `t` holds instances whose vtable field has to be set.
+func (ctx *Context) needsVtable(t types.Type) bool {
+	switch t := t.(type) {
+	case *types.StructType:
+		if _, ok := ctx.Compiler.StructFields[t.Name()]; !ok || t.Name() == "" {
+			return false
+		}
+		if len(ctx.Compiler.virtuals[t.Name()]) > 0 {
+			return true
+		}
+		for _, field := range t.Fields {
+			if ctx.needsVtable(field) {
+				return true
+			}
+		}
+	case *types.ArrayType:
+		return ctx.needsVtable(t.ElemType)
+	}
+	return false
+}
+
+// initInstances sets the vtable field of every instance stored by value at
+// `mem`, which holds a value of type `t`: the instance itself, its fields and
+// the elements of its arrays.
+func (ctx *Context) initInstances(mem value.Value, t types.Type) {
+	if !ctx.needsVtable(t) {
+		return
+	}
+	switch t := t.(type) {
+	case *types.StructType:
+		ctx.initVtable(mem, t.Name())
+		for i, field := range t.Fields {
+			if ctx.needsVtable(field) {
+				ctx.initInstances(ctx.NewGetElementPtr(t, mem, constant.NewInt(types.I32, 0), constant.NewInt(types.I32, int64(i))), field)
+			}
+		}
+	case *types.ArrayType:
+		// Loop over the elements
+		condB := ctx.Block.Parent.NewBlock("")
+		bodyB := ctx.Block.Parent.NewBlock("")
+		leaveB := ctx.Block.Parent.NewBlock("")
+		counter := ctx.NewAlloca(types.I64)
+		ctx.NewStore(constant.NewInt(types.I64, 0), counter)
+		ctx.NewBr(condB)
+
+		ctx.Block = condB
+		i := ctx.NewLoad(types.I64, counter)
+		ctx.NewCondBr(ctx.NewICmp(enum.IPredULT, i, constant.NewInt(types.I64, int64(t.Len))), bodyB, leaveB)
+
+		ctx.Block = bodyB
+		ctx.initInstances(ctx.NewGetElementPtr(t, mem, constant.NewInt(types.I64, 0), i), t.ElemType)
+		ctx.NewStore(ctx.NewAdd(i, constant.NewInt(types.I64, 1)), counter)
+		ctx.NewBr(condB)
+
+		ctx.Block = leaveB
+	}
+}
+
+// vtableSlot returns the address of the hidden vtable field of `obj`.
+func (ctx *Context) vtableSlot(obj value.Value, className string) value.Value {
+	index := 0
+	for i, field := range ctx.Compiler.StructFields[className] {
+		if field.Name == vtableField {
+			index = i
+		}
+	}
+	structType := obj.Type().(*types.PointerType).ElemType
+	return ctx.NewGetElementPtr(structType, obj, constant.NewInt(types.I32, 0), constant.NewInt(types.I32, int64(index)))
+}
+
+// methodCallee returns the function to call for the method `name` of the
+// class `className` on `obj`, implemented by `fn`, and `obj` as the type the
+// function takes. Virtual methods are looked up in the vtable of the instance,
+// unless `static` is set.
+func (ctx *Context) methodCallee(obj value.Value, className string, name string, fn *ir.Func, static bool) (value.Value, value.Value) {
+	this := obj
+	if len(fn.Params) > 0 && !obj.Type().Equal(fn.Params[0].Type()) {
+		// Inherited from an ancestor
+		this = ctx.NewBitCast(obj, fn.Params[0].Type())
+	}
+
+	slots := ctx.Compiler.virtuals[className]
+	if static || !contains(slots, name) {
+		return fn, this
+	}
+	index := 0
+	for i, slot := range slots {
+		if slot == name {
+			index = i
+		}
+	}
+	vtable := ctx.NewBitCast(ctx.NewLoad(types.I8Ptr, ctx.vtableSlot(obj, className)), types.NewPointer(types.I8Ptr))
+	impl := ctx.NewLoad(types.I8Ptr, ctx.NewGetElementPtr(types.I8Ptr, vtable, constant.NewInt(types.I64, int64(index))))
+	return ctx.NewBitCast(impl, fn.Type()), this
+}
+
+// compileSuperCall calls the method `name` of the parent of the class whose
+// method is being compiled, without going through the vtable.
+func (ctx *Context) compileSuperCall(name string, arguments *parser.ArgumentList, pos lexer.Position) (value.Value, error) {
+	if ctx.className == "" {
+		return nil, posError(pos, "super can only be used in the methods of a class")
+	}
+	parent, ok := ctx.Compiler.parents[ctx.className]
+	if !ok {
+		return nil, posError(pos, "Class %s doesn't extend another class", ctx.className)
+	}
+	this := ctx.lookupVariable("this")
+	if this == nil {
+		return nil, posError(pos, "super cannot be used in static methods")
+	}
+	parentType, ok := ctx.lookupClass(parent)
+	if !ok {
+		return nil, posError(pos, "Class %s extends unknown class %s", ctx.className, parent)
+	}
+	obj := ctx.NewBitCast(ctx.variableValue(this), types.NewPointer(parentType))
+	return ctx.compileMethodCall(obj, name, arguments, true, true, pos)
+}
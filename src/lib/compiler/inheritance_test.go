@@ -0,0 +1,59 @@
+package compiler
+
+import "testing"
+
+func TestInheritance(t *testing.T) {
+	expectOutput(t, `
+class Animal {
+	name: *i8;
+	func constructor(n: *i8) { this.name = n; }
+	virtual func speak() { printf("%s: ...\n", this.name); }
+	func hello() { printf("hello from %s\n", this.name); this.speak(); }
+}
+class Dog extends Animal {
+	age: i64;
+	func constructor(n: *i8, a: i64) { super.constructor(n); this.age = a; }
+	override func speak() { printf("%s (%ld): woof\n", this.name, this.age); super.speak(); }
+}
+func talk(a: *Animal) { a.speak(); }
+func main(): i32 {
+	var a: *Animal = new Animal("cat");
+	var d: *Dog = new Dog("rex", 3);
+	talk(a);
+	talk(d);
+	d.hello();
+	return 0;
+}
+`, "cat: ...\nrex (3): woof\nrex: ...\nhello from rex\nrex (3): woof\nrex: ...\n")
+	expectError(t, `
+class A { func f() {} }
+class B extends A { override func g() {} }
+func main(): i32 { return 0; }
+`, "Method g of class B is marked override, but A has no virtual method g")
+}
+
+func TestInstancesByValue(t *testing.T) {
+	expectOutput(t, `
+class A {
+	x: i64;
+	virtual func f(): i64 { return 1; }
+}
+class B extends A {
+	override func f(): i64 { return 2; }
+}
+class Holder {
+	b: B;
+	arr: [2]B;
+}
+var gb: B;
+func main(): i32 {
+	var b: B;
+	var arr: [3]B;
+	var h = new Holder();
+	var pa: *A = &arr[2];
+	var ph: *B = &h.arr[1];
+	printf("%ld %ld %ld %ld %ld\n", b.f(), gb.f(), pa.f(), h.b.f(), ph.f());
+	return 0;
+}
+`, "2 2 2 2 2\n")
+}
@@ -0,0 +1,273 @@
+package compiler
+
+import (
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/enum"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+	"github.com/vyPal/CaffeineC/lib/parser"
+)
+
+// An interface value is a fat pointer {object, vtable}. The vtable of a class
+// for an interface is a constant struct holding its methods in the order the
+// interface lists them, each taking the object as an *i8. Vtables are emitted
+// by every module converting a class instance to the interface.
+
+// iface is a declared interface and the signatures of its methods, without the object.
+type iface struct {
+	name    string
+	typ     *types.StructType
+	vtable  *types.StructType
+	methods []string
+	sigs    []*types.FuncType
+}
+
+// declareInterface registers the type of the interface `i` under `name`.
+// Its methods are added by declareInterfaceMethods.
+func (ctx *Context) declareInterface(i *parser.InterfaceDefinition, name string) *iface {
+	if in, ok := ctx.Compiler.interfaces[name]; ok {
+		return in
+	}
+
+	vtable := types.NewStruct()
+	vtable.SetName(name + ".vtable")
+	ctx.Module.NewTypeDef(name+".vtable", vtable)
+	typ := types.NewStruct(types.I8Ptr, types.NewPointer(vtable))
+	typ.SetName(name)
+	ctx.Module.NewTypeDef(name, typ)
+
+	in := &iface{name: name, typ: typ, vtable: vtable}
+	ctx.Compiler.interfaces[name] = in
+	return in
+}
+
+// declareInterfaceMethods adds the methods of the interface `i` to its vtable.
+func (ctx *Context) declareInterfaceMethods(i *parser.InterfaceDefinition, name string) {
+	in := ctx.declareInterface(i, name)
+	if len(in.methods) > 0 {
+		return
+	}
+	for _, m := range i.Methods {
+		var retType types.Type = types.Void
+		if m.ReturnType != nil {
+			retType = ctx.CFTypeToLLType(m.ReturnType)
+		}
+		var params []types.Type
+		for _, param := range m.Parameters {
+			params = append(params, ctx.CFTypeToLLType(param.Type))
+		}
+		in.methods = append(in.methods, m.Name)
+		in.sigs = append(in.sigs, types.NewFunc(retType, params...))
+
+		// The object is passed to the method as an *i8
+		impl := types.NewFunc(retType, append([]types.Type{types.I8Ptr}, params...)...)
+		in.vtable.Fields = append(in.vtable.Fields, types.NewPointer(impl))
+	}
+}
+
+// compileInterfaceDefinition checks the interface `i`, which was declared with the rest of the module.
+func (ctx *Context) compileInterfaceDefinition(i *parser.InterfaceDefinition) error {
+	seen := map[string]bool{}
+	for _, m := range i.Methods {
+		if seen[m.Name] {
+			return posError(m.Pos, "Method %s of interface %s is declared twice", m.Name, i.Name)
+		}
+		seen[m.Name] = true
+	}
+	return nil
+}
+
+// interfaceOf returns the interface `t` is the type of.
+func (ctx *Context) interfaceOf(t types.Type) (*iface, bool) {
+	structType, ok := t.(*types.StructType)
+	if !ok || structType.Name() == "" {
+		return nil, false
+	}
+	in, ok := ctx.Compiler.interfaces[structType.Name()]
+	if !ok || in.typ != structType {
+		return nil, false
+	}
+	return in, true
+}
+
+// isInterface reports whether `t` is an interface type.
+func (ctx *Context) isInterface(t types.Type) bool {
+	_, ok := ctx.interfaceOf(t)
+	return ok
+}
+
+// checkImplements makes sure the class `c` has every method of the interfaces it implements.
+func (ctx *Context) checkImplements(c *parser.ClassDefinition) error {
+	for _, name := range c.Implements {
+		in, ok := ctx.Compiler.interfaces[name]
+		if !ok {
+			return posError(c.Pos, "Interface %s not found", name)
+		}
+		for i, method := range in.methods {
+			fn, ok := ctx.lookupImplementation(c.Name, method)
+			if !ok {
+				return posError(c.Pos, "Class %s does not implement %s: missing method %s", c.Name, name, method)
+			}
+			sig := types.NewFunc(fn.Sig.RetType, fn.Sig.Params[1:]...)
+			if !sig.Equal(in.sigs[i]) || fn.Sig.Variadic {
+				return posError(methodPos(c, method), "Method %s of class %s has type %s, but %s requires %s", method, c.Name, ctx.funcTypeString("func", sig), name, ctx.funcTypeString("func", in.sigs[i]))
+			}
+		}
+	}
+	return nil
+}
+
+// lookupImplementation finds the method `name` of the class `className` that implements an interface method.
+func (ctx *Context) lookupImplementation(className string, name string) (*ir.Func, bool) {
+	fn, ok := ctx.lookupClassMethod(className, name)
+	if !ok || ctx.StaticMethods[fn.Name()] {
+		return nil, false
+	}
+	return fn, true
+}
+
+// methodPos returns the position of the method `name` of the class `c`.
+func methodPos(c *parser.ClassDefinition, name string) lexer.Position {
+	for _, s := range c.Body {
+		if s.FunctionDefinition != nil && s.FunctionDefinition.Name.Name == name {
+			return s.FunctionDefinition.Pos
+		}
+	}
+	return c.Pos
+}
+
+// implementsInterface reports whether the class `className` or one of its ancestors implements the interface `in`.
+func (ctx *Context) implementsInterface(className string, in *iface) bool {
+	for depth := 0; className != "" && depth <= len(ctx.Compiler.parents); depth++ {
+		if contains(ctx.Compiler.implements[className], in.name) {
+			return true
+		}
+		className = ctx.Compiler.parents[className]
+	}
+	return false
+}
+
+// vtableFor returns the vtable of the class `className` for the interface `in`.
+// It reports false if the class is missing one of its methods.
+func (ctx *Context) vtableFor(className string, in *iface) (*ir.Global, bool) {
+	name := className + ".vtable." + in.name
+	for _, g := range ctx.Module.Globals {
+		if g.Name() == name {
+			return g, true
+		}
+	}
+
+	methods := make([]constant.Constant, len(in.methods))
+	for i, method := range in.methods {
+		fn, ok := ctx.lookupImplementation(className, method)
+		if !ok {
+			return nil, false
+		}
+		if contains(ctx.Compiler.virtuals[className], method) {
+			// The instance may be of a class overriding the method
+			methods[i] = ctx.virtualThunk(className, method, fn, in.vtable.Fields[i])
+			continue
+		}
+		methods[i] = constant.NewBitCast(fn, in.vtable.Fields[i])
+	}
+	vtable := ctx.Module.NewGlobalDef(name, constant.NewStruct(in.vtable, methods...))
+	vtable.Linkage = enum.LinkageInternal
+	vtable.Immutable = true
+	return vtable, true
+}
+
+// virtualThunk returns a function calling the virtual method `name` of the
+// class `className`, implemented by `fn`, through the vtable of the instance.
+func (ctx *Context) virtualThunk(className string, name string, fn *ir.Func, t types.Type) *ir.Func {
+	sig := t.(*types.PointerType).ElemType.(*types.FuncType)
+	params := make([]*ir.Param, len(sig.Params))
+	for i, param := range sig.Params {
+		params[i] = ir.NewParam("", param)
+	}
+	thunk := ctx.Module.NewFunc(className+"."+name+".thunk", sig.RetType, params...)
+	thunk.Linkage = enum.LinkageInternal
+
+	tctx := NewContext(thunk.NewBlock(""), ctx.Compiler)
+	classType, _ := ctx.lookupClass(className)
+	obj := tctx.NewBitCast(params[0], types.NewPointer(classType))
+	callee, this := tctx.methodCallee(obj, className, name, fn, false)
+	args := []value.Value{this}
+	for _, param := range params[1:] {
+		args = append(args, param)
+	}
+	result := tctx.NewCall(callee, args...)
+	if sig.RetType.Equal(types.Void) {
+		tctx.NewRet(nil)
+	} else {
+		tctx.NewRet(result)
+	}
+	return thunk
+}
+
+// toInterface converts the class instance `v` to a value of the interface `in`.
+// It reports false if the class doesn't implement the interface.
+func (ctx *Context) toInterface(v value.Value, in *iface) (value.Value, bool) {
+	className, ok := classOf(v.Type())
+	if !ok || !ctx.implementsInterface(className, in) {
+		return nil, false
+	}
+	vtable, ok := ctx.vtableFor(className, in)
+	if !ok {
+		return nil, false
+	}
+	var result value.Value = ctx.NewInsertValue(constant.NewUndef(in.typ), ctx.NewBitCast(v, types.I8Ptr), 0)
+	result = ctx.NewInsertValue(result, vtable, 1)
+	return result, true
+}
+
+// interfaceValue returns the interface value held by `v`, loading it from its storage.
+func (ctx *Context) interfaceValue(v value.Value) (value.Value, *iface, bool) {
+	if in, ok := ctx.interfaceOf(v.Type()); ok {
+		return v, in, true
+	}
+	if ptrType, ok := v.Type().(*types.PointerType); ok && isStorage(v) {
+		if in, ok := ctx.interfaceOf(ptrType.ElemType); ok {
+			return ctx.NewLoad(in.typ, v), in, true
+		}
+	}
+	return nil, nil, false
+}
+
+// compileInterfaceCall calls the method `name` of the interface value `obj` through its vtable.
+func (ctx *Context) compileInterfaceCall(obj value.Value, in *iface, name string, arguments *parser.ArgumentList, pos lexer.Position) (value.Value, error) {
+	index := -1
+	for i, method := range in.methods {
+		if method == name {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, posError(pos, "Method %s not found on interface %s", name, in.name)
+	}
+	sig := in.sigs[index]
+	if len(arguments.Arguments) != len(sig.Params) {
+		return nil, posError(pos, "Method %s of interface %s takes %d arguments but %d were given", name, in.name, len(sig.Params), len(arguments.Arguments))
+	}
+
+	args := []value.Value{ctx.NewExtractValue(obj, 0)}
+	for i, arg := range arguments.Arguments {
+		ctx.RequestedType = sig.Params[i]
+		compiled, err := ctx.compileExpression(arg)
+		ctx.RequestedType = nil
+		if err != nil {
+			return nil, err
+		}
+		converted, ok := ctx.convertValue(compiled, sig.Params[i])
+		if !ok {
+			return nil, posError(arg.Pos, "Cannot pass a value of type %s as argument %d of type %s", ctx.TypeToString(compiled.Type()), i+1, ctx.TypeToString(sig.Params[i]))
+		}
+		args = append(args, converted)
+	}
+
+	vtable := ctx.NewExtractValue(obj, 1)
+	slot := ctx.NewGetElementPtr(in.vtable, vtable, constant.NewInt(types.I32, 0), constant.NewInt(types.I32, int64(index)))
+	method := ctx.NewLoad(in.vtable.Fields[index], slot)
+	return ctx.NewCall(method, args...), nil
+}
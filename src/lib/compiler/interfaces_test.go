@@ -0,0 +1,34 @@
+package compiler
+
+import "testing"
+
+func TestInterfaces(t *testing.T) {
+	expectOutput(t, `
+interface Shape {
+	func area(): i64;
+}
+class Sq implements Shape {
+	s: i64;
+	func constructor(s: i64) { this.s = s; }
+	func area(): i64 { return this.s * this.s; }
+}
+class Rect implements Shape {
+	w: i64;
+	h: i64;
+	func constructor(w: i64, h: i64) { this.w = w; this.h = h; }
+	func area(): i64 { return this.w * this.h; }
+}
+func show(s: Shape) { printf("%ld\n", s.area()); }
+func main(): i32 {
+	show(new Sq(3));
+	var r: Shape = new Rect(2, 5);
+	show(r);
+	return 0;
+}
+`, "9\n10\n")
+	expectError(t, `
+interface I { func f(): i64; }
+class C implements I { }
+func main(): i32 { return 0; }
+`, "Class C does not implement I: missing method f")
+}
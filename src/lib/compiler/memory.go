@@ -0,0 +1,86 @@
+package compiler
+
+import (
+	"strings"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/enum"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+	"github.com/vyPal/CaffeineC/lib/parser"
+)
+
+// Class instances created with `new` live on the heap. They are allocated
+// with Compiler.Allocator, which takes the size in bytes and returns an i8*,
+// and released by `delete` with Compiler.Deallocator. Both default to the C
+// library's malloc and free. Deleting null does nothing, and deleting an
+// instance created with `local new` is an error when it can be seen at
+// compile time, otherwise its behavior is undefined.
+
+// sizeOf returns the size of `t` in bytes as a constant.
+func sizeOf(t types.Type) constant.Constant {
+	end := constant.NewGetElementPtr(t, constant.NewNull(types.NewPointer(t)), constant.NewInt(types.I32, 1))
+	return constant.NewPtrToInt(end, types.I64)
+}
+
+// allocate returns a pointer to new memory for a value of type `t`.
+// Local allocations are released when the function returns.
+func (ctx *Context) allocate(t types.Type, local bool) value.Value {
+	if local {
+		return ctx.NewAlloca(t)
+	}
+	alloc := ctx.Compiler.runtimeFunc(ctx.Compiler.Allocator, types.I8Ptr, ir.NewParam("size", types.I64))
+	mem := ctx.NewCall(alloc, sizeOf(t))
+	return ctx.NewBitCast(mem, types.NewPointer(t))
+}
+
+func (ctx *Context) compileDelete(d *parser.Delete) error {
+	val, err := ctx.compileExpression(d.Value)
+	if err != nil {
+		return err
+	}
+
+	className, ok := classOf(val.Type())
+	if !ok {
+		return posError(d.Value.Pos, "Cannot delete a value of type %s", ctx.TypeToString(val.Type()))
+	}
+	if ctx.onStack(val) {
+		return posError(d.Value.Pos, "Cannot delete an instance on the stack, it's released when the function returns")
+	}
+
+	deleteB := ctx.Block.Parent.NewBlock("")
+	endB := ctx.Block.Parent.NewBlock("")
+	ctx.NewCondBr(ctx.NewICmp(enum.IPredEQ, val, constant.NewNull(val.Type().(*types.PointerType))), endB, deleteB)
+	ctx.Block = deleteB
+
+	// The destructor may be inherited or virtual
+	destructor, exists := ctx.lookupClassMethod(className, "destructor")
+	if exists {
+		owner := strings.TrimSuffix(destructor.Name(), ".destructor")
+		if err := ctx.checkAccess(owner, "destructor", ctx.PrivateMethods[destructor.Name()], false, d.Pos); err != nil {
+			return err
+		}
+		if len(destructor.Sig.Params) != 1 {
+			return posError(d.Pos, "The destructor of class %s must not take any arguments", owner)
+		}
+		callee, this := ctx.methodCallee(val, className, "destructor", destructor, false)
+		ctx.NewCall(callee, this)
+	}
+
+	free := ctx.Compiler.runtimeFunc(ctx.Compiler.Deallocator, types.Void, ir.NewParam("ptr", types.I8Ptr))
+	ctx.NewCall(free, ctx.NewBitCast(val, types.I8Ptr))
+	ctx.NewBr(endB)
+	ctx.Block = endB
+	return nil
+}
+
+// onStack reports whether `val` points to stack memory, either directly or
+// through a variable that was initialized with it.
+func (ctx *Context) onStack(val value.Value) bool {
+	if _, ok := val.(*ir.InstAlloca); ok {
+		return true
+	}
+	load, ok := val.(*ir.InstLoad)
+	return ok && ctx.Compiler.localInstances[load.Src]
+}
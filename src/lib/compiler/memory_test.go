@@ -0,0 +1,75 @@
+package compiler
+
+import "testing"
+
+func TestHeapAllocation(t *testing.T) {
+	expectOutput(t, `
+class S {
+	v: i64;
+	func constructor(v: i64) { this.v = v; }
+	func destructor() { printf("dtor %ld\n", this.v); }
+}
+func make(v: i64): *S { return new S(v); }
+func main(): i32 {
+	var a = make(3);
+	printf("%ld\n", a.v);
+	delete a;
+	for (var i = 0; i < 2; i = i + 1) {
+		var l = local new S(i);
+		printf("l %ld\n", l.v);
+	}
+	return 0;
+}
+`, "3\ndtor 3\nl 0\nl 1\n")
+	expectError(t, `
+func main(): i32 {
+	var x: i64 = 1;
+	delete x;
+	return 0;
+}
+`, "Cannot delete a value of type i64")
+	expectOutput(t, `
+class S { func destructor() { printf("dtor\n"); } }
+func main(): i32 {
+	var p: *S = null;
+	delete p;
+	var l = local new S();
+	l = new S();
+	delete l;
+	printf("done\n");
+	return 0;
+}
+`, "dtor\ndone\n")
+	expectError(t, `
+class S { v: i64; }
+func main(): i32 {
+	var l = local new S();
+	delete l;
+	return 0;
+}
+`, "Cannot delete an instance on the stack, it's released when the function returns")
+	expectError(t, `
+class S { v: i64; }
+func main(): i32 {
+	delete local new S();
+	return 0;
+}
+`, "Cannot delete an instance on the stack")
+}
+
+func TestUserDeclaredAllocator(t *testing.T) {
+	expectOutput(t, `
+extern func malloc(size: i32): *i8;
+extern func free(p: *i64): void;
+class S { v: i64; }
+func main(): i32 {
+	var s = new S();
+	s.v = 5;
+	printf("%ld\n", s.v);
+	delete s;
+	var p: *i64 = (malloc(8)): *i64;
+	free(p);
+	return 0;
+}
+`, "5\n")
+}
@@ -0,0 +1,156 @@
+package compiler
+
+import (
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/enum"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+	"github.com/vyPal/CaffeineC/lib/parser"
+)
+
+// Every mutable variable lives in storage: an alloca, a global or a field.
+// `&x` returns that storage, so it can be written through by `*p = v` or by
+// C functions taking out-parameters. Parameters are values, they are copied
+// into a stack slot the first time their address is taken.
+
+// addressOf returns the address of the variable `v`.
+func (ctx *Context) addressOf(v *Variable, pos lexer.Position) (value.Value, error) {
+	if v.Constant {
+		return nil, posError(pos, "Cannot take the address of constant %s", v.Name)
+	}
+	if ptrType, ok := v.Value.Type().(*types.PointerType); ok && isStorage(v.Value) && ptrType.ElemType.Equal(v.Type) {
+		return v.Value, nil
+	}
+	if param, ok := v.Value.(*ir.Param); ok {
+		return ctx.spillParam(param).Value, nil
+	}
+	return nil, posError(pos, "Cannot take the address of %s", v.Name)
+}
+
+// spillParam copies `param` into a stack slot at the start of the function
+// and makes the slot the variable the parameter's name refers to.
+func (ctx *Context) spillParam(param *ir.Param) *Variable {
+	root := ctx
+	for root.parent != nil && root.parent.Block != nil && root.parent.Block.Parent == ctx.Block.Parent {
+		root = root.parent
+	}
+
+	entry := ctx.Block.Parent.Blocks[0]
+	alloc := ir.NewAlloca(param.Type())
+	entry.Insts = append([]ir.Instruction{alloc, ir.NewStore(param, alloc)}, entry.Insts...)
+
+	variable := &Variable{
+		Name:  param.Name(),
+		Type:  param.Type(),
+		Value: alloc,
+	}
+	root.vars[param.Name()] = variable
+	return variable
+}
+
+// slotValue loads the pointer held by the stack slot of a pointer variable.
+func (ctx *Context) slotValue(v value.Value) value.Value {
+	if ptrType, ok := v.Type().(*types.PointerType); ok && isStorage(v) {
+		if elemType, ok := ptrType.ElemType.(*types.PointerType); ok {
+			return ctx.NewLoad(elemType, v)
+		}
+	}
+	return v
+}
+
+// variableValue returns the current value of the variable `v`.
+func (ctx *Context) variableValue(v *Variable) value.Value {
+	if ptrType, ok := v.Value.Type().(*types.PointerType); ok && isStorage(v.Value) && ptrType.ElemType.Equal(v.Type) {
+		return ctx.NewLoad(v.Type, v.Value)
+	}
+	return v.Value
+}
+
+// dereference loads the value `v` points to `count` times.
+func (ctx *Context) dereference(v value.Value, count int, pos lexer.Position) (value.Value, error) {
+	for j := 0; j < count; j++ {
+		ptrType, ok := v.Type().(*types.PointerType)
+		if !ok {
+			return nil, posError(pos, "Cannot dereference a value of type %s", ctx.TypeToString(v.Type()))
+		}
+		v = ctx.NewLoad(ptrType.ElemType, v)
+	}
+	return v, nil
+}
+
+// compileDerefTarget compiles the pointer written to by an assignment like `*p = v`.
+func (ctx *Context) compileDerefTarget(ident *parser.Identifier) (*assignTarget, error) {
+	pointee := *ident
+	pointee.Deref = ident.Deref[1:]
+	ptr, err := ctx.compileFactor(&parser.Factor{Pos: ident.Pos, Identifier: &pointee})
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ptr.Type().(*types.PointerType); !ok {
+		return nil, posError(ident.Pos, "Cannot dereference a value of type %s", ctx.TypeToString(ptr.Type()))
+	}
+	return &assignTarget{Name: "*" + ident.Name, Value: ptr, Type: ptr.Type(), Address: true}, nil
+}
+
+// compilePointerArithmetic compiles `p + n`, `n + p` and `p - n`, which move
+// the pointer by whole elements, and `p - q`, the number of elements between
+// two pointers. It reports false if neither operand is a pointer.
+func (ctx *Context) compilePointerArithmetic(left value.Value, right value.Value, op string, pos lexer.Position) (value.Value, bool, error) {
+	leftPtr, leftIsPtr := left.Type().(*types.PointerType)
+	rightPtr, rightIsPtr := right.Type().(*types.PointerType)
+	_, leftIsInt := left.Type().(*types.IntType)
+	_, rightIsInt := right.Type().(*types.IntType)
+
+	switch {
+	case leftIsPtr && rightIsInt:
+		offset := ctx.resizeInt(right, types.I64)
+		if op == "-" {
+			offset = ctx.NewSub(constant.NewInt(types.I64, 0), offset)
+		}
+		return ctx.NewGetElementPtr(leftPtr.ElemType, left, offset), true, nil
+	case leftIsInt && rightIsPtr && op == "+":
+		return ctx.NewGetElementPtr(rightPtr.ElemType, right, ctx.resizeInt(left, types.I64)), true, nil
+	case leftIsPtr && rightIsPtr && op == "-":
+		if !left.Type().Equal(right.Type()) {
+			return nil, false, posError(pos, "Cannot subtract pointers of different types (%s and %s)", ctx.TypeToString(left.Type()), ctx.TypeToString(right.Type()))
+		}
+		diff := ctx.NewSub(ctx.NewPtrToInt(left, types.I64), ctx.NewPtrToInt(right, types.I64))
+		elems := ctx.NewSDiv(diff, sizeOf(leftPtr.ElemType))
+		elems.Exact = true
+		return elems, true, nil
+	case leftIsPtr || rightIsPtr:
+		return nil, false, posError(pos, "Invalid operands for %s: %s and %s", op, ctx.TypeToString(left.Type()), ctx.TypeToString(right.Type()))
+	}
+	return nil, false, nil
+}
+
+// pointerPredicate returns the comparison used for the relational operator `op` on pointers.
+func pointerPredicate(op string) enum.IPred {
+	switch op {
+	case "<":
+		return enum.IPredULT
+	case "<=":
+		return enum.IPredULE
+	case ">":
+		return enum.IPredUGT
+	default:
+		return enum.IPredUGE
+	}
+}
+
+// nullOperands gives a null operand of a comparison the pointer type of the
+// other operand, and reports whether either operand is null. Comparisons with
+// null are always done on addresses, even for classes that overload them.
+func nullOperands(left value.Value, right value.Value) (value.Value, value.Value, bool) {
+	_, leftNull := left.(*constant.Null)
+	_, rightNull := right.(*constant.Null)
+	if ptrType, ok := right.Type().(*types.PointerType); ok && leftNull {
+		left = constant.NewNull(ptrType)
+	}
+	if ptrType, ok := left.Type().(*types.PointerType); ok && rightNull {
+		right = constant.NewNull(ptrType)
+	}
+	return left, right, leftNull || rightNull
+}
@@ -0,0 +1,33 @@
+package compiler
+
+import "testing"
+
+func TestPointers(t *testing.T) {
+	expectOutput(t, `
+class S { v: i64; }
+func setp(p: *i64) { *p = 42; }
+func main(): i32 {
+	var x: i64 = 1;
+	var p = &x;
+	*p = 7;
+	printf("x=%ld\n", x);
+	var s = new S();
+	setp(&s.v);
+	var arr: [4]i64 = [10, 20, 30, 40];
+	var a0 = &arr[0];
+	var a2 = a0 + 2;
+	printf("s.v=%ld a2=%ld diff=%ld lt=%d\n", s.v, *a2, a2 - a0, a0 < a2);
+	var pp = &p;
+	**pp = 99;
+	printf("x=%ld\n", x);
+	return 0;
+}
+`, "x=7\ns.v=42 a2=30 diff=2 lt=1\nx=99\n")
+	expectError(t, `
+func main(): i32 {
+	var x: i64 = 1;
+	var y = *x;
+	return 0;
+}
+`, "Cannot dereference a value of type i64")
+}
@@ -3,6 +3,7 @@ package compiler
 import (
 	"strings"
 
+	"github.com/alecthomas/participle/v2/lexer"
 	"github.com/fatih/color"
 	"github.com/llir/llvm/ir"
 	"github.com/llir/llvm/ir/constant"
@@ -14,6 +15,13 @@ import (
 )
 
 func (ctx *Context) compileStatement(s *parser.Statement) error {
+	if ctx.Block != nil && ctx.Term != nil {
+		// Code after a return, break or continue can never run, but it is
+		// still compiled into a block without predecessors so it gets checked
+		posWarning(s.Pos, "Unreachable code")
+		ctx.Block = ctx.Block.Parent.NewBlock("")
+	}
+
 	if s.VariableDefinition != nil {
 		_, _, _, err := ctx.compileVariableDefinition(s.VariableDefinition)
 		return err
@@ -25,27 +33,50 @@ func (ctx *Context) compileStatement(s *parser.Statement) error {
 	} else if s.ClassDefinition != nil {
 		_, _, _, err := ctx.compileClassDefinition(s.ClassDefinition)
 		return err
+	} else if s.InterfaceDefinition != nil {
+		return ctx.compileInterfaceDefinition(s.InterfaceDefinition)
+	} else if s.EnumDefinition != nil {
+		return ctx.compileEnumDefinition(s.EnumDefinition)
+	} else if s.UnionDefinition != nil {
+		return ctx.compileUnionDefinition(s.UnionDefinition)
 	} else if s.If != nil {
 		return ctx.compileIf(s.If)
 	} else if s.For != nil {
-		return ctx.compileFor(s.For)
+		return ctx.compileFor(s.For, "")
 	} else if s.While != nil {
-		return ctx.compileWhile(s.While)
+		return ctx.compileWhile(s.While, "")
 	} else if s.Until != nil {
-		return ctx.compileUntil(s.Until)
+		return ctx.compileUntil(s.Until, "")
+	} else if s.Labeled != nil {
+		if s.Labeled.For != nil {
+			return ctx.compileFor(s.Labeled.For, s.Labeled.Label)
+		} else if s.Labeled.While != nil {
+			return ctx.compileWhile(s.Labeled.While, s.Labeled.Label)
+		}
+		return ctx.compileUntil(s.Labeled.Until, s.Labeled.Label)
+	} else if s.Switch != nil {
+		return ctx.compileSwitch(s.Switch)
 	} else if s.Return != nil {
 		return ctx.compileReturn(s.Return)
+	} else if s.Throw != nil {
+		return ctx.compileThrow(s.Throw)
+	} else if s.Delete != nil {
+		return ctx.compileDelete(s.Delete)
+	} else if s.Defer != nil {
+		return ctx.compileDefer(s.Defer)
+	} else if s.TryCatch != nil {
+		return ctx.compileTryCatch(s.TryCatch)
 	} else if s.Break != nil {
-		ctx.NewBr(ctx.fc.Leave)
+		return ctx.compileBreak(s.Break)
 	} else if s.Continue != nil {
-		ctx.NewBr(ctx.fc.Continue)
+		return ctx.compileContinue(s.Continue)
 	} else if s.Expression != nil {
 		_, err := ctx.compileExpression(s.Expression)
 		return err
 	} else if s.FieldDefinition != nil {
 		return posError(s.FieldDefinition.Pos, "Field definitions are not allowed outside of classes")
 	} else if s.External != nil {
-		ctx.compileExternalFunction(s.External)
+		return ctx.compileExternalFunction(s.External)
 	} else if s.Import != nil {
 		return ctx.Compiler.ImportAll(s.Import.Package, ctx)
 	} else if s.FromImport != nil {
@@ -61,6 +92,14 @@ func (ctx *Context) compileStatement(s *parser.Statement) error {
 		}
 		ctx.Compiler.ImportAs(s.FromImportMultiple.Package, symbols, ctx)
 	} else if s.Export != nil {
+		if v := s.Export.VariableDefinition; v != nil {
+			// Importers declare the variable from its definition, so they need its type
+			for _, b := range variableBindings(v) {
+				if b.Type == nil {
+					return posError(b.Pos, "Exported variable %s must have an explicit type", b.Name)
+				}
+			}
+		}
 		return ctx.compileStatement(s.Export)
 	} else if s.Comment != nil {
 		return nil
@@ -68,7 +107,46 @@ func (ctx *Context) compileStatement(s *parser.Statement) error {
 	return nil
 }
 
-func (ctx *Context) compileExternalFunction(v *parser.ExternalFunctionDefinition) {
+// compileBody compiles the statements of a block. The statements deferred in
+// the block run when control reaches its end.
+func (ctx *Context) compileBody(stmts []*parser.Statement) error {
+	outer := ctx.cleanup
+	for _, stmt := range stmts {
+		if err := ctx.compileStatement(stmt); err != nil {
+			return err
+		}
+	}
+	err := ctx.runCleanups(outer)
+	ctx.cleanup = outer
+	return err
+}
+
+// compileDefer schedules a statement to run whenever control leaves the
+// enclosing block, after the value of a return statement has been computed.
+// Deferred statements run in the reverse order of their definitions.
+func (ctx *Context) compileDefer(d *parser.Defer) error {
+	s := d.Statement
+	if s.Return != nil || s.Break != nil || s.Continue != nil || s.Labeled != nil || s.Defer != nil {
+		return posError(d.Statement.Pos, "This statement cannot be deferred")
+	}
+
+	ctx.cleanup = &Cleanup{
+		parent: ctx.cleanup,
+		Emit: func(c *Context) error {
+			// Names refer to the variables visible where the statement was deferred
+			dctx := ctx.NewContext(c.Block)
+			dctx.cleanup = c.cleanup
+			if err := dctx.compileStatement(s); err != nil {
+				return err
+			}
+			c.Block = dctx.Block
+			return nil
+		},
+	}
+	return nil
+}
+
+func (ctx *Context) compileExternalFunction(v *parser.ExternalFunctionDefinition) error {
 	var retType types.Type
 	if len(v.ReturnType) == 0 {
 		retType = types.Void
@@ -82,36 +160,83 @@ func (ctx *Context) compileExternalFunction(v *parser.ExternalFunctionDefinition
 
 	v.Name = strings.Trim(v.Name, "\"")
 
+	// The function might have already been declared by an import or the runtime
+	if fn, exists := ctx.lookupFunction(v.Name); exists {
+		var paramTypes []types.Type
+		for _, arg := range args {
+			paramTypes = append(paramTypes, arg.Type())
+		}
+		sig := types.NewFunc(retType, paramTypes...)
+		sig.Variadic = v.Variadic
+		if !fn.Sig.Equal(sig) {
+			return posError(v.Pos, "Function %s is already declared as %s", v.Name, ctx.funcTypeString("func", fn.Sig))
+		}
+		return nil
+	}
+
 	fn := ctx.Module.NewFunc(v.Name, retType, args...)
 	fn.Sig.Variadic = v.Variadic
+	return nil
 }
 
 func (ctx *Context) compileVariableDefinition(v *parser.VariableDefinition) (Name string, Type types.Type, Value value.Value, Err error) {
-	// If there is no assignment, create an uninitialized variable
-	valType := ctx.CFTypeToLLType(v.Type)
+	// File-scope variables aren't inside a function
+	if ctx.Block == nil {
+		return ctx.compileGlobalDefinition(v)
+	}
+
+	if len(v.Rest) > 0 {
+		return ctx.compileUnpackingDefinition(v)
+	}
+
+	// Without a type, the variable takes the type of its initializer
+	var valType types.Type
+	var inferred value.Value
+	if v.Type == nil {
+		val, err := ctx.compileInferredInitializer(v.Name, v.Pos, v.Assignment)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		inferred = val
+		valType = val.Type()
+	} else {
+		valType = ctx.CFTypeToLLType(v.Type)
+	}
+
+	initializer := func(requested types.Type) (value.Value, error) {
+		if inferred != nil {
+			return inferred, nil
+		}
+		ctx.RequestedType = requested
+		defer func() { ctx.RequestedType = nil }()
+		return ctx.compileExpression(v.Assignment)
+	}
 
 	if v.Constant == "const" {
 		if v.Assignment == nil {
 			return "", nil, nil, posError(v.Pos, "Constant definition must have assignment")
 		}
 
-		cVal, err := ctx.compileExpression(v.Assignment)
+		cVal, err := initializer(nil)
 		if err != nil {
 			return "", nil, nil, err
 		}
 
 		ctx.vars[v.Name] = &Variable{
-			Name:  v.Name,
-			Type:  valType,
-			Value: cVal,
+			Name:     v.Name,
+			Type:     valType,
+			Value:    cVal,
+			Constant: true,
 		}
 
 		return v.Name, valType, cVal, nil
 	}
 
+	// If there is no assignment, create an uninitialized variable
 	if v.Assignment == nil {
 		alloc := ctx.NewAlloca(valType)
 		ctx.NewStore(constant.NewZeroInitializer(valType), alloc)
+		ctx.initInstances(alloc, valType)
 		ctx.vars[v.Name] = &Variable{
 			Name:  v.Name,
 			Type:  valType,
@@ -120,28 +245,14 @@ func (ctx *Context) compileVariableDefinition(v *parser.VariableDefinition) (Nam
 		return v.Name, alloc.Type(), alloc, nil
 	}
 
-	if _, isPointer := valType.(*types.PointerType); isPointer && v.Assignment != nil {
-		val, err := ctx.compileExpression(v.Assignment)
-		if err != nil {
-			return "", nil, nil, err
-		}
-		ctx.vars[v.Name] = &Variable{
-			Name:  v.Name,
-			Type:  valType,
-			Value: val,
-		}
-		return v.Name, valType, val, nil
-	}
-
-	ctx.RequestedType = valType
-	val, err := ctx.compileExpression(v.Assignment)
+	val, err := initializer(valType)
 	if err != nil {
 		return "", nil, nil, err
 	}
-	ctx.RequestedType = nil
 
+	// Pointers get a stack slot too, so they can be reassigned and have their address taken
 	ptr, ok := val.(*ir.InstAlloca)
-	if ok {
+	if _, isPointer := valType.(*types.PointerType); ok && !isPointer {
 		ctx.vars[v.Name] = &Variable{
 			Name:  v.Name,
 			Type:  valType,
@@ -150,8 +261,16 @@ func (ctx *Context) compileVariableDefinition(v *parser.VariableDefinition) (Nam
 		return v.Name, ptr.Type(), ptr, nil
 	}
 
-	alloc := ctx.NewAlloca(val.Type())
-	ctx.NewStore(val, alloc)
+	converted, ok := ctx.convertValue(val, valType)
+	if !ok {
+		return "", nil, nil, posError(v.Assignment.Pos, "Cannot initialize %s of type %s with a value of type %s", v.Name, ctx.TypeToString(valType), ctx.TypeToString(val.Type()))
+	}
+
+	alloc := ctx.NewAlloca(valType)
+	ctx.NewStore(converted, alloc)
+	if _, ok := val.(*ir.InstAlloca); ok {
+		ctx.Compiler.localInstances[alloc] = true
+	}
 	ctx.vars[v.Name] = &Variable{
 		Name:  v.Name,
 		Type:  valType,
@@ -160,27 +279,324 @@ func (ctx *Context) compileVariableDefinition(v *parser.VariableDefinition) (Nam
 	return v.Name, alloc.Type(), alloc, nil
 }
 
-func (ctx *Context) compileAssignment(a *parser.Assignment) (Err error) {
-	type Ident struct {
-		Value value.Value
-		Type  types.Type
+// compileInferredInitializer compiles the initializer of a variable defined
+// without a type. Literals default to i64 and f64.
+func (ctx *Context) compileInferredInitializer(name string, pos lexer.Position, e *parser.Expression) (value.Value, error) {
+	if e == nil {
+		return nil, posError(pos, "Cannot infer the type of %s without an assignment", name)
+	}
+
+	// Nothing is requested, so literals keep their default types
+	requested := ctx.RequestedType
+	ctx.RequestedType = nil
+	val, err := ctx.compileExpression(e)
+	ctx.RequestedType = requested
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := val.(*constant.Null); ok {
+		return nil, posError(e.Pos, "Cannot infer the type of %s from null", name)
+	} else if val.Type().Equal(types.Void) {
+		return nil, posError(e.Pos, "Cannot infer the type of %s from an expression without a value", name)
+	} else if structType, ok := val.Type().(*types.StructType); ok && structType.Name() == "" && !ctx.isClosure(structType) {
+		return nil, posError(e.Pos, "Cannot assign %d values to the single variable %s", len(structType.Fields), name)
+	}
+	return val, nil
+}
+
+// compileUnpackingDefinition defines several variables at once, each holding
+// one of the values returned by the assigned function call.
+func (ctx *Context) compileUnpackingDefinition(v *parser.VariableDefinition) (Name string, Type types.Type, Value value.Value, Err error) {
+	bindings := variableBindings(v)
+
+	if v.Assignment == nil {
+		if v.Constant == "const" {
+			return "", nil, nil, posError(v.Pos, "Constant definition must have assignment")
+		}
+		for _, b := range bindings {
+			if b.Type == nil {
+				return "", nil, nil, posError(b.Pos, "Cannot infer the type of %s without an assignment", b.Name)
+			}
+			valType := ctx.CFTypeToLLType(b.Type)
+			alloc := ctx.NewAlloca(valType)
+			ctx.NewStore(constant.NewZeroInitializer(valType), alloc)
+			ctx.initInstances(alloc, valType)
+			ctx.vars[b.Name] = &Variable{
+				Name:  b.Name,
+				Type:  valType,
+				Value: alloc,
+			}
+		}
+		return v.Name, nil, nil, nil
+	}
+
+	vals, err := ctx.compileUnpacking(v.Assignment, bindings)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	for i, b := range bindings {
+		valType := vals[i].Type()
+		if v.Constant == "const" {
+			ctx.vars[b.Name] = &Variable{
+				Name:     b.Name,
+				Type:     valType,
+				Value:    vals[i],
+				Constant: true,
+			}
+			continue
+		}
+
+		alloc := ctx.NewAlloca(valType)
+		ctx.NewStore(vals[i], alloc)
+		ctx.vars[b.Name] = &Variable{
+			Name:  b.Name,
+			Type:  valType,
+			Value: alloc,
+		}
+	}
+	return v.Name, nil, nil, nil
+}
+
+// compileUnpacking compiles an expression returning multiple values and
+// converts each of them to the type of its binding.
+func (ctx *Context) compileUnpacking(e *parser.Expression, bindings []*parser.VariableBinding) ([]value.Value, error) {
+	val, err := ctx.compileExpression(e)
+	if err != nil {
+		return nil, err
+	}
+
+	structType, ok := val.Type().(*types.StructType)
+	if !ok || structType.Name() != "" || ctx.isClosure(structType) {
+		return nil, posError(e.Pos, "Cannot assign non-struct value to multiple variables")
+	}
+	if len(structType.Fields) != len(bindings) {
+		return nil, posError(e.Pos, "Unable to unpack %d values into %d variables", len(structType.Fields), len(bindings))
+	}
+
+	vals := make([]value.Value, len(bindings))
+	for i, b := range bindings {
+		field := ctx.NewExtractValue(val, uint64(i))
+		if b.Type == nil {
+			// Without a type, the variable takes the type of the returned value
+			vals[i] = field
+			continue
+		}
+
+		valType := ctx.CFTypeToLLType(b.Type)
+		converted, ok := ctx.convertValue(field, valType)
+		if !ok {
+			return nil, posError(b.Pos, "Cannot assign value %d of type %s to %s of type %s", i+1, ctx.TypeToString(field.Type()), b.Name, ctx.TypeToString(valType))
+		}
+		vals[i] = converted
+	}
+	return vals, nil
+}
+
+// assignTarget is something a value can be assigned to: a variable, a field,
+// an element, a property with a setter or an overloaded index operator.
+type assignTarget struct {
+	Name   string
+	Value  value.Value
+	Type   types.Type
+	Object value.Value
+	Getter *ir.Func
+	Setter *ir.Func
+	Index  value.Value
+	// Address is set when Value is a pointer being written through
+	Address bool
+}
+
+// addressed reports whether the target is stored to through its Value.
+func (t *assignTarget) addressed() bool {
+	return t.Address || isStorage(t.Value)
+}
+
+// valueType is the type of the values that can be assigned to the target.
+func (t *assignTarget) valueType() types.Type {
+	if t.Setter != nil {
+		return t.Setter.Sig.Params[1]
+	}
+	if ptrType, ok := t.Type.(*types.PointerType); ok && t.addressed() {
+		return ptrType.ElemType
+	}
+	return t.Type
+}
+
+func (ctx *Context) compileAssignTarget(ident *parser.Identifier) (*assignTarget, error) {
+	// Find the last field in the chain, it might be a property
+	last := ident.Sub
+	for last != nil && last.Sub != nil {
+		last = last.Sub
+	}
+	// Static fields are accessed through the class name and can't be properties
+	isStatic := ident.Sub != nil && ctx.lookupVariable(ident.Name) == nil
+	if ident.Ref == "" && ident.Deref == "" && !isStatic {
+		if last == nil && ident.GEP != nil {
+			if v := ctx.lookupVariable(ident.Name); v != nil {
+				if className, obj, ok := ctx.indexableClass(v.Value, "[]="); ok {
+					return ctx.compileIndexTarget(className, obj, ident.GEP)
+				}
+			}
+		} else if last != nil {
+			return ctx.compileMemberTarget(ident, last)
+		}
+	}
+
+	if ident.Deref != "" && ident.Ref == "" {
+		return ctx.compileDerefTarget(ident)
+	}
+
+	if last == nil && ident.GEP == nil && ident.Deref == "" {
+		if v := ctx.lookupVariable(ident.Name); v != nil && v.Constant {
+			return nil, posError(ident.Pos, "Cannot assign to constant %s", ident.Name)
+		}
+	}
+
+	val, t, err := ctx.compileIdentifier(ident, false)
+	if err != nil {
+		return nil, err
+	}
+	delete(ctx.Compiler.localInstances, val)
+	return &assignTarget{Name: ident.Name, Value: val, Type: t}, nil
+}
+
+// compileMemberTarget compiles an assignment to the field `last`, which ends the chain of `ident`.
+func (ctx *Context) compileMemberTarget(ident *parser.Identifier, last *parser.Identifier) (*assignTarget, error) {
+	// Compile everything before the last field to get the object it belongs to
+	parent := &parser.Identifier{Pos: ident.Pos, Name: ident.Name, GEP: ident.GEP}
+	tail := parent
+	for sub := ident.Sub; sub != last; sub = sub.Sub {
+		tail.Sub = &parser.Identifier{Pos: sub.Pos, Name: sub.Name, GEP: sub.GEP}
+		tail = tail.Sub
+	}
+	obj, _, err := ctx.compileIdentifier(parent, true)
+	if err != nil {
+		return nil, err
+	}
+
+	objName := ""
+	if parent.Sub == nil {
+		objName = parent.Name
+	}
+	obj = ctx.slotValue(obj)
+	objVar := &Variable{Name: objName, Type: obj.Type(), Value: obj}
+
+	className, _ := classOf(obj.Type())
+	field := ctx.lookupField(className, last.Name)
+	if field == nil && className != "" {
+		getter, setter, isProperty := ctx.lookupProperty(className, last.Name)
+		if isProperty && last.GEP == nil {
+			if setter == nil {
+				return nil, posError(last.Pos, "Property %s of class %s is read-only", last.Name, className)
+			}
+			if err := ctx.checkAccess(className, last.Name, ctx.PrivateMethods[setter.Name()], objName == "this", last.Pos); err != nil {
+				return nil, err
+			}
+			return &assignTarget{Name: last.Name, Object: obj, Getter: getter, Setter: setter, Type: setter.Sig.Params[1]}, nil
+		}
+	}
+
+	if field != nil && last.GEP != nil {
+		// The field might hold a class instance that overloads indexing
+		if fieldClass, ok := classOf(ctx.fieldType(className, field)); ok && ctx.hasOperator(fieldClass, "[]=") {
+			fieldType, fieldPtr, _, err := ctx.compileSubIdentifier(objVar, &parser.Identifier{Pos: last.Pos, Name: last.Name})
+			if err != nil {
+				return nil, err
+			}
+			return ctx.compileIndexTarget(fieldClass, ctx.NewLoad(fieldType.(*types.PointerType).ElemType, fieldPtr), last.GEP)
+		}
 	}
-	var idents = make([]Ident, len(a.Idents))
+
+	_, fieldPtr, _, err := ctx.compileSubIdentifier(objVar, last)
+	if err != nil {
+		return nil, err
+	}
+	return &assignTarget{Name: last.Name, Value: fieldPtr, Type: fieldPtr.Type()}, nil
+}
+
+// compileIndexTarget compiles an assignment through the `[]=` operator of `obj`.
+func (ctx *Context) compileIndexTarget(className string, obj value.Value, index *parser.Expression) (*assignTarget, error) {
+	idx, err := ctx.compileExpression(index)
+	if err != nil {
+		return nil, err
+	}
+
+	// The getter decides the element type, if there is one
+	var elemType types.Type
+	if getter, _, ok := ctx.lookupOperator(className, "[]", []value.Value{idx}); ok {
+		elemType = getter.Sig.RetType
+	}
+	return &assignTarget{Name: className + "[]", Object: obj, Index: idx, Type: elemType}, nil
+}
+
+// loadTarget returns the current value of the target.
+func (ctx *Context) loadTarget(t *assignTarget, pos lexer.Position) (value.Value, error) {
+	if t.Index != nil {
+		v, _, err := ctx.compileOperatorOverload(t.Object, "[]", pos, t.Index)
+		return v, err
+	}
+	if t.Setter != nil {
+		if t.Getter == nil {
+			return nil, posError(pos, "Property %s is write-only", t.Name)
+		}
+		return ctx.NewCall(t.Getter, t.Object), nil
+	}
+	if t.addressed() {
+		return ctx.NewLoad(t.Type.(*types.PointerType).ElemType, t.Value), nil
+	}
+	return t.Value, nil
+}
+
+// storeTarget assigns a new value to the target.
+func (ctx *Context) storeTarget(t *assignTarget, v value.Value, pos lexer.Position) error {
+	if t.Index != nil {
+		_, _, err := ctx.compileOperatorOverload(t.Object, "[]=", pos, t.Index, v)
+		return err
+	}
+
+	if t.Setter != nil || t.addressed() {
+		converted, ok := ctx.convertValue(v, t.valueType())
+		if !ok {
+			return posError(pos, "Cannot assign a value of type %s to %s of type %s", ctx.TypeToString(v.Type()), t.Name, ctx.TypeToString(t.valueType()))
+		}
+		v = converted
+	}
+
+	if t.Setter != nil {
+		ctx.NewCall(t.Setter, t.Object, v)
+	} else if t.addressed() {
+		ctx.NewStore(v, t.Value)
+	} else {
+		ctx.vars[t.Name] = &Variable{
+			Name:  t.Name,
+			Type:  t.Type,
+			Value: v,
+		}
+	}
+	return nil
+}
+
+func (ctx *Context) compileAssignment(a *parser.Assignment) (Err error) {
+	var idents = make([]*assignTarget, len(a.Idents))
 
 	for index, ident := range a.Idents {
-		i, t, err := ctx.compileIdentifier(ident, false)
+		target, err := ctx.compileAssignTarget(ident)
 		if err != nil {
 			return err
 		}
 
-		if a.Op != "=" && !isNumeric(t) {
+		if a.Op != "=" && !isNumeric(target.Type) {
 			return posError(ident.Pos, "Numeric operator used on non-numeric identifier %s", ident.Name)
 		}
 
-		idents[index] = Ident{Value: i, Type: t}
+		idents[index] = target
 	}
 
-	ctx.RequestedType = idents[0].Type
+	if len(idents) == 1 {
+		ctx.RequestedType = idents[0].valueType()
+	}
 	val, err := ctx.compileExpression(a.Right)
 	if err != nil {
 		return err
@@ -193,87 +609,84 @@ func (ctx *Context) compileAssignment(a *parser.Assignment) (Err error) {
 		}
 
 		for i, ident := range idents {
-			_, isFloat := ident.Value.Type().(*types.FloatType)
+			cur, err := ctx.loadTarget(ident, a.Idents[i].Pos)
+			if err != nil {
+				return err
+			}
+
+			cur, val, err := ctx.promoteOperands(cur, val, a.Right.Pos)
+			if err != nil {
+				return err
+			}
+
+			_, isFloat := cur.Type().(*types.FloatType)
+			unsigned := ctx.isUnsigned(cur.Type())
 			var v value.Value
 			switch a.Op {
 			case "+=":
 				if isFloat {
-					v = ctx.NewFAdd(ident.Value, val)
+					v = ctx.NewFAdd(cur, val)
 				} else {
-					v = ctx.NewAdd(ident.Value, val)
+					v = ctx.NewAdd(cur, val)
 				}
 			case "-=":
 				if isFloat {
-					v = ctx.NewFSub(ident.Value, val)
+					v = ctx.NewFSub(cur, val)
 				} else {
-					v = ctx.NewSub(ident.Value, val)
+					v = ctx.NewSub(cur, val)
 				}
 			case "*=":
 				if isFloat {
-					v = ctx.NewFMul(ident.Value, val)
+					v = ctx.NewFMul(cur, val)
 				} else {
-					v = ctx.NewMul(ident.Value, val)
+					v = ctx.NewMul(cur, val)
 				}
 			case "/=":
 				if isFloat {
-					v = ctx.NewFDiv(ident.Value, val)
+					v = ctx.NewFDiv(cur, val)
+				} else if unsigned {
+					v = ctx.NewUDiv(cur, val)
 				} else {
-					v = ctx.NewSDiv(ident.Value, val)
+					v = ctx.NewSDiv(cur, val)
 				}
 			case "%=":
 				if isFloat {
 					return posError(a.Pos, "Modulus operator not allowed on float")
 				}
-				v = ctx.NewSRem(ident.Value, val)
+				if unsigned {
+					v = ctx.NewURem(cur, val)
+				} else {
+					v = ctx.NewSRem(cur, val)
+				}
 			case "&=":
-				v = ctx.NewAnd(ident.Value, val)
+				v = ctx.NewAnd(cur, val)
 			case "|=":
-				v = ctx.NewOr(ident.Value, val)
+				v = ctx.NewOr(cur, val)
 			case "^=":
-				v = ctx.NewXor(ident.Value, val)
+				v = ctx.NewXor(cur, val)
 			case "<<=":
-				v = ctx.NewShl(ident.Value, val)
+				v = ctx.NewShl(cur, val)
 			case ">>=":
-				v = ctx.NewLShr(ident.Value, val)
+				if unsigned {
+					v = ctx.NewLShr(cur, val)
+				} else {
+					v = ctx.NewAShr(cur, val)
+				}
 			case ">>>=":
-				v = ctx.NewAShr(ident.Value, val)
+				v = ctx.NewLShr(cur, val)
 			case "??=":
-				isNull := ctx.NewICmp(enum.IPredEQ, ident.Value, constant.NewNull(ident.Value.Type().(*types.PointerType)))
-				v = ctx.NewSelect(isNull, val, ident.Value)
+				isNull := ctx.NewICmp(enum.IPredEQ, cur, constant.NewNull(cur.Type().(*types.PointerType)))
+				v = ctx.NewSelect(isNull, val, cur)
 			}
 
-			ptr, ok := ident.Value.(*ir.InstGetElementPtr)
-			if !ok {
-				aptr, ok := ident.Value.(*ir.InstAlloca)
-				if !ok {
-					ctx.vars[a.Idents[i].Name] = &Variable{
-						Name:  a.Idents[i].Name,
-						Type:  ident.Type,
-						Value: v,
-					}
-				} else {
-					ctx.NewStore(v, aptr)
-				}
-			} else {
-				ctx.NewStore(v, ptr)
+			if err := ctx.storeTarget(ident, v, a.Idents[i].Pos); err != nil {
+				return err
 			}
 		}
 	} else {
 		if len(idents) == 1 {
-			ptr, ok := idents[0].Value.(*ir.InstGetElementPtr)
-			if !ok {
-				aptr, ok := idents[0].Value.(*ir.InstAlloca)
-				if !ok {
-					ctx.vars[a.Idents[0].Name] = &Variable{
-						Name:  a.Idents[0].Name,
-						Type:  idents[0].Type,
-						Value: val,
-					}
-				} else {
-					ctx.NewStore(val, aptr)
-				}
-			} else {
-				ctx.NewStore(val, ptr)
+			if err := ctx.storeTarget(idents[0], val, a.Idents[0].Pos); err != nil {
+				return err
 			}
 		} else {
 			if _, ok := val.Type().(*types.StructType); !ok {
@@ -285,20 +698,13 @@ func (ctx *Context) compileAssignment(a *parser.Assignment) (Err error) {
 			}
 
 			for i, ident := range idents {
-				ptr, ok := ident.Value.(*ir.InstGetElementPtr)
+				field := ctx.NewExtractValue(val, uint64(i))
+				converted, ok := ctx.convertValue(field, ident.valueType())
 				if !ok {
-					aptr, ok := ident.Value.(*ir.InstAlloca)
-					if !ok {
-						ctx.vars[a.Idents[i].Name] = &Variable{
-							Name:  a.Idents[i].Name,
-							Type:  ident.Type,
-							Value: ctx.NewExtractValue(val, uint64(i)),
-						}
-					} else {
-						ctx.NewStore(ctx.NewExtractValue(val, uint64(i)), aptr)
-					}
-				} else {
-					ctx.NewStore(ctx.NewExtractValue(val, uint64(i)), ptr)
+					return posError(a.Idents[i].Pos, "Cannot assign value %d of type %s to %s of type %s", i+1, ctx.TypeToString(field.Type()), a.Idents[i].Name, ctx.TypeToString(ident.valueType()))
+				}
+				if err := ctx.storeTarget(ident, converted, a.Idents[i].Pos); err != nil {
+					return err
 				}
 			}
 		}
@@ -308,33 +714,30 @@ func (ctx *Context) compileAssignment(a *parser.Assignment) (Err error) {
 }
 
 func (ctx *Context) compileFunctionDefinition(f *parser.FunctionDefinition) (Name string, ReturnType types.Type, Args []*ir.Param, err error) {
-	var params []*ir.Param
-	for _, arg := range f.Parameters {
-		params = append(params, ir.NewParam(arg.Name, ctx.CFTypeToLLType(arg.Type)))
+	if len(f.TypeParams) > 0 {
+		// Compiled for each instance
+		return f.Name.Name, nil, nil, nil
 	}
-	if f.Variadic != "" {
-		params = append(params, ir.NewParam(f.Variadic, types.I8Ptr))
+	fn := ctx.declareFunction(f)
+	if len(fn.Blocks) != 0 {
+		return "", nil, nil, posError(f.Pos, "Function `%s` is already defined", f.Name.Name)
 	}
+	retType := fn.Sig.RetType
+	params := fn.Params
 
-	retType := ctx.CFMultiTypeToLLType(f.ReturnType)
-
-	fn := ctx.Module.NewFunc(f.Name.Name, retType, params...)
-	if f.Variadic != "" {
-		fn.Sig.Variadic = true
-	}
 	block := fn.NewBlock("")
 	nctx := NewContext(block, ctx.Compiler)
-	ctx.SymbolTable[f.Name.Name] = fn
+	nctx.spillArrayParams(fn)
 
-	for _, stmt := range f.Body {
-		err := nctx.compileStatement(stmt)
-		if err != nil {
-			return "", nil, []*ir.Param{}, err
-		}
+	if err := nctx.compileBody(f.Body); err != nil {
+		return "", nil, []*ir.Param{}, err
 	}
 	if nctx.Term == nil {
 		if retType.Equal(types.Void) {
 			nctx.NewRet(nil)
+		} else if !isReachable(nctx.Block) {
+			// Every path already returned, e.g. from both branches of an if
+			nctx.NewUnreachable()
 		} else {
 			return "", nil, nil, posError(f.Pos, "Function `%s` does not return a value", f.Name.Name)
 		}
@@ -343,64 +746,146 @@ func (ctx *Context) compileFunctionDefinition(f *parser.FunctionDefinition) (Nam
 	return f.Name.Name, retType, params, nil
 }
 
+// declareFunction declares the function `f` without compiling its body.
+// It returns the existing declaration if the function was already declared.
+func (ctx *Context) declareFunction(f *parser.FunctionDefinition) *ir.Func {
+	if fn, ok := ctx.SymbolTable[f.Name.Name].(*ir.Func); ok {
+		return fn
+	}
+
+	var params []*ir.Param
+	for _, arg := range f.Parameters {
+		params = append(params, ir.NewParam(arg.Name, ctx.CFTypeToLLType(arg.Type)))
+	}
+	if f.Variadic != "" {
+		params = append(params, ir.NewParam(f.Variadic, types.I8Ptr))
+	}
+
+	fn := ctx.Module.NewFunc(f.Name.Name, ctx.CFMultiTypeToLLType(f.ReturnType), params...)
+	if f.Variadic != "" {
+		fn.Sig.Variadic = true
+	}
+	ctx.SymbolTable[f.Name.Name] = fn
+	return fn
+}
+
+// spillArrayParams copies arrays passed by value into local variables, so they can be indexed and modified.
+func (ctx *Context) spillArrayParams(fn *ir.Func) {
+	for _, param := range fn.Params {
+		if arrType, ok := param.Type().(*types.ArrayType); ok {
+			alloc := ctx.NewAlloca(arrType)
+			ctx.NewStore(param, alloc)
+			ctx.vars[param.Name()] = &Variable{
+				Name:  param.Name(),
+				Type:  arrType,
+				Value: alloc,
+			}
+		}
+	}
+}
+
 func (ctx *Context) compileClassDefinition(c *parser.ClassDefinition) (Name string, TypeDef *types.StructType, Methods []ir.Func, err error) {
-	classType := types.NewStruct()
-	classType.SetName(c.Name)
-	ctx.structNames[classType] = c.Name
-	ctx.Module.NewTypeDef(c.Name, classType)
+	if len(c.TypeParams) > 0 {
+		// Compiled for each instance
+		return c.Name, nil, nil, nil
+	}
+	classType := ctx.declareClass(c)
+	ctx.declareClassMembers(c)
+	if err := ctx.checkInheritance(c); err != nil {
+		return "", nil, []ir.Func{}, err
+	}
+	if err := ctx.checkImplements(c); err != nil {
+		return "", nil, []ir.Func{}, err
+	}
 	for _, s := range c.Body {
-		if s.FieldDefinition != nil {
-			classType.Fields = append(classType.Fields, ctx.CFTypeToLLType(s.FieldDefinition.Type))
-			ctx.Compiler.StructFields[c.Name] = append(ctx.Compiler.StructFields[c.Name], s.FieldDefinition)
-		} else if s.FunctionDefinition != nil {
+		if s.FunctionDefinition != nil {
 			err := ctx.compileClassMethodDefinition(s.FunctionDefinition, c.Name, classType)
 			if err != nil {
 				return "", nil, []ir.Func{}, err
 			}
 		}
 	}
+	if len(ctx.Compiler.virtuals[c.Name]) > 0 {
+		// Modules importing the class refer to its vtable
+		ctx.classVtable(c.Name)
+	}
 
 	return c.Name, classType, nil, nil
 }
 
-func (ctx *Context) compileClassMethodDefinition(f *parser.FunctionDefinition, cname string, ctype *types.StructType) error {
-	var params []*ir.Param
-	params = append(params, ir.NewParam("this", types.NewPointer(ctype)))
-	for _, arg := range f.Parameters {
-		params = append(params, ir.NewParam(arg.Name, ctx.CFTypeToLLType(arg.Type)))
+// declareClass registers the type of the class `c`. Its fields are added by declareClassMembers.
+func (ctx *Context) declareClass(c *parser.ClassDefinition) *types.StructType {
+	if t, ok := ctx.lookupClass(c.Name); ok {
+		if classType, ok := t.(*types.StructType); ok {
+			return classType
+		}
 	}
-	if f.Variadic != "" {
-		params = append(params, ir.NewParam(f.Variadic, types.I8Ptr))
+
+	classType := types.NewStruct()
+	classType.SetName(c.Name)
+	ctx.structNames[classType] = c.Name
+	ctx.Module.NewTypeDef(c.Name, classType)
+	return classType
+}
+
+// declareClassMembers adds the fields of the class `c` to its type and declares its static fields and methods.
+func (ctx *Context) declareClassMembers(c *parser.ClassDefinition) {
+	if ctx.Compiler.declaredClasses[c.Name] {
+		return
 	}
+	ctx.Compiler.declaredClasses[c.Name] = true
+	ctx.Compiler.implements[c.Name] = c.Implements
 
-	trimmed := strings.Trim(f.Name.Name, "\"")
-	ms := "." + f.Name.Name
-	if f.Name.Op {
-		ms = ".op." + trimmed
-	} else if f.Name.Get {
-		ms = ".get." + trimmed
-	} else if f.Name.Set {
-		ms = ".set." + trimmed
+	classType := ctx.declareClass(c)
+	ctx.inheritMembers(c, c.Name, classType)
+	for _, s := range c.Body {
+		if s.FieldDefinition != nil && s.FieldDefinition.Static {
+			global := ctx.declareStaticField(c.Name, c.Name, s.FieldDefinition)
+			global.Linkage = enum.LinkageNone
+			if !ctx.Compiler.exportedClasses[c] {
+				global.Linkage = enum.LinkageInternal
+			}
+			global.Init = constant.NewZeroInitializer(global.ContentType)
+		} else if s.FieldDefinition != nil {
+			classType.Fields = append(classType.Fields, ctx.CFTypeToLLType(s.FieldDefinition.Type))
+			ctx.Compiler.StructFields[c.Name] = append(ctx.Compiler.StructFields[c.Name], s.FieldDefinition)
+		} else if s.FunctionDefinition != nil {
+			ctx.declareClassMethod(s.FunctionDefinition, c.Name, classType)
+		}
 	}
+}
 
-	retType := ctx.CFMultiTypeToLLType(f.ReturnType)
+// declareStaticField declares the global that holds a static field, named after
+// its class `cname`. The field is used through `alias`, the name the class has
+// in the module.
+func (ctx *Context) declareStaticField(cname string, alias string, f *parser.FieldDefinition) *ir.Global {
+	global := ctx.Module.NewGlobal(cname+"."+f.Name, ctx.CFTypeToLLType(f.Type))
+	global.Linkage = enum.LinkageExternal
+	ctx.Compiler.StaticFields[alias+"."+f.Name] = f
+	ctx.Compiler.staticGlobals[alias+"."+f.Name] = &Variable{Name: global.Name(), Type: global.ContentType, Value: global}
+	return global
+}
 
-	fn := ctx.Module.NewFunc(cname+ms, retType, params...)
-	if f.Variadic != "" {
-		fn.Sig.Variadic = true
+func (ctx *Context) compileClassMethodDefinition(f *parser.FunctionDefinition, cname string, ctype *types.StructType) error {
+	fn := ctx.declareClassMethod(f, cname, ctype)
+	if len(fn.Blocks) != 0 {
+		return posError(f.Pos, "Method `%s` of class `%s` is already defined", f.Name.Name, cname)
 	}
+	retType := fn.Sig.RetType
+
 	block := fn.NewBlock("")
 	nctx := NewContext(block, ctx.Compiler)
-	ctx.SymbolTable[cname+ms] = fn
-	for _, stmt := range f.Body {
-		err := nctx.compileStatement(stmt)
-		if err != nil {
-			return err
-		}
+	nctx.className = cname
+	nctx.spillArrayParams(fn)
+	if err := nctx.compileBody(f.Body); err != nil {
+		return err
 	}
 	if nctx.Term == nil {
 		if retType.Equal(types.Void) {
 			nctx.NewRet(nil)
+		} else if !isReachable(nctx.Block) {
+			// Every path already returned, e.g. from both branches of an if
+			nctx.NewUnreachable()
 		} else {
 			cli.Exit(color.RedString("Error: Method `%s` of class `%s` does not return a value", f.Name, cname), 1)
 		}
@@ -409,67 +894,154 @@ func (ctx *Context) compileClassMethodDefinition(f *parser.FunctionDefinition, c
 	return nil
 }
 
-func (ctx *Context) compileIf(i *parser.If) error {
-	// Compile the condition
-	cond, err := ctx.compileExpression(i.Condition)
-	if err != nil {
-		return err
+// declareClassMethod declares the method `f` of the class `cname` without compiling its body.
+// It returns the existing declaration if the method was already declared.
+func (ctx *Context) declareClassMethod(f *parser.FunctionDefinition, cname string, ctype *types.StructType) *ir.Func {
+	ms := ctx.methodSuffix(f)
+	if fn, ok := ctx.SymbolTable[cname+ms].(*ir.Func); ok {
+		return fn
 	}
 
-	// Create blocks for the then, else and merge parts
-	thenBlock := ctx.Block.Parent.NewBlock("")
-	elseBlock := ctx.Block.Parent.NewBlock("")
-	mergeBlock := ctx.Block.Parent.NewBlock("")
+	var params []*ir.Param
+	if !f.Static {
+		params = append(params, ir.NewParam("this", types.NewPointer(ctype)))
+	}
+	for _, arg := range f.Parameters {
+		params = append(params, ir.NewParam(arg.Name, ctx.CFTypeToLLType(arg.Type)))
+	}
+	if f.Variadic != "" {
+		params = append(params, ir.NewParam(f.Variadic, types.I8Ptr))
+	}
 
-	// Create the conditional branch
-	ctx.Block.NewCondBr(cond, thenBlock, elseBlock)
+	fn := ctx.Module.NewFunc(cname+ms, ctx.CFMultiTypeToLLType(f.ReturnType), params...)
+	if f.Variadic != "" {
+		fn.Sig.Variadic = true
+	}
+	ctx.SymbolTable[cname+ms] = fn
+	if f.Private {
+		ctx.Compiler.PrivateMethods[cname+ms] = true
+	}
+	if f.Static {
+		ctx.Compiler.StaticMethods[cname+ms] = true
+	}
+	return fn
+}
 
-	// Compile the then part
-	ctx.Block = thenBlock
-	for _, stmt := range i.Body {
-		err := ctx.compileStatement(stmt)
-		if err != nil {
-			return err
+// declareStatements declares every class, field, function, method and global among `stmts`
+// before any body is compiled, so they can be used regardless of their order.
+func (ctx *Context) declareStatements(stmts []*parser.Statement) {
+	var classes []*parser.ClassDefinition
+	var interfaces []*parser.InterfaceDefinition
+	var enums []*parser.EnumDefinition
+	var unions []*parser.UnionDefinition
+	var functions []*parser.FunctionDefinition
+	var externals []*parser.ExternalFunctionDefinition
+	var globals []*parser.VariableDefinition
+	for _, s := range stmts {
+		if s.Export != nil {
+			if s.Export.VariableDefinition != nil {
+				ctx.Compiler.exportedGlobals[s.Export.VariableDefinition] = true
+			} else if s.Export.ClassDefinition != nil {
+				ctx.Compiler.exportedClasses[s.Export.ClassDefinition] = true
+			}
+			s = s.Export
+		}
+		if ctx.Compiler.registerGeneric(s, "") {
+			continue
+		}
+		if s.ClassDefinition != nil {
+			classes = append(classes, s.ClassDefinition)
+		} else if s.FunctionDefinition != nil {
+			functions = append(functions, s.FunctionDefinition)
+		} else if s.InterfaceDefinition != nil {
+			interfaces = append(interfaces, s.InterfaceDefinition)
+		} else if s.EnumDefinition != nil {
+			enums = append(enums, s.EnumDefinition)
+		} else if s.UnionDefinition != nil {
+			unions = append(unions, s.UnionDefinition)
+		} else if s.External != nil {
+			externals = append(externals, s.External)
+		} else if s.VariableDefinition != nil {
+			globals = append(globals, s.VariableDefinition)
 		}
 	}
-	if thenBlock.Term == nil {
-		thenBlock.NewBr(mergeBlock)
+
+	// The class, enum and union types come first, so fields and signatures can refer to any of them
+	for _, e := range enums {
+		ctx.declareEnum(e, e.Name)
+	}
+	for _, c := range classes {
+		ctx.declareClass(c)
+	}
+	for _, u := range unions {
+		ctx.declareUnion(u, u.Name)
+	}
+	for _, i := range interfaces {
+		ctx.declareInterface(i, i.Name)
 	}
+	for _, i := range interfaces {
+		ctx.declareInterfaceMethods(i, i.Name)
+	}
+	// Parents come before the classes extending them, which start with their fields
+	classes = sortByParent(classes)
+	for _, c := range classes {
+		ctx.declareClassMembers(c)
+	}
+	for _, u := range unions {
+		ctx.layoutUnion(ctx.Compiler.unions[u.Name])
+	}
+	for _, f := range functions {
+		ctx.declareFunction(f)
+	}
+	// Externals may redeclare the functions above, conflicting declarations
+	// are reported when the statements are compiled
+	for _, e := range externals {
+		ctx.compileExternalFunction(e)
+	}
+	for _, v := range globals {
+		ctx.declareGlobals(v)
+	}
+}
 
-	// Compile the else if parts
+func (ctx *Context) compileIf(i *parser.If) error {
+	conditions := []*parser.Expression{i.Condition}
+	bodies := [][]*parser.Statement{i.Body}
 	for _, elseif := range i.ElseIf {
-		cond, err := ctx.compileExpression(elseif.Condition)
+		conditions = append(conditions, elseif.Condition)
+		bodies = append(bodies, elseif.Body)
+	}
+
+	mergeBlock := ctx.Block.Parent.NewBlock("")
+
+	// Every condition is tested in the else block of the previous one
+	for n, condition := range conditions {
+		cond, err := ctx.compileExpression(condition)
 		if err != nil {
 			return err
 		}
-		newElseBlock := ctx.Block.Parent.NewBlock("")
-		ctx.Block = elseBlock
-		ctx.Block.NewCondBr(cond, thenBlock, newElseBlock)
-		ctx.Block = thenBlock
-		for _, stmt := range elseif.Body {
-			err := ctx.compileStatement(stmt)
-			if err != nil {
-				return err
-			}
+
+		thenBlock := ctx.Block.Parent.NewBlock("")
+		elseBlock := ctx.Block.Parent.NewBlock("")
+		ctx.NewCondBr(cond, thenBlock, elseBlock)
+
+		thenCtx := ctx.NewContext(thenBlock)
+		if err := thenCtx.compileBody(bodies[n]); err != nil {
+			return err
 		}
-		if thenBlock.Term == nil {
-			thenBlock.NewBr(mergeBlock)
+		if thenCtx.Term == nil {
+			thenCtx.NewBr(mergeBlock)
 		}
-		elseBlock = newElseBlock
+
+		ctx.Block = elseBlock
 	}
 
 	// Compile the else part
-	ctx.Block = elseBlock
-	if i.Else != nil {
-		for _, stmt := range i.Else {
-			err := ctx.compileStatement(stmt)
-			if err != nil {
-				return err
-			}
-		}
+	elseCtx := ctx.NewContext(ctx.Block)
+	if err := elseCtx.compileBody(i.Else); err != nil {
+		return err
 	}
-	if elseBlock.Term == nil {
-		elseBlock.NewBr(mergeBlock)
+	if elseCtx.Term == nil {
+		elseCtx.NewBr(mergeBlock)
 	}
 
 	// Continue with the merge block
@@ -477,49 +1049,46 @@ func (ctx *Context) compileIf(i *parser.If) error {
 	return nil
 }
 
-func (ctx *Context) compileFor(f *parser.For) error {
-	// Compile the initializer
-	if err := ctx.compileStatement(f.Initializer); err != nil {
+func (ctx *Context) compileFor(f *parser.For, label string) error {
+	// The initializer gets its own scope, so the loop variable doesn't leak out of the loop
+	forCtx := ctx.NewContext(ctx.Block)
+	if err := forCtx.compileStatement(f.Initializer); err != nil {
 		return err
 	}
 
-	// Create the loop and leave blocks
+	// Create the condition, body, increment and leave blocks
+	condB := ctx.Block.Parent.NewBlock("")
 	loopB := ctx.Block.Parent.NewBlock("")
+	incB := ctx.Block.Parent.NewBlock("")
 	leaveB := ctx.Block.Parent.NewBlock("")
-	loopCtx := ctx.NewContext(loopB)
+	forCtx.NewBr(condB)
 
-	// Compile the condition
-	cond, err := ctx.compileExpression(f.Condition)
+	// Compile the condition and branch to the loop or leave block based on it
+	forCtx.Block = condB
+	cond, err := forCtx.compileExpression(f.Condition)
 	if err != nil {
 		return err
 	}
+	forCtx.NewCondBr(cond, loopB, leaveB)
 
-	// Create a conditional branch to the loop or leave block based on the condition
-	ctx.Block.NewCondBr(cond, loopB, leaveB)
-
-	// Set the current block to the loop block
-	ctx.Compiler.Context.Block = loopB
-
-	// Compile the body of the loop
-	for _, stmt := range f.Body {
-		if err := loopCtx.compileStatement(stmt); err != nil {
-			return err
-		}
-	}
-
-	// Compile the increment expression
-	if err := loopCtx.compileStatement(f.Increment); err != nil {
+	// Compile the body of the loop, `continue` jumps to the increment
+	loopCtx := forCtx.NewContext(loopB)
+	loopCtx.enterLoop(leaveB, incB, label)
+	if err := loopCtx.compileBody(f.Body); err != nil {
 		return err
 	}
+	if loopCtx.Term == nil {
+		loopCtx.NewBr(incB)
+	}
 
-	// Compile the condition again
-	cond, err = loopCtx.compileExpression(f.Condition)
-	if err != nil {
+	// Compile the increment and check the condition again
+	forCtx.Block = incB
+	if err := forCtx.compileStatement(f.Increment); err != nil {
 		return err
 	}
-
-	// Create a conditional branch to the loop or leave block based on the condition
-	loopCtx.Block.NewCondBr(cond, loopB, leaveB)
+	if forCtx.Term == nil {
+		forCtx.NewBr(condB)
+	}
 
 	// Set the current block to the leave block
 	ctx.Block = leaveB
@@ -527,63 +1096,356 @@ func (ctx *Context) compileFor(f *parser.For) error {
 	return nil
 }
 
-func (ctx *Context) compileWhile(w *parser.While) error {
+func (ctx *Context) compileWhile(w *parser.While, label string) error {
+	condB := ctx.Block.Parent.NewBlock("")
+	loopB := ctx.Block.Parent.NewBlock("")
+	leaveB := ctx.Block.Parent.NewBlock("")
+	ctx.NewBr(condB)
+
+	ctx.Block = condB
 	cond, err := ctx.compileExpression(w.Condition)
 	if err != nil {
 		return err
 	}
+	ctx.NewCondBr(cond, loopB, leaveB)
 
+	loopCtx := ctx.NewContext(loopB)
+	loopCtx.enterLoop(leaveB, condB, label)
+	if err := loopCtx.compileBody(w.Body); err != nil {
+		return err
+	}
+	if loopCtx.Term == nil {
+		loopCtx.NewBr(condB)
+	}
+	ctx.Block = leaveB
+
+	return nil
+}
+
+func (ctx *Context) compileUntil(u *parser.Until, label string) error {
+	condB := ctx.Block.Parent.NewBlock("")
 	loopB := ctx.Block.Parent.NewBlock("")
 	leaveB := ctx.Block.Parent.NewBlock("")
+	ctx.NewBr(condB)
+
+	ctx.Block = condB
+	cond, err := ctx.compileExpression(u.Condition)
+	if err != nil {
+		return err
+	}
+	ctx.NewCondBr(cond, leaveB, loopB)
+
 	loopCtx := ctx.NewContext(loopB)
+	loopCtx.enterLoop(leaveB, condB, label)
+	if err := loopCtx.compileBody(u.Body); err != nil {
+		return err
+	}
+	if loopCtx.Term == nil {
+		loopCtx.NewBr(condB)
+	}
+	ctx.Block = leaveB
 
-	ctx.NewCondBr(cond, loopB, leaveB)
-	loopCtx.fc.Leave = leaveB
-	loopCtx.fc.Continue = loopB
+	return nil
+}
 
-	for _, stmt := range w.Body {
-		err := loopCtx.compileStatement(stmt)
-		if err != nil {
-			return err
+// enterLoop makes `break` and `continue` in this context target the given blocks.
+func (ctx *Context) enterLoop(leave *ir.Block, cont *ir.Block, label string) {
+	ctx.fc = &FlowControl{
+		Leave:           leave,
+		Continue:        cont,
+		LeaveCleanup:    ctx.cleanup,
+		ContinueCleanup: ctx.cleanup,
+		Label:           label,
+		outer:           ctx.fc,
+	}
+}
+
+func (ctx *Context) compileBreak(b *parser.Break) error {
+	fc := ctx.fc
+	if b.Label != "" {
+		fc = ctx.fc.lookupLoop(b.Label)
+		if fc == nil {
+			return posError(b.Pos, "No enclosing loop labeled %s", b.Label)
 		}
+	} else if fc.Leave == nil {
+		return posError(b.Pos, "break used outside of a loop or switch")
+	}
+
+	if err := ctx.runCleanups(fc.LeaveCleanup); err != nil {
+		return err
 	}
+	ctx.NewBr(fc.Leave)
+	return nil
+}
+
+func (ctx *Context) compileContinue(c *parser.Continue) error {
+	fc := ctx.fc.lookupLoop(c.Label)
+	if fc == nil {
+		if c.Label != "" {
+			return posError(c.Pos, "No enclosing loop labeled %s", c.Label)
+		}
+		return posError(c.Pos, "continue used outside of a loop")
+	}
+
+	if err := ctx.runCleanups(fc.ContinueCleanup); err != nil {
+		return err
+	}
+	ctx.NewBr(fc.Continue)
+	return nil
+}
 
-	cond, err = loopCtx.compileExpression(w.Condition)
+func (ctx *Context) compileSwitch(s *parser.Switch) error {
+	cond, err := ctx.compileExpression(s.Condition)
 	if err != nil {
 		return err
 	}
-	loopCtx.NewCondBr(cond, loopB, leaveB)
+
+	leaveB := ctx.Block.Parent.NewBlock("")
+	defaultB := leaveB
+	if s.Default != nil {
+		defaultB = ctx.Block.Parent.NewBlock("")
+	}
+
+	// Compile the case values and check that every one of them can be used in an LLVM switch
+	_, isInt := cond.Type().(*types.IntType)
+	allConst := isInt
+	values := make([][]value.Value, len(s.Cases))
+	seen := make(map[string]bool)
+	for i, c := range s.Cases {
+		for _, expr := range c.Values {
+			ctx.RequestedType = cond.Type()
+			val, err := ctx.compileExpression(expr)
+			if err != nil {
+				return err
+			}
+			ctx.RequestedType = nil
+
+			if ptrType, ok := val.Type().(*types.PointerType); ok && ptrType.ElemType.Equal(cond.Type()) {
+				val = ctx.NewLoad(ptrType.ElemType, val)
+			}
+
+			if !val.Type().Equal(cond.Type()) {
+				return posError(expr.Pos, "case value must be the same type as the switch condition (%s != %s)", val.Type(), cond.Type())
+			}
+
+			if c, ok := val.(*constant.Int); ok {
+				if seen[c.X.String()] {
+					return posError(expr.Pos, "Duplicate case value %s in switch", c.X.String())
+				}
+				seen[c.X.String()] = true
+			} else {
+				allConst = false
+			}
+
+			values[i] = append(values[i], val)
+		}
+	}
+	ctx.warnMissingVariants(s, cond.Type(), values)
+
+	bodies := make([]*ir.Block, len(s.Cases))
+	for i := range s.Cases {
+		bodies[i] = ctx.Block.Parent.NewBlock("")
+	}
+
+	if allConst {
+		var cases []*ir.Case
+		for i, vals := range values {
+			for _, val := range vals {
+				cases = append(cases, ir.NewCase(val.(*constant.Int), bodies[i]))
+			}
+		}
+		ctx.NewSwitch(cond, defaultB, cases...)
+	} else {
+		// Fall back to a chain of comparisons for values LLVM can't switch on
+		for i, vals := range values {
+			for _, val := range vals {
+				var cmp value.Value
+				if types.IsFloat(cond.Type()) {
+					cmp = ctx.NewFCmp(enum.FPredOEQ, cond, val)
+				} else {
+					cmp = ctx.NewICmp(enum.IPredEQ, cond, val)
+				}
+				nextB := ctx.Block.Parent.NewBlock("")
+				ctx.NewCondBr(cmp, bodies[i], nextB)
+				ctx.Block = nextB
+			}
+		}
+		ctx.NewBr(defaultB)
+	}
+
+	// Cases don't fall through, `break` leaves the switch early
+	for i, c := range s.Cases {
+		caseCtx := ctx.NewContext(bodies[i])
+		caseCtx.enterSwitch(leaveB)
+		if err := caseCtx.compileBody(c.Body); err != nil {
+			return err
+		}
+		if caseCtx.Term == nil {
+			caseCtx.NewBr(leaveB)
+		}
+	}
+
+	if s.Default != nil {
+		defaultCtx := ctx.NewContext(defaultB)
+		defaultCtx.enterSwitch(leaveB)
+		if err := defaultCtx.compileBody(s.Default); err != nil {
+			return err
+		}
+		if defaultCtx.Term == nil {
+			defaultCtx.NewBr(leaveB)
+		}
+	}
+
 	ctx.Block = leaveB
 
 	return nil
 }
 
-func (ctx *Context) compileUntil(u *parser.Until) error {
-	cond, err := ctx.compileExpression(u.Condition)
+// enterSwitch makes `break` in this context leave the switch, `continue` still targets the enclosing loop.
+func (ctx *Context) enterSwitch(leave *ir.Block) {
+	ctx.fc = &FlowControl{
+		Leave:           leave,
+		Continue:        ctx.fc.Continue,
+		LeaveCleanup:    ctx.cleanup,
+		ContinueCleanup: ctx.fc.ContinueCleanup,
+		outer:           ctx.fc,
+	}
+}
+
+func (ctx *Context) compileThrow(t *parser.Throw) error {
+	val, err := ctx.compileExpression(t.Value)
 	if err != nil {
 		return err
 	}
 
-	loopB := ctx.Block.Parent.NewBlock("")
+	payload, err := ctx.toExceptionPayload(val, t.Pos)
+	if err != nil {
+		return err
+	}
+
+	ctx.NewCall(ctx.Compiler.exceptionRuntime().throw, payload, ctx.throwSite(t.Pos))
+	ctx.NewUnreachable()
+
+	return nil
+}
+
+func (ctx *Context) compileTryCatch(t *parser.TryCatch) error {
+	if t.Catch == nil && t.Final == nil {
+		return posError(t.Pos, "Try statement must have a catch or finally block")
+	}
+
+	outer := ctx.cleanup
 	leaveB := ctx.Block.Parent.NewBlock("")
-	loopCtx := ctx.NewContext(loopB)
 
-	ctx.NewCondBr(cond, leaveB, loopB)
-	loopCtx.fc.Leave = leaveB
-	loopCtx.fc.Continue = loopB
+	// compileFinally emits the finally block at the end of c, if there is one
+	compileFinally := func(c *Context) error {
+		fctx := c.NewContext(c.Block)
+		fctx.cleanup = outer
+		if err := fctx.compileBody(t.Final); err != nil {
+			return err
+		}
+		c.Block = fctx.Block
+		return nil
+	}
 
-	for _, stmt := range u.Body {
-		err := loopCtx.compileStatement(stmt)
-		if err != nil {
+	// Compile the try block, leaving it in any way has to unlink the handler
+	frame, tryB, caughtB := ctx.pushHandler()
+	tryCtx := ctx.NewContext(tryB)
+	tryCtx.cleanup = &Cleanup{
+		parent: outer,
+		Emit: func(c *Context) error {
+			c.popHandler(frame)
+			return compileFinally(c)
+		},
+	}
+	if err := tryCtx.compileBody(t.Try); err != nil {
+		return err
+	}
+	if tryCtx.Term == nil {
+		tryCtx.popHandler(frame)
+		if err := compileFinally(tryCtx); err != nil {
 			return err
 		}
+		if tryCtx.Term == nil {
+			tryCtx.NewBr(leaveB)
+		}
+	}
+
+	ctx.Block = caughtB
+	if t.Catch == nil {
+		// Without a catch block, run the finally block and let the exception propagate
+		if err := compileFinally(ctx); err != nil {
+			return err
+		}
+		if ctx.Term == nil {
+			ctx.rethrow()
+		}
+		ctx.Block = leaveB
+		return nil
+	}
+
+	// If there is a finally block, exceptions thrown by the catch block have to run it too
+	catchB := caughtB
+	var catchFrame value.Value
+	var rethrowB *ir.Block
+	if t.Final != nil {
+		catchFrame, catchB, rethrowB = ctx.pushHandler()
+	}
+
+	catchCtx := ctx.NewContext(catchB)
+	if catchFrame != nil {
+		catchCtx.cleanup = &Cleanup{
+			parent: outer,
+			Emit: func(c *Context) error {
+				c.popHandler(catchFrame)
+				return compileFinally(c)
+			},
+		}
 	}
 
-	cond, err = loopCtx.compileExpression(u.Condition)
+	// Bind the thrown value to the catch variable
+	var catchType types.Type = types.I8Ptr
+	if t.Catch.Type != nil {
+		catchType = ctx.CFTypeToLLType(t.Catch.Type)
+	}
+	rt := ctx.Compiler.exceptionRuntime()
+	val, err := catchCtx.fromExceptionPayload(catchCtx.NewLoad(types.I64, rt.value), catchType, t.Catch.Pos)
 	if err != nil {
 		return err
 	}
-	loopCtx.NewCondBr(cond, leaveB, loopB)
+	alloc := catchCtx.NewAlloca(catchType)
+	catchCtx.NewStore(val, alloc)
+	catchCtx.vars[t.Catch.Name] = &Variable{
+		Name:  t.Catch.Name,
+		Type:  catchType,
+		Value: alloc,
+	}
+
+	if err := catchCtx.compileBody(t.Catch.Body); err != nil {
+		return err
+	}
+	if catchCtx.Term == nil {
+		if catchFrame != nil {
+			catchCtx.popHandler(catchFrame)
+		}
+		if err := compileFinally(catchCtx); err != nil {
+			return err
+		}
+		if catchCtx.Term == nil {
+			catchCtx.NewBr(leaveB)
+		}
+	}
+
+	if rethrowB != nil {
+		ctx.Block = rethrowB
+		if err := compileFinally(ctx); err != nil {
+			return err
+		}
+		if ctx.Term == nil {
+			ctx.rethrow()
+		}
+	}
+
 	ctx.Block = leaveB
 
 	return nil
@@ -597,31 +1459,52 @@ func (ctx *Context) compileReturn(r *parser.Return) error {
 			return posError(r.Pos, "Error compiling return expression: %s", err.Error())
 		}
 		ctx.RequestedType = nil
+		retType := ctx.Block.Parent.Sig.RetType
+		converted, ok := ctx.convertValue(val, retType)
+		if !ok {
+			return posError(r.Expressions[0].Pos, "Cannot return a value of type %s as %s", ctx.TypeToString(val.Type()), ctx.TypeToString(retType))
+		}
+		val = converted
+		if err := ctx.runCleanups(nil); err != nil {
+			return err
+		}
 		ctx.NewRet(val)
 	} else if len(r.Expressions) > 1 {
 		if _, ok := ctx.Block.Parent.Sig.RetType.(*types.StructType); !ok {
 			return posError(r.Pos, "Cannot return multiple values from a non-struct function")
 		}
 
-		var vals []constant.Constant
+		retType := ctx.Block.Parent.Sig.RetType.(*types.StructType)
+		if len(retType.Fields) != len(r.Expressions) {
+			return posError(r.Pos, "Function returns %d values but %d were given", len(retType.Fields), len(r.Expressions))
+		}
+
+		// Build the returned struct one field at a time, so the values don't have to be constants
+		var ret value.Value = constant.NewUndef(retType)
 		for i, expr := range r.Expressions {
-			ctx.RequestedType = ctx.Block.Parent.Sig.RetType.(*types.StructType).Fields[i]
+			ctx.RequestedType = retType.Fields[i]
 			val, err := ctx.compileExpression(expr)
 			ctx.RequestedType = nil
 			if err != nil {
 				return posError(r.Pos, "Error compiling return expression: %s", err.Error())
 			}
 
-			constVal, ok := val.(constant.Constant)
+			converted, ok := ctx.convertValue(val, retType.Fields[i])
 			if !ok {
-				return posError(r.Pos, "Return expression did not evaluate to a constant")
+				return posError(expr.Pos, "Cannot return a value of type %s as return value %d of type %s", ctx.TypeToString(val.Type()), i+1, ctx.TypeToString(retType.Fields[i]))
 			}
 
-			vals = append(vals, constVal)
+			ret = ctx.NewInsertValue(ret, converted, uint64(i))
 		}
 
-		ctx.NewRet(constant.NewStruct(ctx.Block.Parent.Sig.RetType.(*types.StructType), vals...))
+		if err := ctx.runCleanups(nil); err != nil {
+			return err
+		}
+		ctx.NewRet(ret)
 	} else {
+		if err := ctx.runCleanups(nil); err != nil {
+			return err
+		}
 		ctx.NewRet(nil)
 	}
 	return nil
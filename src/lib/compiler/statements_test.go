@@ -0,0 +1,334 @@
+package compiler
+
+import "testing"
+
+func TestSwitch(t *testing.T) {
+	expectIR(t, `
+func f(x: i64): i64 {
+	switch (x) {
+	case 1, 2:
+		return 10;
+	case 3:
+		return 30;
+	default:
+		return 0;
+	}
+	return -1;
+}
+func main(): i32 { return 0; }
+`, "switch i64")
+	expectOutput(t, `
+func main(): i32 {
+	for (var i: i64 = 0; i < 4; i = i + 1) {
+		switch (i) {
+		case 1:
+			continue;
+		case 2:
+			printf("two ");
+			break;
+		default:
+			printf("%ld ", i);
+		}
+	}
+	return 0;
+}
+`, "0 two 3 ")
+	expectError(t, `
+func main(): i32 {
+	switch (1) {
+	case 1:
+		return 1;
+	case 1:
+		return 2;
+	}
+	return 0;
+}
+`, "Duplicate case value 1 in switch")
+}
+
+func TestLoopControl(t *testing.T) {
+	expectOutput(t, `
+func main(): i32 {
+	outer: for (var i: i64 = 0; i < 3; i = i + 1) {
+		for (var j: i64 = 0; j < 3; j = j + 1) {
+			if (j >= 1) {
+				continue outer;
+			}
+			if (i >= 2) {
+				break outer;
+			}
+			printf("%ld%ld ", i, j);
+		}
+	}
+	var k: i64 = 0;
+	while (k < 5) {
+		k = k + 1;
+		if (k < 2) {
+			continue;
+		}
+		if (k > 3) {
+			break;
+		}
+		printf("k%ld ", k);
+	}
+	return 0;
+}
+`, "00 10 k2 k3 ")
+	expectOutput(t, `
+func main(): i32 {
+	loop: for (var k: i64 = 0; k < 3; k = k + 1) {
+		if (k == 1) {
+			continue;
+		}
+		printf("k%ld ", k);
+	}
+	for (var i: i64 = 0; i < 2; i = i + 1) {
+		inner: for (var j: i64 = 0; j < 3; j = j + 1) {
+			if (j == 1) {
+				continue;
+			}
+			printf("%ld%ld ", i, j);
+		}
+	}
+	return 0;
+}
+`, "k0 k2 00 02 10 12 ")
+	expectError(t, `
+func main(): i32 {
+	for (var i: i64 = 0; i < 3; i = i + 1) {
+		break missing;
+	}
+	return 0;
+}
+`, "No enclosing loop labeled missing")
+	expectError(t, `
+func main(): i32 {
+	continue;
+	return 0;
+}
+`, "continue used outside of a loop")
+}
+
+func TestIfElse(t *testing.T) {
+	expectOutput(t, `
+func sign(x: i64): i64 {
+	if (x < 0) {
+		var r: i64 = 0 - 1;
+		return r;
+	} else if (x == 0) {
+		var r: i64 = 0;
+		return r;
+	} else {
+		if (x > 100) {
+			return 2;
+		}
+		return 1;
+	}
+}
+func main(): i32 {
+	printf("%ld %ld %ld %ld\n", sign(0 - 5), sign(0), sign(7), sign(500));
+	return 0;
+}
+`, "-1 0 1 2\n")
+}
+
+func TestForwardReferences(t *testing.T) {
+	expectOutput(t, `
+func main(): i32 {
+	var n: *Node = new Node(later(2));
+	printf("%ld\n", n.value);
+	return 0;
+}
+func later(x: i64): i64 { return x * 21; }
+class Node {
+	value: i64;
+	func constructor(v: i64) { this.value = v; }
+}
+`, "42\n")
+	expectError(t, `
+func main(): i32 {
+	return (never(1)): i32;
+}
+`, "Function never not found")
+}
+
+func TestMultipleReturn(t *testing.T) {
+	expectOutput(t, `
+func pair(n: i64): i64, f64 {
+	var k: i32 = 3;
+	return n * 2, k;
+}
+func main(): i32 {
+	var x: i64, y: f64 = pair(4);
+	printf("%ld %.1f\n", x, y);
+	x, y = pair(10);
+	printf("%ld %.1f\n", x, y);
+	return 0;
+}
+`, "8 3.0\n20 3.0\n")
+	expectError(t, `
+func pair(): i64, i64 { return 1, 2; }
+func main(): i32 {
+	var x: i64, y: i64, z: i64 = pair();
+	return 0;
+}
+`, "Unable to unpack 2 values into 3 variables")
+	expectError(t, `
+func pair(): i64, i64 { return 1, 2; }
+func main(): i32 {
+	var x = pair();
+	return 0;
+}
+`, "Cannot assign 2 values to the single variable x")
+}
+
+func TestTypeInference(t *testing.T) {
+	expectOutput(t, `
+class S { v: i64; func constructor(v: i64) { this.v = v; } }
+var gi = 40;
+const gf = 2.5;
+func main(): i32 {
+	var a = 5;
+	var b = 1.5;
+	var s = new S(9);
+	const k = a + 1;
+	var t: i32 = 7;
+	var u = t;
+	printf("%ld %.1f %ld %ld %ld %.1f %d\n", a, b, s.v, k, gi, gf, u);
+	return 0;
+}
+`, "5 1.5 9 6 40 2.5 7\n")
+	expectError(t, `
+func main(): i32 {
+	var x;
+	return 0;
+}
+`, "Cannot infer the type of x without an assignment")
+	expectError(t, `
+func main(): i32 {
+	var p = null;
+	return 0;
+}
+`, "Cannot infer the type of p from null")
+}
+
+func TestDefer(t *testing.T) {
+	expectOutput(t, `
+func f(): i64 {
+	var x = 1;
+	defer printf("d1 x=%ld\n", x);
+	defer x = 5;
+	defer printf("d2\n");
+	if (x == 1) {
+		return x;
+	}
+	return 0;
+}
+func g() {
+	for (var i = 0; i < 3; i = i + 1) {
+		defer printf("iter %ld\n", i);
+		if (i == 1) {
+			break;
+		}
+	}
+}
+func main(): i32 {
+	printf("f=%ld\n", f());
+	g();
+	return 0;
+}
+`, "d2\nd1 x=5\nf=1\niter 0\niter 1\n")
+	expectError(t, `
+func main(): i32 {
+	defer return 1;
+	return 0;
+}
+`, "This statement cannot be deferred")
+}
+
+func TestInferenceAfterConstructor(t *testing.T) {
+	expectOutput(t, `
+class Box {
+	v: f64;
+	func constructor(c: i64) {}
+	func put(v: f64) { this.v = v; }
+}
+extern func malloc(size: i64): *i8;
+class List<T> {
+	items: *T;
+	func constructor(cap: i64) { this.items = (malloc(cap * 16)): *T; }
+	func push(v: T) { *this.items = v; }
+}
+func main(): i32 {
+	var b = new Box(1);
+	var y = 2.5;
+	printf("%.1f\n", y);
+	b.put(1.5);
+	printf("%.1f\n", b.v);
+	var l = new List<f64>(4);
+	l.push(1.5);
+	printf("%.1f\n", *l.items);
+	return 0;
+}
+`, "2.5\n1.5\n1.5\n")
+}
+
+func TestUnreachableCode(t *testing.T) {
+	expectWarning(t, `
+func main(): i32 {
+	return 0;
+	printf("never\n");
+}
+`, "Unreachable code")
+	expectWarning(t, `
+func main(): i32 {
+	for (var i: i64 = 0; i < 3; i = i + 1) {
+		if (i == 1) { break; }
+		printf("%ld\n", i);
+	}
+	return 0;
+}
+`, "")
+	expectError(t, `
+func main(): i32 {
+	return 0;
+	var x: i64 = missing;
+}
+`, "missing")
+	expectOutput(t, `
+func f(n: i64): i64 {
+	if (n > 0) {
+		return n;
+		n = n + 1;
+	}
+	return 0 - n;
+	return 1;
+}
+func main(): i32 {
+	printf("%ld %ld\n", f(2), f(-3));
+	return 0;
+}
+`, "2 3\n")
+}
+
+func TestReturnConversion(t *testing.T) {
+	expectOutput(t, `
+func g(): i64 {
+	var y: i32 = 7;
+	return y;
+}
+func h(): f64 {
+	var n: i16 = -3;
+	return n;
+}
+func main(): i32 {
+	printf("%ld %.1f\n", g(), h());
+	return 0;
+}
+`, "7 -3.0\n")
+	expectError(t, `
+class C { x: i64; }
+func f(c: *C): i64 { return c; }
+func main(): i32 { return 0; }
+`, "Cannot return a value of type *C as i64")
+}
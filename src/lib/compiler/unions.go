@@ -0,0 +1,337 @@
+package compiler
+
+import (
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+	"github.com/vyPal/CaffeineC/lib/parser"
+)
+
+// A union value is a struct {tag, payload}. The tag is the index of the
+// variant the value holds, and the payload is an array big enough for the
+// fields of the largest variant, which are read and written through a pointer
+// to a struct of the variant's fields. Unions are values like interfaces: they
+// are copied when assigned or passed, and built with `Shape.Circle(1.0)`.
+
+// unionDef is a declared union and the fields of its variants.
+type unionDef struct {
+	name     string
+	def      *parser.UnionDefinition
+	typ      *types.StructType
+	variants []string
+	payloads []*types.StructType
+	// Set while the payload is being laid out, to catch unions containing themselves
+	laying    bool
+	recursive bool
+}
+
+// declareUnion registers the type of the union `u` under `name`. Its payload
+// is laid out by layoutUnion once the types of its fields are known.
+func (ctx *Context) declareUnion(u *parser.UnionDefinition, name string) *unionDef {
+	if def, ok := ctx.Compiler.unions[name]; ok {
+		return def
+	}
+
+	typ := types.NewStruct()
+	typ.SetName(name)
+	ctx.Module.NewTypeDef(name, typ)
+	def := &unionDef{name: name, def: u, typ: typ}
+	for _, v := range u.Variants {
+		def.variants = append(def.variants, v.Name)
+	}
+	ctx.Compiler.unions[name] = def
+	return def
+}
+
+// layoutUnion sizes the payload of the union `def` for its largest variant.
+func (ctx *Context) layoutUnion(def *unionDef) {
+	if def.typ.Fields != nil || def.laying {
+		return
+	}
+	def.laying = true
+	var size, align uint64 = 0, 8
+	for _, v := range def.def.Variants {
+		var fields []types.Type
+		for _, f := range v.Fields {
+			fields = append(fields, ctx.CFTypeToLLType(f.Type))
+		}
+		payload := types.NewStruct(fields...)
+		def.payloads = append(def.payloads, payload)
+		s, a := ctx.typeLayout(payload)
+		size = max(size, s)
+		align = max(align, a)
+	}
+	def.laying = false
+
+	word := types.I64
+	if align > 8 {
+		word = types.I128
+	}
+	words := (size + align - 1) / align
+	def.typ.Fields = []types.Type{types.I32, types.NewArray(words, word)}
+}
+
+// typeLayout returns the size and alignment of `t` in bytes on a 64-bit target.
+func (ctx *Context) typeLayout(t types.Type) (uint64, uint64) {
+	switch t := t.(type) {
+	case *types.IntType:
+		size := uint64(1)
+		for size*8 < t.BitSize {
+			size *= 2
+		}
+		return size, size
+	case *types.FloatType:
+		switch t.Kind {
+		case types.FloatKindHalf:
+			return 2, 2
+		case types.FloatKindFloat:
+			return 4, 4
+		case types.FloatKindDouble:
+			return 8, 8
+		default:
+			return 16, 16
+		}
+	case *types.ArrayType:
+		size, align := ctx.typeLayout(t.ElemType)
+		return size * t.Len, align
+	case *types.StructType:
+		if def, ok := ctx.unionOf(t); ok {
+			if def.laying {
+				def.recursive = true
+				return 0, 1
+			}
+			ctx.layoutUnion(def)
+		}
+		var size, align uint64 = 0, 1
+		for _, field := range t.Fields {
+			s, a := ctx.typeLayout(field)
+			size = (size + a - 1) / a * a
+			size += s
+			align = max(align, a)
+		}
+		return (size + align - 1) / align * align, align
+	default:
+		return 8, 8
+	}
+}
+
+// compileUnionDefinition checks the union `u`, which was declared with the rest of the module.
+func (ctx *Context) compileUnionDefinition(u *parser.UnionDefinition) error {
+	def := ctx.declareUnion(u, u.Name)
+	if len(u.Variants) == 0 {
+		return posError(u.Pos, "Union %s has no variants", u.Name)
+	}
+	if def.recursive {
+		return posError(u.Pos, "Union %s contains itself, use a pointer instead", u.Name)
+	}
+
+	variants := map[string]bool{}
+	for _, v := range u.Variants {
+		if variants[v.Name] {
+			return posError(v.Pos, "Variant %s of union %s is declared twice", v.Name, u.Name)
+		}
+		variants[v.Name] = true
+		fields := map[string]bool{}
+		for _, f := range v.Fields {
+			if fields[f.Name] {
+				return posError(f.Pos, "Field %s of variant %s.%s is declared twice", f.Name, u.Name, v.Name)
+			}
+			fields[f.Name] = true
+		}
+	}
+	return nil
+}
+
+// unionOf returns the union `t` is the type of.
+func (ctx *Context) unionOf(t types.Type) (*unionDef, bool) {
+	structType, ok := t.(*types.StructType)
+	if !ok || structType.Name() == "" {
+		return nil, false
+	}
+	def, ok := ctx.Compiler.unions[structType.Name()]
+	if !ok || def.typ != structType {
+		return nil, false
+	}
+	return def, true
+}
+
+// isUnion reports whether `t` is a union type.
+func (ctx *Context) isUnion(t types.Type) bool {
+	_, ok := ctx.unionOf(t)
+	return ok
+}
+
+// variantIndex returns the tag of the variant `name` of the union `def`.
+func (def *unionDef) variantIndex(name string) int {
+	for i, v := range def.variants {
+		if v == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// variantPayload returns a pointer to the fields of the variant `index` of the union stored at `mem`.
+func (ctx *Context) variantPayload(def *unionDef, mem value.Value, index int) value.Value {
+	payload := ctx.NewGetElementPtr(def.typ, mem, constant.NewInt(types.I32, 0), constant.NewInt(types.I32, 1))
+	return ctx.NewBitCast(payload, types.NewPointer(def.payloads[index]))
+}
+
+// compileUnionVariant builds a value of the union `def` holding the variant `name`.
+func (ctx *Context) compileUnionVariant(def *unionDef, name string, arguments *parser.ArgumentList, pos lexer.Position) (value.Value, error) {
+	index := def.variantIndex(name)
+	if index < 0 {
+		return nil, posError(pos, "Union %s has no variant %s", def.name, name)
+	}
+	fields := def.payloads[index].Fields
+	if len(arguments.Arguments) != len(fields) {
+		return nil, posError(pos, "Variant %s.%s takes %d values but %d were given", def.name, name, len(fields), len(arguments.Arguments))
+	}
+
+	mem := ctx.NewAlloca(def.typ)
+	tag := ctx.NewGetElementPtr(def.typ, mem, constant.NewInt(types.I32, 0), constant.NewInt(types.I32, 0))
+	ctx.NewStore(constant.NewInt(types.I32, int64(index)), tag)
+	payload := ctx.variantPayload(def, mem, index)
+	for i, arg := range arguments.Arguments {
+		ctx.RequestedType = fields[i]
+		compiled, err := ctx.compileExpression(arg)
+		ctx.RequestedType = nil
+		if err != nil {
+			return nil, err
+		}
+		converted, ok := ctx.convertValue(compiled, fields[i])
+		if !ok {
+			return nil, posError(arg.Pos, "Cannot use a value of type %s as field %s of %s.%s, which has type %s", ctx.TypeToString(compiled.Type()), def.def.Variants[index].Fields[i].Name, def.name, name, ctx.TypeToString(fields[i]))
+		}
+		field := ctx.NewGetElementPtr(def.payloads[index], payload, constant.NewInt(types.I32, 0), constant.NewInt(types.I32, int64(i)))
+		ctx.NewStore(converted, field)
+	}
+	return ctx.NewLoad(def.typ, mem), nil
+}
+
+// compileMatch evaluates the arm of `m` for the variant held by the union value it matches on.
+func (ctx *Context) compileMatch(m *parser.Match) (value.Value, error) {
+	requested := ctx.RequestedType
+	ctx.RequestedType = nil
+	val, err := ctx.compileExpression(m.Value)
+	if err != nil {
+		return nil, err
+	}
+	def, ok := ctx.unionOf(val.Type())
+	if !ok {
+		return nil, posError(m.Value.Pos, "Cannot match on a value of type %s, it isn't a union", ctx.TypeToString(val.Type()))
+	}
+
+	// Check the arms before compiling any of them
+	handled := map[string]bool{}
+	wildcard := false
+	for _, arm := range m.Arms {
+		if arm.Variant == "_" {
+			if wildcard {
+				return nil, posError(arm.Pos, "match has more than one _ arm")
+			}
+			if len(arm.Bindings) > 0 {
+				return nil, posError(arm.Pos, "The _ arm of a match cannot bind fields")
+			}
+			wildcard = true
+			continue
+		}
+		index := def.variantIndex(arm.Variant)
+		if index < 0 {
+			return nil, posError(arm.Pos, "Union %s has no variant %s", def.name, arm.Variant)
+		}
+		if handled[arm.Variant] {
+			return nil, posError(arm.Pos, "Variant %s is matched twice", arm.Variant)
+		}
+		handled[arm.Variant] = true
+		if fields := def.payloads[index].Fields; len(arm.Bindings) > 0 && len(arm.Bindings) != len(fields) {
+			return nil, posError(arm.Pos, "Variant %s.%s has %d fields but %d were bound", def.name, arm.Variant, len(fields), len(arm.Bindings))
+		}
+	}
+	if len(m.Arms) == 0 {
+		return nil, posError(m.Pos, "match over union %s has no arms", def.name)
+	}
+	if !wildcard {
+		var missing []string
+		for _, v := range def.variants {
+			if !handled[v] {
+				missing = append(missing, v)
+			}
+		}
+		if len(missing) > 0 {
+			return nil, posError(m.Pos, "match over union %s doesn't handle %s", def.name, strings.Join(missing, ", "))
+		}
+	}
+
+	// The value is spilled so the fields of its payload can be bound
+	mem := ctx.NewAlloca(def.typ)
+	ctx.NewStore(val, mem)
+	tag := ctx.NewExtractValue(val, 0)
+
+	var cases []*ir.Case
+	defaultB := ctx.Block.Parent.NewBlock("")
+	leaveB := ctx.Block.Parent.NewBlock("")
+	switchB := ctx.Block
+	var incoming []*ir.Incoming
+	var resultType types.Type
+	var last value.Value
+	for _, arm := range m.Arms {
+		armB := defaultB
+		index := def.variantIndex(arm.Variant)
+		if index >= 0 {
+			armB = ctx.Block.Parent.NewBlock("")
+			cases = append(cases, ir.NewCase(constant.NewInt(types.I32, int64(index)), armB))
+		}
+
+		armCtx := ctx.NewContext(armB)
+		if len(arm.Bindings) > 0 {
+			payload := armCtx.variantPayload(def, mem, index)
+			for i, name := range arm.Bindings {
+				if name == "_" {
+					continue
+				}
+				fieldType := def.payloads[index].Fields[i]
+				field := armCtx.NewGetElementPtr(def.payloads[index], payload, constant.NewInt(types.I32, 0), constant.NewInt(types.I32, int64(i)))
+				armCtx.vars[name] = &Variable{Name: name, Type: fieldType, Value: field}
+			}
+		}
+
+		if resultType != nil {
+			armCtx.RequestedType = resultType
+		} else {
+			armCtx.RequestedType = requested
+		}
+		result, err := armCtx.compileExpression(arm.Body)
+		armCtx.RequestedType = nil
+		if err != nil {
+			return nil, err
+		}
+		if resultType == nil {
+			resultType = result.Type()
+		}
+		converted, ok := armCtx.convertValue(result, resultType)
+		if !ok {
+			return nil, posError(arm.Body.Pos, "The arms of a match must have the same type, this one has type %s instead of %s", ctx.TypeToString(result.Type()), ctx.TypeToString(resultType))
+		}
+		incoming = append(incoming, ir.NewIncoming(converted, armCtx.Block))
+		last = converted
+		armCtx.NewBr(leaveB)
+	}
+
+	if !wildcard {
+		// Every variant has an arm, so the tag can't be anything else
+		defaultB.NewUnreachable()
+	}
+	switchB.NewSwitch(tag, defaultB, cases...)
+
+	ctx.Block = leaveB
+	if resultType.Equal(types.Void) {
+		// Arms without a value are only evaluated for their effects
+		return last, nil
+	}
+	return ctx.NewPhi(incoming...), nil
+}
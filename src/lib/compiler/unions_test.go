@@ -0,0 +1,36 @@
+package compiler
+
+import "testing"
+
+func TestUnions(t *testing.T) {
+	expectOutput(t, `
+union Shape { Circle(r: f64), Rect(w: f64, h: f64), Empty }
+union Tok { Num(v: i64), Op(c: i8), Big(a: i64, b: i64, c: i64) }
+func area(s: Shape): f64 {
+	return match (s) {
+		Circle(r) => 3.0 * r * r,
+		Rect(w, h) => w * h,
+		Empty => 0.0,
+	};
+}
+func isNum(t: Tok): i64 {
+	return match (t) { Num(v) => v, _ => -1 };
+}
+func main(): i32 {
+	var a: Shape = Shape.Circle(2.0);
+	var b = Shape.Rect(2.0, 3.5);
+	printf("%.1f %.1f %.1f\n", area(a), area(b), area(Shape.Empty()));
+	var t: Tok = Tok.Big(1, 2, 3);
+	printf("%ld %ld %ld\n", isNum(Tok.Num(42)), isNum(Tok.Op(43)), match (t) { Big(x, _, z) => x + z, _ => 0 });
+	return 0;
+}
+`, "12.0 7.0 0.0\n42 -1 4\n")
+	expectError(t, `
+union S { A(x: i64), B }
+func main(): i32 {
+	var s = S.A(1);
+	var k = match (s) { A(x) => x };
+	return 0;
+}
+`, "match over union S doesn't handle B")
+}
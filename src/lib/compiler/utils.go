@@ -2,13 +2,18 @@ package compiler
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"strconv"
 	"strings"
+	"unicode"
 
 	"github.com/alecthomas/participle/v2/lexer"
 	"github.com/fatih/color"
+	"github.com/llir/llvm/ir"
 	"github.com/llir/llvm/ir/constant"
 	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
 	"github.com/urfave/cli/v2"
 	"github.com/vyPal/CaffeineC/lib/parser"
 )
@@ -17,16 +22,43 @@ func posError(pos lexer.Position, message string, args ...interface{}) error {
 	return cli.Exit(color.RedString("%s at %s:%d:%d", fmt.Sprintf(message, args...), pos.Filename, pos.Line, pos.Column), 1)
 }
 
+// warningOutput is where warnings are printed.
+var warningOutput io.Writer = os.Stderr
+
+// posWarning prints a warning at pos without stopping the compilation.
+func posWarning(pos lexer.Position, message string, args ...interface{}) {
+	fmt.Fprintln(warningOutput, color.YellowString("Warning: %s at %s:%d:%d", fmt.Sprintf(message, args...), pos.Filename, pos.Line, pos.Column))
+}
+
 func (ctx *Context) CFTypeToLLType(t *parser.Type) types.Type {
 	pointerCount := strings.Count(t.Ptr, "*")
 	var typ types.Type
 
 	if t.Inner != nil {
 		typ = ctx.CFTypeToLLType(t.Inner)
+	} else if t.Func != nil {
+		typ = ctx.funcValueType(t.Func)
+	} else if bound, ok := ctx.lookupTypeParam(t.Name); ok && len(t.TypeArgs) == 0 {
+		typ = bound
+	} else if len(t.TypeArgs) > 0 {
+		args := make([]types.Type, len(t.TypeArgs))
+		for i, arg := range t.TypeArgs {
+			args[i] = ctx.CFTypeToLLType(arg)
+		}
+		classType, err := ctx.instantiateClass(t.Name, args, t.Pos)
+		if err != nil {
+			panic(err)
+		}
+		typ = classType
+	} else if def, ok := ctx.Compiler.enums[t.Name]; ok {
+		typ = def.typ
 	} else {
-		if strings.HasPrefix(t.Name, "i") || strings.HasPrefix(t.Name, "u") {
+		if strings.HasPrefix(t.Name, "i") {
 			size, _ := strconv.Atoi(t.Name[1:])
 			typ = types.NewInt(uint64(size))
+		} else if strings.HasPrefix(t.Name, "u") {
+			size, _ := strconv.Atoi(t.Name[1:])
+			typ = ctx.unsignedInt(uint64(size))
 		} else {
 			switch t.Name {
 			case "void", "":
@@ -93,6 +125,121 @@ func (ctx *Context) CFMultiTypeToLLType(typeArr []*parser.Type) types.Type {
 	return types.NewStruct(typs...)
 }
 
+// unsignedInt returns the unsigned integer type of the given size. LLVM
+// integers have no signedness, so an unsigned type is a distinct
+// *types.IntType instance that follows its values through loads, stores and
+// arithmetic. Each compiler has its own, as compilers run concurrently.
+func (c *Compiler) unsignedInt(size uint64) *types.IntType {
+	if typ, ok := c.unsignedTypes[size]; ok {
+		return typ
+	}
+	typ := types.NewInt(size)
+	c.unsignedTypes[size] = typ
+	return typ
+}
+
+// isUnsigned reports whether t is an unsigned integer type.
+func (c *Compiler) isUnsigned(t types.Type) bool {
+	intType, ok := t.(*types.IntType)
+	if !ok {
+		return false
+	}
+	if def, ok := c.enumTypes[intType]; ok {
+		return def.unsigned
+	}
+	return c.unsignedTypes[intType.BitSize] == intType
+}
+
+// promoteOperands converts the operands of a binary operator to a common type:
+//   - a constant takes the type of the other operand if it fits
+//   - the smaller of two integers is widened, keeping its signedness
+//   - an integer mixed with a float is converted to that float type
+//   - the smaller of two floats is extended
+//
+// Mixing signed and unsigned integers still requires a cast. Operands that
+// aren't integers or floats are returned unchanged.
+func (ctx *Context) promoteOperands(left value.Value, right value.Value, pos lexer.Position) (value.Value, value.Value, error) {
+	lt, rt := left.Type(), right.Type()
+	if !isScalar(lt) || !isScalar(rt) {
+		return left, right, nil
+	} else if lt.Equal(rt) && ctx.isUnsigned(lt) == ctx.isUnsigned(rt) {
+		return left, right, nil
+	}
+
+	if ctx.constantFits(right, lt) {
+		return left, ctx.convertConstant(right, lt), nil
+	} else if ctx.constantFits(left, rt) {
+		return ctx.convertConstant(left, rt), right, nil
+	}
+
+	lInt, lIsInt := lt.(*types.IntType)
+	rInt, rIsInt := rt.(*types.IntType)
+	lFloat, lIsFloat := lt.(*types.FloatType)
+	rFloat, rIsFloat := rt.(*types.FloatType)
+
+	switch {
+	case lIsInt && rIsInt:
+		if ctx.isUnsigned(lt) != ctx.isUnsigned(rt) {
+			return nil, nil, posError(pos, "Cannot mix %s and %s operands without a cast", ctx.TypeToString(lt), ctx.TypeToString(rt))
+		}
+		if lInt.BitSize < rInt.BitSize {
+			left = ctx.resizeInt(left, rInt)
+		} else {
+			right = ctx.resizeInt(right, lInt)
+		}
+	case lIsInt && rIsFloat:
+		left, _ = ctx.convertValue(left, rFloat)
+	case lIsFloat && rIsInt:
+		right, _ = ctx.convertValue(right, lFloat)
+	case lIsFloat && rIsFloat:
+		if lFloat.Kind < rFloat.Kind {
+			left = ctx.NewFPExt(left, rFloat)
+		} else {
+			right = ctx.NewFPExt(right, lFloat)
+		}
+	}
+	return left, right, nil
+}
+
+// constantFits reports whether `v` is a constant that can take the type `t`
+// without losing its value.
+func (comp *Compiler) constantFits(v value.Value, t types.Type) bool {
+	switch c := v.(type) {
+	case *constant.Int:
+		if intType, ok := t.(*types.IntType); ok {
+			if comp.isUnsigned(intType) {
+				return c.X.Sign() >= 0 && c.X.BitLen() <= int(intType.BitSize)
+			}
+			return c.X.BitLen() < int(intType.BitSize)
+		}
+		return types.IsFloat(t)
+	case *constant.Float:
+		return types.IsFloat(t)
+	}
+	return false
+}
+
+// isScalar reports whether t is an integer or float type.
+func isScalar(t types.Type) bool {
+	return types.IsInt(t) || types.IsFloat(t)
+}
+
+// resizeInt truncates or extends the integer `v` to the size of `t`.
+// The value is extended according to its own signedness.
+func (ctx *Context) resizeInt(v value.Value, t *types.IntType) value.Value {
+	from := v.Type().(*types.IntType)
+	if c := ctx.convertConstant(v, t); c != nil {
+		return c
+	} else if from.BitSize == t.BitSize {
+		return ctx.NewBitCast(v, t)
+	} else if from.BitSize > t.BitSize {
+		return ctx.NewTrunc(v, t)
+	} else if from.BitSize == 1 || ctx.isUnsigned(from) {
+		return ctx.NewZExt(v, t)
+	}
+	return ctx.NewSExt(v, t)
+}
+
 func isNumeric(t types.Type) bool {
 	switch t := t.(type) {
 	case *types.IntType, *types.FloatType:
@@ -104,14 +251,205 @@ func isNumeric(t types.Type) bool {
 	}
 }
 
+// operatorNames are the names operators have in mangled method names.
+var operatorNames = map[string]string{
+	"+": "add", "-": "sub", "*": "mul", "/": "div", "%": "rem",
+	"&": "and", "|": "or", "^": "xor", "<<": "shl", ">>": "shr", ">>>": "ushr",
+	"==": "eq", "!=": "ne", "<": "lt", "<=": "le", ">": "gt", ">=": "ge",
+	"&&": "land", "and": "land", "||": "lor", "or": "lor",
+	"!": "not", "~": "compl", "++": "inc", "--": "dec", "[]": "index", "[]=": "setindex",
+}
+
+// operatorName returns the name of the operator `op` in mangled method names.
+func operatorName(op string) string {
+	if name, ok := operatorNames[op]; ok {
+		return name
+	}
+	return mangleName(op)
+}
+
+// mangleName replaces the characters of `name` that can't appear in a C identifier.
+func mangleName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// mangleType returns the name of `t` in mangled method names, like `V_ptr` for *V.
+func (ctx *Context) mangleType(t types.Type) string {
+	name := ctx.TypeToString(t)
+	ptrs := len(name) - len(strings.TrimLeft(name, "*"))
+	return mangleName(name[ptrs:]) + strings.Repeat("_ptr", ptrs)
+}
+
+// operatorPrefix returns the mangled name of the overloads of the operator `op` of the class `className`.
+func operatorPrefix(className string, op string) string {
+	return className + ".op." + operatorName(op)
+}
+
+// methodSuffix returns the part of a method's mangled name that follows the class name.
+// Operators also carry their operand types, so they can be overloaded.
+func (ctx *Context) methodSuffix(f *parser.FunctionDefinition) string {
+	trimmed := strings.Trim(f.Name.Name, "\"")
+	if f.Name.Op {
+		ms := ".op." + operatorName(trimmed)
+		for _, arg := range f.Parameters {
+			ms += "." + ctx.mangleType(ctx.CFTypeToLLType(arg.Type))
+		}
+		return ms
+	} else if f.Name.Get {
+		return ".get." + trimmed
+	} else if f.Name.Set {
+		return ".set." + trimmed
+	}
+	return "." + f.Name.Name
+}
+
+// classOf returns the name of the class `t` points to.
+func classOf(t types.Type) (string, bool) {
+	ptrType, ok := t.(*types.PointerType)
+	if !ok {
+		return "", false
+	}
+	structType, ok := ptrType.ElemType.(*types.StructType)
+	if !ok || structType.Name() == "" {
+		return "", false
+	}
+	return structType.Name(), true
+}
+
+// convertConstant converts the constant `v` to the type `t`.
+// It returns nil if `v` isn't a constant of a compatible type.
+func (comp *Compiler) convertConstant(v value.Value, t types.Type) value.Value {
+	if v.Type().Equal(t) && comp.isUnsigned(v.Type()) == comp.isUnsigned(t) {
+		return v
+	}
+	switch c := v.(type) {
+	case *constant.Int:
+		if intType, ok := t.(*types.IntType); ok {
+			return constant.NewInt(intType, c.X.Int64())
+		} else if floatType, ok := t.(*types.FloatType); ok {
+			return constant.NewFloat(floatType, float64(c.X.Int64()))
+		}
+	case *constant.Float:
+		if floatType, ok := t.(*types.FloatType); ok {
+			f, _ := c.X.Float64()
+			return constant.NewFloat(floatType, f)
+		}
+	}
+	return nil
+}
+
+// variableBindings returns every variable declared by `v`.
+func variableBindings(v *parser.VariableDefinition) []*parser.VariableBinding {
+	bindings := []*parser.VariableBinding{{Pos: v.Pos, Name: v.Name, Type: v.Type}}
+	return append(bindings, v.Rest...)
+}
+
+// convertValue implicitly converts `v` to the type `t`. Integers are widened or
+// narrowed, floats are extended or truncated and integers become floats.
+// Integers keep their signedness.
+// It returns false if there is no implicit conversion between the two types.
+func (ctx *Context) convertValue(v value.Value, t types.Type) (value.Value, bool) {
+	if c := ctx.convertConstant(v, t); c != nil {
+		return c, true
+	}
+
+	switch from := v.Type().(type) {
+	case *types.IntType:
+		switch to := t.(type) {
+		case *types.IntType:
+			if from.BitSize == to.BitSize {
+				// Changing the signedness needs a cast
+				return v, ctx.isUnsigned(from) == ctx.isUnsigned(to)
+			} else if from.BitSize > to.BitSize {
+				return ctx.NewTrunc(v, to), true
+			} else if from.BitSize == 1 || ctx.isUnsigned(from) {
+				return ctx.NewZExt(v, to), true
+			}
+			return ctx.NewSExt(v, to), true
+		case *types.FloatType:
+			if ctx.isUnsigned(from) {
+				return ctx.NewUIToFP(v, to), true
+			}
+			return ctx.NewSIToFP(v, to), true
+		}
+	case *types.FloatType:
+		if to, ok := t.(*types.FloatType); ok {
+			if from.Kind > to.Kind {
+				return ctx.NewFPTrunc(v, to), true
+			}
+			return ctx.NewFPExt(v, to), true
+		}
+	case *types.PointerType:
+		if _, ok := v.(*constant.Null); ok {
+			if to, ok := t.(*types.PointerType); ok {
+				return constant.NewNull(to), true
+			}
+		}
+		if in, ok := ctx.interfaceOf(t); ok {
+			return ctx.toInterface(v, in)
+		}
+		if from, ok := classOf(from); ok {
+			if to, ok := classOf(t); ok && ctx.Compiler.isSubclass(from, to) {
+				return ctx.NewBitCast(v, t), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// convertArgument converts the argument `v` to the type `t` of the parameter at `index`.
+func (ctx *Context) convertArgument(v value.Value, t types.Type, index int, pos lexer.Position) (value.Value, error) {
+	converted, ok := ctx.convertValue(v, t)
+	if !ok {
+		return nil, posError(pos, "Cannot pass a value of type %s as argument %d of type %s", ctx.TypeToString(v.Type()), index+1, ctx.TypeToString(t))
+	}
+	return converted, nil
+}
+
+// isReachable reports whether any block can branch to b.
+func isReachable(b *ir.Block) bool {
+	if b == b.Parent.Blocks[0] {
+		return true
+	}
+	for _, other := range b.Parent.Blocks {
+		if other.Term == nil {
+			continue
+		}
+		for _, succ := range other.Term.Succs() {
+			if succ == b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isStorage reports whether v is the address of a variable, field or element rather than a value.
+func isStorage(v value.Value) bool {
+	switch v.(type) {
+	case *ir.InstAlloca, *ir.InstGetElementPtr, *ir.Global:
+		return true
+	default:
+		return false
+	}
+}
+
 func (ctx *Context) StringToType(name string) types.Type {
 	pointerCount := strings.Count(name, "*")
 	name = strings.TrimLeft(name, "*")
 
 	var typ types.Type
-	if strings.HasPrefix(name, "i") || strings.HasPrefix(name, "u") {
+	if strings.HasPrefix(name, "i") {
 		size, _ := strconv.Atoi(name[1:])
 		typ = types.NewInt(uint64(size))
+	} else if strings.HasPrefix(name, "u") {
+		size, _ := strconv.Atoi(name[1:])
+		typ = ctx.unsignedInt(uint64(size))
 	} else {
 		switch name {
 		case "void", "":
@@ -151,6 +489,12 @@ func (ctx *Context) TypeToString(typ types.Type) string {
 	case *types.VoidType:
 		return "void"
 	case *types.IntType:
+		if def, ok := ctx.enumOf(typ); ok {
+			return def.name
+		}
+		if ctx.isUnsigned(typ) {
+			return "u" + strconv.Itoa(int(typ.BitSize))
+		}
 		return "i" + strconv.Itoa(int(typ.BitSize))
 	case *types.FloatType:
 		switch typ.Kind {
@@ -166,8 +510,24 @@ func (ctx *Context) TypeToString(typ types.Type) string {
 			panic("Unknown float type")
 		}
 	case *types.PointerType:
+		if sig, ok := typ.ElemType.(*types.FuncType); ok {
+			return ctx.funcTypeString("func", sig)
+		}
 		return "*" + ctx.TypeToString(typ.ElemType)
+	case *types.ArrayType:
+		return "[" + strconv.FormatUint(typ.Len, 10) + "]" + ctx.TypeToString(typ.ElemType)
 	case *types.StructType:
+		if sig, ok := ctx.closureSignature(typ); ok {
+			return ctx.funcTypeString("closure", sig)
+		}
+		if typ.Name() == "" {
+			// The values returned by a function with multiple return types
+			var fields []string
+			for _, field := range typ.Fields {
+				fields = append(fields, ctx.TypeToString(field))
+			}
+			return strings.Join(fields, ", ")
+		}
 		return typ.Name()
 	default:
 		panic("Unknown type")
@@ -2,6 +2,7 @@ package parser
 
 import (
 	"errors"
+	"strings"
 
 	"github.com/alecthomas/participle/v2/lexer"
 )
@@ -21,10 +22,19 @@ func (b *Bool) Capture(values []string) error {
 	}
 }
 
+// Operators collects the operators of a chain of binary operations. Operators
+// made of several tokens like `<=` are joined into a single entry.
+type Operators []string
+
+func (o *Operators) Capture(values []string) error {
+	*o = append(*o, strings.Join(values, ""))
+	return nil
+}
+
 type Value struct {
 	Pos    lexer.Position
 	Array  []*Expression `parser:"'[' ( @@ ( ',' @@ )* )? ']'"`
-	Float  *float64      `parser:"  @('-'? Float)"`
+	Float  *float64      `parser:"| @('-'? Float)"`
 	Int    *int64        `parser:"| @('-'? Int)"`
 	HexInt *string       `parser:"| @('-'? '0x' (Int | 'a' | 'b' | 'c' | 'd' | 'e' | 'f' | 'A' | 'B' | 'C' | 'D' | 'E' | 'F')+)"`
 	Bool   *Bool         `parser:"| @('true' | 'True' | 'false' | 'False')"`
@@ -46,15 +56,36 @@ type ArgumentList struct {
 	Arguments []*Expression `parser:"( @@ ( ',' @@ )* )?"`
 }
 
+// ClassInitializer allocates a class instance on the heap, or on the stack
+// of the current function with `local new`.
 type ClassInitializer struct {
 	Pos       lexer.Position
+	Local     bool         `parser:"@'local'? 'new'"`
 	ClassName string       `parser:"@Ident"`
+	TypeArgs  []*Type      `parser:"( '<' @@ ( ',' @@ )* '>' )?"`
 	Args      ArgumentList `parser:"'(' @@ ')'"`
 }
 
+// Lambda is an anonymous function used as a value. The locals it uses are
+// copied into the closure, unless they are captured by reference with `[&name]`.
+type Lambda struct {
+	Pos        lexer.Position
+	Captures   []*Capture            `parser:"'func' ( '[' @@ ( ',' @@ )* ']' )?"`
+	Parameters []*ArgumentDefinition `parser:"'(' ( @@ ( ',' @@ )* )? ')'"`
+	ReturnType *Type                 `parser:"( ':' @@ )?"`
+	Body       []*Statement          `parser:"'{' @@* '}'"`
+}
+
+type Capture struct {
+	Pos   lexer.Position
+	ByRef bool   `parser:"@'&'?"`
+	Name  string `parser:"@Ident"`
+}
+
 type FunctionCall struct {
 	Pos          lexer.Position
 	FunctionName string       `parser:"@( Ident | String )"`
+	TypeArgs     []*Type      `parser:"( '<' @@ ( ',' @@ )* '>' )?"`
 	Args         ArgumentList `parser:"'(' @@ ')'"`
 }
 
@@ -62,9 +93,11 @@ type Factor struct {
 	Pos              lexer.Position
 	Unpack           bool              `parser:"@'...'?"`
 	Value            *Value            `parser:"  @@"`
-	FunctionCall     *FunctionCall     `parser:"| (?= ( Ident | String ) '(') @@"`
+	Lambda           *Lambda           `parser:"| (?= 'func' ( '[' | '(' )) @@"`
+	Match            *Match            `parser:"| (?= 'match' '(') @@"`
+	FunctionCall     *FunctionCall     `parser:"| (?= ( Ident | String ) ( '<' ( ~( ';' | '{' | '}' | '(' | ')' | '=' | '&' | '|' | '>' ) | '>' (?! '(') )* '>' )? '(') @@"`
 	BitCast          *BitCast          `parser:"| '(' @@"`
-	ClassInitializer *ClassInitializer `parser:"| 'new' @@"`
+	ClassInitializer *ClassInitializer `parser:"| (?= 'local'? 'new') @@"`
 	ClassMethod      *ClassMethod      `parser:"| (?= Ident ( '.' Ident)+ '(') @@"`
 	Identifier       *Identifier       `parser:"| @@"`
 }
@@ -85,78 +118,81 @@ type Assignment struct {
 type Expression struct {
 	Pos       lexer.Position
 	Condition *LogicalOr  `parser:"@@"`
-	True      *Expression `parser:"('?' @@ ':')?"`
-	False     *Expression `parser:"@@?"`
+	True      *Expression `parser:"( '?' @@ ':'"`
+	False     *Expression `parser:"  @@ )?"`
 }
 
+// The binary operator levels are left-associative: Op[i] is applied to the
+// result so far and Right[i].
+
 type LogicalOr struct {
 	Pos   lexer.Position
-	Left  *LogicalAnd  `parser:"@@"`
-	Op    string       `parser:"@( '|' '|' | 'or' )?"`
-	Right []*LogicalOr `parser:"@@?"`
+	Left  *LogicalAnd   `parser:"@@"`
+	Op    Operators     `parser:"( @( '|' '|' | 'or' )"`
+	Right []*LogicalAnd `parser:"  @@ )*"`
 }
 
 type LogicalAnd struct {
 	Pos   lexer.Position
-	Left  *BitwiseOr    `parser:"@@"`
-	Op    string        `parser:"@( '&' '&' | 'and' )?"`
-	Right []*LogicalAnd `parser:"@@?"`
+	Left  *BitwiseOr   `parser:"@@"`
+	Op    Operators    `parser:"( @( '&' '&' | 'and' )"`
+	Right []*BitwiseOr `parser:"  @@ )*"`
 }
 
 type BitwiseOr struct {
 	Pos   lexer.Position
-	Left  *BitwiseXor  `parser:"@@"`
-	Op    string       `parser:"@'|'?"`
-	Right []*BitwiseOr `parser:"@@?"`
+	Left  *BitwiseXor   `parser:"@@"`
+	Op    Operators     `parser:"( @( '|' (?! '|') )"`
+	Right []*BitwiseXor `parser:"  @@ )*"`
 }
 
 type BitwiseXor struct {
 	Pos   lexer.Position
 	Left  *BitwiseAnd   `parser:"@@"`
-	Op    string        `parser:"@'^'?"`
-	Right []*BitwiseXor `parser:"@@?"`
+	Op    Operators     `parser:"( @'^'"`
+	Right []*BitwiseAnd `parser:"  @@ )*"`
 }
 
 type BitwiseAnd struct {
 	Pos   lexer.Position
-	Left  *Equality     `parser:"@@"`
-	Op    string        `parser:"@'&'?"`
-	Right []*BitwiseAnd `parser:"@@?"`
+	Left  *Equality   `parser:"@@"`
+	Op    Operators   `parser:"( @( '&' (?! '&') )"`
+	Right []*Equality `parser:"  @@ )*"`
 }
 
 type Equality struct {
 	Pos   lexer.Position
-	Left  *Relational `parser:"@@"`
-	Op    string      `parser:"@( '=' '=' | '!' '=' )?"`
-	Right []*Equality `parser:"@@?"`
+	Left  *Relational   `parser:"@@"`
+	Op    Operators     `parser:"( @( '=' '=' | '!' '=' )"`
+	Right []*Relational `parser:"  @@ )*"`
 }
 
 type Relational struct {
 	Pos   lexer.Position
-	Left  *Shift        `parser:"@@"`
-	Op    string        `parser:"@( '<' '=' | '>' '=' | '<' | '>' )?"`
-	Right []*Relational `parser:"@@?"`
+	Left  *Shift    `parser:"@@"`
+	Op    Operators `parser:"( @( '<' '=' | '>' '=' | '<' | '>' )"`
+	Right []*Shift  `parser:"  @@ )*"`
 }
 
 type Shift struct {
 	Pos   lexer.Position
-	Left  *Additive `parser:"@@"`
-	Op    string    `parser:"@( '<' '<' | '>' '>' | '>' '>' '>' )?"`
-	Right []*Shift  `parser:"@@?"`
+	Left  *Additive   `parser:"@@"`
+	Op    Operators   `parser:"( @( '<' '<' | '>' '>' '>'? )"`
+	Right []*Additive `parser:"  @@ )*"`
 }
 
 type Additive struct {
 	Pos   lexer.Position
-	Left  *Multiplicative `parser:"@@"`
-	Op    string          `parser:"@( '+' | '-' )?"`
-	Right []*Additive     `parser:"@@?"`
+	Left  *Multiplicative   `parser:"@@"`
+	Op    Operators         `parser:"( @( '+' | '-' )"`
+	Right []*Multiplicative `parser:"  @@ )*"`
 }
 
 type Multiplicative struct {
 	Pos   lexer.Position
-	Left  *LogicalNot       `parser:"@@"`
-	Op    string            `parser:"@( '*' | '/' | '%' )?"`
-	Right []*Multiplicative `parser:"@@?"`
+	Left  *LogicalNot   `parser:"@@"`
+	Op    Operators     `parser:"( @( '*' | '/' | '%' )"`
+	Right []*LogicalNot `parser:"  @@ )*"`
 }
 
 type LogicalNot struct {
@@ -167,7 +203,14 @@ type LogicalNot struct {
 
 type BitwiseNot struct {
 	Pos   lexer.Position
-	Op    string          `parser:"@'~'?"`
+	Op    string    `parser:"@'~'?"`
+	Right *Negation `parser:"@@"`
+}
+
+// Negative literals are part of the Value, so they stay constants
+type Negation struct {
+	Pos   lexer.Position
+	Op    string          `parser:"@( '-' (?! '-' | Int | Float) )?"`
 	Right *PrefixAdditive `parser:"@@"`
 }
 
@@ -185,15 +228,25 @@ type PostfixAdditive struct {
 
 type VariableDefinition struct {
 	Pos        lexer.Position
-	Constant   string      `parser:"@('const' | 'var')"`
-	Name       string      `parser:"@Ident"`
-	Type       *Type       `parser:"':' @@"`
-	Assignment *Expression `parser:"( '=' @@ )?"`
+	Constant   string             `parser:"@('const' | 'var')"`
+	Name       string             `parser:"@Ident"`
+	Type       *Type              `parser:"( ':' @@ )?"`
+	Rest       []*VariableBinding `parser:"( ',' @@ )*"`
+	Assignment *Expression        `parser:"( '=' @@ )?"`
+}
+
+// VariableBinding is one of the additional variables of a definition that
+// unpacks a function's multiple return values, like `y` in `var x: i64, y: f64 = f();`
+type VariableBinding struct {
+	Pos  lexer.Position
+	Name string `parser:"@Ident"`
+	Type *Type  `parser:"( ':' @@ )?"`
 }
 
 type FieldDefinition struct {
 	Pos     lexer.Position
 	Private bool   `parser:"@'private'?"`
+	Static  bool   `parser:"@'static'?"`
 	Name    string `parser:"@Ident"`
 	Type    *Type  `parser:"':' @@ ';'"`
 }
@@ -216,7 +269,10 @@ type FunctionDefinition struct {
 	Pos        lexer.Position
 	Private    bool                  `parser:"@'private'?"`
 	Static     bool                  `parser:"@'static'?"`
+	Virtual    bool                  `parser:"( @'virtual'"`
+	Override   bool                  `parser:"| @'override' )?"`
 	Name       FuncName              `parser:"@@"`
+	TypeParams []string              `parser:"( '<' @Ident ( ',' @Ident )* '>' )?"`
 	Parameters []*ArgumentDefinition `parser:"'(' ( @@ ( ',' @@ )* )?"`
 	Variadic   string                `parser:"(',' '.' '.' '.' @Ident)?"`
 	ReturnType []*Type               `parser:"')' ( ':' @@ ( ',' @@ )* )?"`
@@ -224,9 +280,70 @@ type FunctionDefinition struct {
 }
 
 type ClassDefinition struct {
-	Pos  lexer.Position
-	Name string       `parser:"@Ident"`
-	Body []*Statement `parser:"'{' @@* '}'"`
+	Pos        lexer.Position
+	Name       string       `parser:"@Ident"`
+	TypeParams []string     `parser:"( '<' @Ident ( ',' @Ident )* '>' )?"`
+	Extends    string       `parser:"( 'extends' @Ident )?"`
+	Implements []string     `parser:"( 'implements' @Ident ( ',' @Ident )* )?"`
+	Body       []*Statement `parser:"'{' @@* '}'"`
+}
+
+// InterfaceDefinition lists the methods a class needs to implement the interface.
+type InterfaceDefinition struct {
+	Pos     lexer.Position
+	Name    string             `parser:"@Ident"`
+	Methods []*InterfaceMethod `parser:"'{' @@* '}'"`
+}
+
+// EnumDefinition declares an integer type with named values, like
+// `enum Color: u8 { Red, Green = 5, Blue }`.
+type EnumDefinition struct {
+	Pos      lexer.Position
+	Name     string         `parser:"@Ident"`
+	Type     *Type          `parser:"( ':' @@ )?"`
+	Variants []*EnumVariant `parser:"'{' ( @@ ( ',' @@ )* ','? )? '}'"`
+}
+
+type EnumVariant struct {
+	Pos   lexer.Position
+	Name  string `parser:"@Ident"`
+	Value *int64 `parser:"( '=' @('-'? Int) )?"`
+}
+
+// UnionDefinition declares a tagged union, a type holding a value of one of
+// its variants, like `union Shape { Circle(r: f64), Rect(w: f64, h: f64) }`.
+type UnionDefinition struct {
+	Pos      lexer.Position
+	Name     string          `parser:"@Ident"`
+	Variants []*UnionVariant `parser:"'{' ( @@ ( ',' @@ )* ','? )? '}'"`
+}
+
+type UnionVariant struct {
+	Pos    lexer.Position
+	Name   string                `parser:"@Ident"`
+	Fields []*ArgumentDefinition `parser:"( '(' ( @@ ( ',' @@ )* )? ')' )?"`
+}
+
+// Match evaluates the arm for the variant held by a union value, with the
+// fields of the variant bound to the names the arm lists. `_` matches any variant.
+type Match struct {
+	Pos   lexer.Position
+	Value *Expression `parser:"'match' '(' @@ ')'"`
+	Arms  []*MatchArm `parser:"'{' ( @@ ( ',' @@ )* ','? )? '}'"`
+}
+
+type MatchArm struct {
+	Pos      lexer.Position
+	Variant  string      `parser:"@Ident"`
+	Bindings []string    `parser:"( '(' ( @Ident ( ',' @Ident )* )? ')' )?"`
+	Body     *Expression `parser:"'=' '>' @@"`
+}
+
+type InterfaceMethod struct {
+	Pos        lexer.Position
+	Name       string                `parser:"'func' @Ident"`
+	Parameters []*ArgumentDefinition `parser:"'(' ( @@ ( ',' @@ )* )? ')'"`
+	ReturnType *Type                 `parser:"( ':' @@ )? ';'"`
 }
 
 type ClassMethod struct {
@@ -269,6 +386,14 @@ type Until struct {
 	Body      []*Statement `parser:"'{' @@* '}'"`
 }
 
+type Labeled struct {
+	Pos   lexer.Position
+	Label string `parser:"@Ident ':'"`
+	For   *For   `parser:"( 'for' @@"`
+	While *While `parser:"| 'while' @@"`
+	Until *Until `parser:"| 'until' @@ )"`
+}
+
 type Switch struct {
 	Pos       lexer.Position
 	Condition *Expression  `parser:"'(' @@ ')'"`
@@ -279,7 +404,17 @@ type Switch struct {
 type Case struct {
 	Pos    lexer.Position
 	Values []*Expression `parser:"'case' @@ ( ',' @@ )* ':'"`
-	Body   []*Statement  `parser:"@@*"`
+	Body   []*Statement  `parser:"( (?! 'case' | 'default' ) @@ )*"`
+}
+
+type Break struct {
+	Pos   lexer.Position
+	Label string `parser:"'break' ((?= Ident ';') @Ident)? ';'?"`
+}
+
+type Continue struct {
+	Pos   lexer.Position
+	Label string `parser:"'continue' ((?= Ident ';') @Ident)? ';'?"`
 }
 
 type Return struct {
@@ -297,23 +432,51 @@ type ExternalFunctionDefinition struct {
 
 type TryCatch struct {
 	Pos   lexer.Position
-	Try   []*Statement `parser:"'try' '{' @@* '}'"`
-	Catch *Catch       `parser:"'catch' @@"`
+	Try   []*Statement `parser:"'{' @@* '}'"`
+	Catch *Catch       `parser:"('catch' @@)?"`
 	Final []*Statement `parser:"('finally' '{' @@* '}')?"`
 }
 
 type Catch struct {
 	Pos  lexer.Position
 	Name string       `parser:"@Ident"`
+	Type *Type        `parser:"(':' @@)?"`
 	Body []*Statement `parser:"'{' @@* '}'"`
 }
 
-type Type struct {
+type Throw struct {
 	Pos   lexer.Position
-	Array *Expression `parser:"('[' @@ ']')?"`
-	Ptr   string      `parser:"@'*'*"`
-	Name  string      `parser:"@Ident"`
-	Inner *Type       `parser:"| @@"`
+	Value *Expression `parser:"@@ ';'"`
+}
+
+type Delete struct {
+	Pos   lexer.Position
+	Value *Expression `parser:"@@ ';'"`
+}
+
+type Defer struct {
+	Pos       lexer.Position
+	Statement *Statement `parser:"@@"`
+}
+
+type Type struct {
+	Pos      lexer.Position
+	Array    *Expression `parser:"('[' @@ ']')?"`
+	Ptr      string      `parser:"@'*'*"`
+	Func     *FuncType   `parser:"( @@"`
+	Name     string      `parser:"| @Ident"`
+	TypeArgs []*Type     `parser:"  ( (?= '<' ( '[' ~']'* ']' )? '*'* Ident ( '<' | '>' | ',' )) '<' @@ ( ',' @@ )* '>' )? )"`
+	Inner    *Type       `parser:"| @@"`
+}
+
+// FuncType is the type of a pointer to a function, like `func(i64, *i8): i32`,
+// or of a closure, like `closure(i64): i64`.
+type FuncType struct {
+	Pos        lexer.Position
+	Closure    bool    `parser:"( 'func' | @'closure' ) '('"`
+	Parameters []*Type `parser:"( (?! ')') @@ ( ',' (?! '.') @@ )* )?"`
+	Variadic   bool    `parser:"@(',' '.' '.' '.')? ')'"`
+	ReturnType *Type   `parser:"( ':' @@ )?"`
 }
 
 type Import struct {
@@ -338,28 +501,35 @@ type Symbol struct {
 }
 
 type Statement struct {
-	Pos                lexer.Position
-	VariableDefinition *VariableDefinition         `parser:"(?= ('const' | 'var') Ident) @@? (';' | '\\n')?"`
-	Assignment         *Assignment                 `parser:"| (?= Ident ('['~']'']')?('.'Ident('['~']'']')?)*(','Ident('['~']'']')?('.'Ident('['~']'']')?)*)*('+'|'-'|'*'|'/'|'%'|'&'|'|'|'^'|'<''<'|'>''>'|'>''>''>'|'?''?')?'=')@@?(';' | '\\n')?"`
-	External           *ExternalFunctionDefinition `parser:"| 'extern' @@ ';'"`
-	Export             *Statement                  `parser:"| 'export' @@"`
-	FunctionDefinition *FunctionDefinition         `parser:"| (?= 'private'? 'static'? 'func') @@?"`
-	TryCatch           *TryCatch                   `parser:"| 'try' @@"`
-	Switch             *Switch                     `parser:"| 'switch' @@"`
-	ClassDefinition    *ClassDefinition            `parser:"| 'class' @@?"`
-	If                 *If                         `parser:"| 'if' @@?"`
-	For                *For                        `parser:"| 'for' @@?"`
-	While              *While                      `parser:"| 'while' @@?"`
-	Until              *Until                      `parser:"| 'until' @@?"`
-	Return             *Return                     `parser:"| 'return' @@?"`
-	FieldDefinition    *FieldDefinition            `parser:"| (?= 'private'? Ident ':' ('[' ~']' ']')? '*'* Ident) @@?"`
-	Import             *Import                     `parser:"| 'import' @@?"`
-	FromImportMultiple *FromImportMultiple         `parser:"| (?= 'from' String 'import' '{') @@?"`
-	FromImport         *FromImport                 `parser:"| (?= 'from' String 'import') @@?"`
-	Break              *string                     `parser:"| @('break' (';' | '\\n')?)"`
-	Continue           *string                     `parser:"| @('continue' (';' | '\\n')?)"`
-	Comment            *string                     `parser:"| @Comment"`
-	Expression         *Expression                 `parser:"| @@ ';'"`
+	Pos                 lexer.Position
+	VariableDefinition  *VariableDefinition         `parser:"(?= ('const' | 'var') Ident) @@? (';' | '\\n')?"`
+	Assignment          *Assignment                 `parser:"| (?= '*'* Ident ('['~']'']')?('.'Ident('['~']'']')?)*(',' '*'* Ident('['~']'']')?('.'Ident('['~']'']')?)*)*('+'|'-'|'*'|'/'|'%'|'&'|'|'|'^'|'<''<'|'>''>'|'>''>''>'|'?''?')?'=')@@?(';' | '\\n')?"`
+	External            *ExternalFunctionDefinition `parser:"| 'extern' @@ ';'"`
+	Export              *Statement                  `parser:"| 'export' @@"`
+	FunctionDefinition  *FunctionDefinition         `parser:"| (?= 'private'? 'static'? ( 'virtual' | 'override' )? 'func') @@?"`
+	TryCatch            *TryCatch                   `parser:"| 'try' @@"`
+	Switch              *Switch                     `parser:"| 'switch' @@"`
+	ClassDefinition     *ClassDefinition            `parser:"| 'class' @@?"`
+	InterfaceDefinition *InterfaceDefinition        `parser:"| 'interface' @@"`
+	EnumDefinition      *EnumDefinition             `parser:"| 'enum' @@"`
+	UnionDefinition     *UnionDefinition            `parser:"| 'union' @@"`
+	Labeled             *Labeled                    `parser:"| (?= Ident ':' ('for' | 'while' | 'until')) @@"`
+	If                  *If                         `parser:"| 'if' @@?"`
+	For                 *For                        `parser:"| 'for' @@?"`
+	While               *While                      `parser:"| 'while' @@?"`
+	Until               *Until                      `parser:"| 'until' @@?"`
+	Return              *Return                     `parser:"| 'return' @@?"`
+	Throw               *Throw                      `parser:"| 'throw' @@"`
+	Delete              *Delete                     `parser:"| 'delete' @@"`
+	Defer               *Defer                      `parser:"| 'defer' @@"`
+	FieldDefinition     *FieldDefinition            `parser:"| (?= 'private'? 'static'? Ident ':' ('[' ~']' ']')? '*'* Ident) @@?"`
+	Import              *Import                     `parser:"| 'import' @@?"`
+	FromImportMultiple  *FromImportMultiple         `parser:"| (?= 'from' String 'import' '{') @@?"`
+	FromImport          *FromImport                 `parser:"| (?= 'from' String 'import') @@?"`
+	Break               *Break                      `parser:"| (?= 'break') @@"`
+	Continue            *Continue                   `parser:"| (?= 'continue') @@"`
+	Comment             *string                     `parser:"| @Comment"`
+	Expression          *Expression                 `parser:"| @@ ';'"`
 }
 
 type Program struct {
@@ -27,6 +27,8 @@ type CFConfCompiler struct {
 	ClangFlags        string `yaml:"clangFlags"`
 	GCCFlags          string `yaml:"gccFlags"`
 	LLCFlags          string `yaml:"llcFlags"`
+	Allocator         string `yaml:"allocator"`
+	Deallocator       string `yaml:"deallocator"`
 }
 
 type CFConfDependency struct {